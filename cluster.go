@@ -0,0 +1,236 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// clusterMetrics maps the names of the metrics which clusterCollector sums
+// across the cluster to the names of the sums.
+var clusterMetrics = map[string]string{
+	"dnsmasq_leases":     "dnsmasq_cluster_leases",
+	"dnsmasq_cachesize":  "dnsmasq_cluster_cachesize",
+	"dnsmasq_insertions": "dnsmasq_cluster_insertions",
+	"dnsmasq_evictions":  "dnsmasq_cluster_evictions",
+	"dnsmasq_misses":     "dnsmasq_cluster_misses",
+	"dnsmasq_hits":       "dnsmasq_cluster_hits",
+	"dnsmasq_auth":       "dnsmasq_cluster_auth",
+	// With -counter_records.
+	"dnsmasq_insertions_total": "dnsmasq_cluster_insertions_total",
+	"dnsmasq_evictions_total":  "dnsmasq_cluster_evictions_total",
+	"dnsmasq_misses_total":     "dnsmasq_cluster_misses_total",
+	"dnsmasq_hits_total":       "dnsmasq_cluster_hits_total",
+	"dnsmasq_auth_total":       "dnsmasq_cluster_auth_total",
+}
+
+var (
+	peerUp = prometheus.NewDesc(
+		"dnsmasq_cluster_peer_up",
+		"Whether the metrics of the peer exporter could be scraped in the last scrape",
+		[]string{"peer"}, nil,
+	)
+
+	peersFailed = prometheus.NewDesc(
+		"dnsmasq_cluster_peers_failed",
+		"Number of peer exporters which could not be scraped in the last scrape, i.e. which are missing from the dnsmasq_cluster_* sums",
+		nil, nil,
+	)
+)
+
+// peerHeader marks the scrapes of a clusterCollector. Exporters answer them
+// without their own cluster metrics, so that exporters which list each other
+// in -peers do not scrape each other recursively.
+const peerHeader = "X-Dnsmasq-Exporter-Peer"
+
+// clusterCollector aggregates the dnsmasq metrics of a cluster of exporters,
+// e.g. a pair of dnsmasq instances serving the same network: it exposes the
+// sums of the clusterMetrics of the local exporter and its peers. Peers which
+// cannot be scraped are left out of the sums.
+type clusterCollector struct {
+	local  prometheus.Gatherer
+	peers  []string // URLs of the peers' metrics
+	token  string   // sent as bearer token, see -auth_token
+	client *http.Client
+	descs  map[string]*prometheus.Desc // keyed by the name of the summed metric
+}
+
+// clusterSum is the sum of a metric across the cluster, exposed with the
+// type of the summed metric.
+type clusterSum struct {
+	value     float64
+	valueType prometheus.ValueType
+}
+
+// newClusterCollector returns a clusterCollector for the local dnsmasq
+// metrics and the peers (URLs or host:port), scraping each peer with the
+// given timeout and, if non-empty, bearer token.
+func newClusterCollector(local prometheus.Gatherer, peers []string, timeout time.Duration, token string) *clusterCollector {
+	c := &clusterCollector{
+		local:  local,
+		token:  token,
+		client: &http.Client{Timeout: timeout},
+		descs:  make(map[string]*prometheus.Desc),
+	}
+	for _, peer := range peers {
+		c.peers = append(c.peers, peerURL(peer))
+	}
+	for name, clusterName := range clusterMetrics {
+		c.descs[name] = prometheus.NewDesc(
+			clusterName,
+			fmt.Sprintf("Sum of %s across this exporter and its -peers", name),
+			nil, nil,
+		)
+	}
+	return c
+}
+
+// peerURL returns the URL of the metrics of peer, which defaults to
+// http://peer/metrics if peer is not a URL.
+func peerURL(peer string) string {
+	if strings.Contains(peer, "://") {
+		return peer
+	}
+	return "http://" + peer + "/metrics"
+}
+
+func (c *clusterCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range c.descs {
+		ch <- d
+	}
+	ch <- peerUp
+	ch <- peersFailed
+}
+
+func (c *clusterCollector) Collect(ch chan<- prometheus.Metric) {
+	sums := make(map[string]clusterSum)
+	mfs, err := c.local.Gather()
+	if err != nil {
+		log.Printf("gathering the local metrics: %v", err)
+	}
+	// Gather returns the metrics it could gather even if it fails.
+	for _, mf := range mfs {
+		addClusterMetrics(sums, mf)
+	}
+
+	peerMetrics := make([]map[string]*dto.MetricFamily, len(c.peers))
+	var wg sync.WaitGroup
+	for i, peer := range c.peers {
+		wg.Add(1)
+		go func(i int, peer string) {
+			defer wg.Done()
+			mfs, err := c.scrape(peer)
+			if err != nil {
+				log.Printf("scraping peer %s: %v", peer, err)
+				return
+			}
+			peerMetrics[i] = mfs
+		}(i, peer)
+	}
+	wg.Wait()
+
+	var failed int
+	for i, peer := range c.peers {
+		var v float64
+		if mfs := peerMetrics[i]; mfs != nil {
+			v = 1
+			for _, mf := range mfs {
+				addClusterMetrics(sums, mf)
+			}
+		} else {
+			failed++
+		}
+		ch <- prometheus.MustNewConstMetric(peerUp, prometheus.GaugeValue, v, peer)
+	}
+	ch <- prometheus.MustNewConstMetric(peersFailed, prometheus.GaugeValue, float64(failed))
+	for name, sum := range sums {
+		ch <- prometheus.MustNewConstMetric(c.descs[name], sum.valueType, sum.value)
+	}
+}
+
+// scrape fetches and parses the metrics of peer.
+func (c *clusterCollector) scrape(peer string) (map[string]*dto.MetricFamily, error) {
+	req, err := http.NewRequest("GET", peer, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(peerHeader, "1")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected HTTP status %s", resp.Status)
+	}
+	var parser expfmt.TextParser
+	return parser.TextToMetricFamilies(resp.Body)
+}
+
+// addClusterMetrics adds the values of mf (summed across all label values)
+// to sums if it is one of the clusterMetrics. The sum takes the type of mf;
+// if instances disagree (e.g. a peer with different -counter_records), the
+// last one wins.
+func addClusterMetrics(sums map[string]clusterSum, mf *dto.MetricFamily) {
+	name := mf.GetName()
+	if _, ok := clusterMetrics[name]; !ok {
+		return
+	}
+	sum := sums[name]
+	switch mf.GetType() {
+	case dto.MetricType_COUNTER:
+		sum.valueType = prometheus.CounterValue
+	case dto.MetricType_GAUGE:
+		sum.valueType = prometheus.GaugeValue
+	default:
+		sum.valueType = prometheus.UntypedValue
+	}
+	for _, m := range mf.GetMetric() {
+		switch {
+		case m.Gauge != nil:
+			sum.value += m.GetGauge().GetValue()
+		case m.Counter != nil:
+			sum.value += m.GetCounter().GetValue()
+		case m.Untyped != nil:
+			sum.value += m.GetUntyped().GetValue()
+		}
+	}
+	sums[name] = sum
+}
+
+// peerAwareHandler serves the scrapes of clusterCollectors (see peerHeader)
+// with local, which must not include the cluster metrics, and all other
+// requests with h.
+func peerAwareHandler(local, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(peerHeader) != "" {
+			local.ServeHTTP(w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -17,14 +17,33 @@ package collector
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math"
+	mathrand "math/rand"
+	"net"
+	"net/http"
 	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/idna"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -69,6 +88,82 @@ var (
 		),
 	}
 
+	// counterMetrics replace floatMetrics for Config.CounterRecords:
+	// counters are named with a _total suffix, as OpenMetrics requires.
+	counterMetrics = map[string]*prometheus.Desc{
+		"cachesize.bind.": prometheus.NewDesc(
+			"dnsmasq_cachesize_total",
+			"configured size of the DNS cache",
+			nil, nil,
+		),
+
+		"insertions.bind.": prometheus.NewDesc(
+			"dnsmasq_insertions_total",
+			"DNS cache insertions",
+			nil, nil,
+		),
+
+		"evictions.bind.": prometheus.NewDesc(
+			"dnsmasq_evictions_total",
+			"DNS cache exictions: numbers of entries which replaced an unexpired cache entry",
+			nil, nil,
+		),
+
+		"misses.bind.": prometheus.NewDesc(
+			"dnsmasq_misses_total",
+			"DNS cache misses: queries which had to be forwarded",
+			nil, nil,
+		),
+
+		"hits.bind.": prometheus.NewDesc(
+			"dnsmasq_hits_total",
+			"DNS queries answered locally (cache hits)",
+			nil, nil,
+		),
+
+		"auth.bind.": prometheus.NewDesc(
+			"dnsmasq_auth_total",
+			"DNS queries for authoritative zones",
+			nil, nil,
+		),
+	}
+
+	cacheUndersized = prometheus.NewDesc(
+		"dnsmasq_cache_undersized",
+		"Whether entries were evicted from the full cache since the previous scrape, hinting that cachesize is too small",
+		nil, nil,
+	)
+
+	cacheHitRatio = prometheus.NewDesc(
+		"dnsmasq_cache_hit_ratio",
+		"Ratio of DNS cache hits to all queries (hits and misses)",
+		nil, nil,
+	)
+
+	statsResponseBytes = prometheus.NewDesc(
+		"dnsmasq_stats_response_bytes",
+		"Size of the DNS response to the stats query (responses over UDP larger than 512 bytes may be truncated)",
+		[]string{"record"}, nil,
+	)
+
+	queriesPerSecond = prometheus.NewDesc(
+		"dnsmasq_queries_per_second",
+		"Rate of DNS queries answered from the cache (hits) or not (misses) since the previous scrape, see -compute_rates",
+		[]string{"type"}, nil,
+	)
+
+	statsLastSuccess = prometheus.NewDesc(
+		"dnsmasq_stats_last_success_timestamp_seconds",
+		"Unix time of the last stats query which succeeded and could be parsed, by stats DNS record",
+		[]string{"record"}, nil,
+	)
+
+	queriesForwarded = prometheus.NewDesc(
+		"dnsmasq_queries_forwarded_total",
+		"DNS queries forwarded to upstream servers (sum over all servers)",
+		nil, nil,
+	)
+
 	serversMetrics = map[string]*prometheus.Desc{
 		"queries": prometheus.NewDesc(
 			"dnsmasq_servers_queries",
@@ -82,12 +177,61 @@ var (
 		),
 	}
 
+	// serversExtraStat is exposed with Config.ServerExtraStats.
+	serversExtraStat = prometheus.NewDesc(
+		"dnsmasq_servers_extra_stat",
+		"Numeric fields which follow the queries and failed queries of an upstream server in servers.bind, by zero-based field index",
+		[]string{"server", "field"}, nil,
+	)
+
+	// serversExtraStatSplit replaces serversExtraStat with
+	// Config.SplitServerAddr.
+	serversExtraStatSplit = prometheus.NewDesc(
+		"dnsmasq_servers_extra_stat",
+		"Numeric fields which follow the queries and failed queries of an upstream server in servers.bind, by zero-based field index",
+		[]string{"server_ip", "server_port", "field"}, nil,
+	)
+
+	// serversMetricsSplit replace serversMetrics with
+	// Config.SplitServerAddr.
+	serversMetricsSplit = map[string]*prometheus.Desc{
+		"queries": prometheus.NewDesc(
+			"dnsmasq_servers_queries",
+			"DNS queries on upstream server",
+			[]string{"server_ip", "server_port"}, nil,
+		),
+		"queries_failed": prometheus.NewDesc(
+			"dnsmasq_servers_queries_failed",
+			"DNS queries failed on upstream server",
+			[]string{"server_ip", "server_port"}, nil,
+		),
+	}
+
 	// individual lease metrics have high cardinality and are thus disabled by
 	// default, unless enabled with the -expose_leases flag
 	leaseMetrics = prometheus.NewDesc(
 		"dnsmasq_lease_expiry",
-		"Expiry time for active DHCP leases",
-		[]string{"mac_addr", "ip_addr", "computer_name", "client_id"},
+		"Expiry time for active DHCP leases. DHCPv4 leases have a mac_addr, DHCPv6 leases an iaid instead",
+		[]string{"mac_addr", "ip_addr", "computer_name", "client_id", "iaid"},
+		nil,
+	)
+
+	// leaseMetricsIDN replaces leaseMetrics with Config.DecodeIDNHostnames.
+	leaseMetricsIDN = prometheus.NewDesc(
+		"dnsmasq_lease_expiry",
+		"Expiry time for active DHCP leases. DHCPv4 leases have a mac_addr, DHCPv6 leases an iaid instead. computer_name is decoded from punycode, computer_name_raw is as in the leases file",
+		[]string{"mac_addr", "ip_addr", "computer_name", "computer_name_raw", "client_id", "iaid"},
+		nil,
+	)
+
+	// leaseAge is exposed along with leaseMetrics if the issue time of the
+	// leases is known (see Config.DhcpLeaseTime) and Config.OpenMetrics is
+	// set. It is a counter which started at the issue time, which is its
+	// created timestamp in the OpenMetrics format.
+	leaseAge = prometheus.NewDesc(
+		"dnsmasq_lease_age_seconds_total",
+		"Time since active DHCP leases were issued or last renewed, estimated as their expiry minus -dhcp_lease_time (infinite leases are omitted)",
+		[]string{"mac_addr", "ip_addr", "computer_name", "client_id", "iaid"},
 		nil,
 	)
 
@@ -96,6 +240,174 @@ var (
 		"Number of DHCP leases handed out",
 		nil, nil,
 	)
+
+	leasesExpiringSoon = prometheus.NewDesc(
+		"dnsmasq_leases_expiring_soon",
+		"Number of DHCP leases expiring within -expiry_warning",
+		nil, nil,
+	)
+
+	transportInfo = prometheus.NewDesc(
+		"dnsmasq_exporter_transport_info",
+		"Transport used for the stats queries, always 1",
+		[]string{"protocol"}, nil,
+	)
+
+	exposeLeasesDesc = prometheus.NewDesc(
+		"dnsmasq_exporter_expose_leases",
+		"Whether per-lease series are exposed (-expose_leases)",
+		nil, nil,
+	)
+
+	protocolFallbackSuggested = prometheus.NewDesc(
+		"dnsmasq_protocol_fallback_suggested",
+		"Whether the first scrape failed but dnsmasq answered over the alternate protocol",
+		nil, nil,
+	)
+
+	clockSkewSuspected = prometheus.NewDesc(
+		"dnsmasq_clock_skew_suspected",
+		"Whether so many DHCP leases appear already expired (or, with -dhcp_lease_time, to expire later than possible) that the clock is likely wrong, e.g. before NTP synced on a router without RTC",
+		nil, nil,
+	)
+
+	leaseRemaining = prometheus.NewDesc(
+		"dnsmasq_lease_remaining_seconds",
+		"Summary of the time until expiry of the DHCP leases, excluding infinite and expired leases",
+		nil, nil,
+	)
+
+	oldestLeaseAge = prometheus.NewDesc(
+		"dnsmasq_oldest_lease_age_seconds",
+		"Time since the oldest DHCP lease was issued or last renewed, estimated as its expiry minus -dhcp_lease_time (infinite leases are ignored)",
+		nil, nil,
+	)
+
+	leasesIssuedToday = prometheus.NewDesc(
+		"dnsmasq_leases_issued_today",
+		"Estimated number of active DHCP leases issued since midnight, according to -dhcp_lease_time",
+		nil, nil,
+	)
+
+	leasesReadDuration = prometheus.NewDesc(
+		"dnsmasq_leases_read_duration_seconds",
+		"Time it took to read and parse the leases file(s)",
+		nil, nil,
+	)
+
+	leasesSkipped = prometheus.NewDesc(
+		"dnsmasq_leases_skipped",
+		"Number of lease lines or leases skipped by design in the last scrape, by reason",
+		[]string{"reason"}, nil,
+	)
+
+	leasesFileLines = prometheus.NewDesc(
+		"dnsmasq_leases_file_lines",
+		"Number of lines in the leases file(s), including lines which were skipped or could not be parsed",
+		nil, nil,
+	)
+
+	pdLeasesDesc = prometheus.NewDesc(
+		"dnsmasq_pd_leases",
+		"Number of DHCPv6 prefix delegation leases",
+		nil, nil,
+	)
+
+	poolUtilization = prometheus.NewDesc(
+		"dnsmasq_dhcp_pool_utilization",
+		"Number of DHCP leases divided by -dhcp_pool_size (0 to 1)",
+		nil, nil,
+	)
+
+	leasesRange = prometheus.NewDesc(
+		"dnsmasq_leases_range",
+		"Number of DHCP leases per configured DHCP range",
+		[]string{"range"}, nil,
+	)
+
+	leasesRangeHighWater = prometheus.NewDesc(
+		"dnsmasq_leases_range_high_water",
+		"Maximum number of DHCP leases per configured DHCP range since the exporter started",
+		[]string{"range"}, nil,
+	)
+
+	up = prometheus.NewDesc(
+		"dnsmasq_up",
+		"Whether the dnsmasq stats could be queried in the last scrape",
+		nil, nil,
+	)
+
+	cacheAge = prometheus.NewDesc(
+		"dnsmasq_metrics_cache_age_seconds",
+		"Time since the served metrics were collected, see -cache_duration",
+		nil, nil,
+	)
+
+	leasesLifecycle = prometheus.NewDesc(
+		"dnsmasq_leases_lifecycle",
+		"Number of DHCP leases in the early (first half) or late (second half) phase of their lifetime, according to -dhcp_lease_time",
+		[]string{"phase"}, nil,
+	)
+
+	leasesUnknownHostname = prometheus.NewDesc(
+		"dnsmasq_leases_unknown_hostname",
+		"Number of DHCP leases whose client did not send a hostname",
+		nil, nil,
+	)
+
+	uniqueClients = prometheus.NewDesc(
+		"dnsmasq_unique_clients",
+		"Number of distinct DHCP clients (by MAC address, or client ID for DHCPv6 leases)",
+		nil, nil,
+	)
+
+	leasesChurn = prometheus.NewDesc(
+		"dnsmasq_leases_churn_per_minute",
+		"Number of DHCP leases added or removed per minute, averaged over -lease_churn_window",
+		nil, nil,
+	)
+
+	leasePTRMismatch = prometheus.NewDesc(
+		"dnsmasq_lease_ptr_mismatch",
+		"Number of DHCP leases whose IP address does not resolve (PTR) to their hostname, which can indicate stale DNS",
+		nil, nil,
+	)
+
+	leasesByClientIDType = prometheus.NewDesc(
+		"dnsmasq_leases_by_clientid_type",
+		"Number of DHCP leases by the form of their client ID: mac (hardware type and MAC address), duid (DHCPv6 or RFC 4361 DUID) or other (including none)",
+		[]string{"type"}, nil,
+	)
+
+	leaseDUIDConflicts = prometheus.NewDesc(
+		"dnsmasq_lease_duid_conflicts",
+		"Number of client DUIDs which appear in DHCPv6 leases with different IAIDs",
+		nil, nil,
+	)
+
+	leasesByVendor = prometheus.NewDesc(
+		"dnsmasq_leases_by_vendor",
+		"Number of DHCP leases by vendor, as classified by MAC address prefix",
+		[]string{"vendor"}, nil,
+	)
+
+	leasesMatched = prometheus.NewDesc(
+		"dnsmasq_leases_matched",
+		"Number of DHCP leases whose hostname matches one of the patterns of a bucket",
+		[]string{"bucket"}, nil,
+	)
+
+	leasesFileMode = prometheus.NewDesc(
+		"dnsmasq_leases_file_mode",
+		"Permission bits of the DHCP leases file (e.g. 420 for 0644)",
+		nil, nil,
+	)
+
+	leaseSeriesTruncated = prometheus.NewDesc(
+		"dnsmasq_lease_series_truncated",
+		"Whether per-lease series were omitted because their number would exceed -max_lease_series",
+		nil, nil,
+	)
 )
 
 // From https://manpages.debian.org/stretch/dnsmasq-base/dnsmasq.8.en.html:
@@ -106,105 +418,1901 @@ var (
 // be:
 //     dig +short chaos txt cachesize.bind
 
+// Exchanger sends DNS queries. It is implemented by *dns.Client, so users of
+// this package can customize the transport (e.g. Net "tcp-tls" with a
+// TLSConfig), timeouts and source address by passing their own *dns.Client
+// as Config.DnsClient, or wrap one to add retries or logging.
+type Exchanger interface {
+	Exchange(m *dns.Msg, address string) (r *dns.Msg, rtt time.Duration, err error)
+}
+
 // Config contains the configuration for the collector.
+//
+// Either DnsmasqAddr or LeasesPath (and LeasesGlob) may be left empty to only collect the
+// dnsmasq stats or only the DHCP leases, respectively. A collector which only
+// collects leases does not expose dnsmasq_scrape_errors_total, so that it
+// can be combined with stats-only collectors whose metrics carry additional
+// labels.
 type Config struct {
-	DnsClient    *dns.Client
+	DnsClient    Exchanger
 	DnsmasqAddr  string
 	LeasesPath   string
 	ExposeLeases bool
+
+	// MaxLeaseSeries limits the number of per-lease series (one per active
+	// lease, two with dnsmasq_lease_age_seconds_total). If there would be
+	// more, no per-lease series are exposed at all. Zero means no limit.
+	MaxLeaseSeries int
+
+	// FailedStats controls what is exposed for a stats record whose query
+	// failed: FailedStatsOmit (the default) omits the metric and skips the
+	// remaining stats queries of the scrape, FailedStatsNaN exposes NaN and
+	// FailedStatsLast exposes the last successfully queried value (or omits
+	// the metric if there is none). With FailedStatsNaN and FailedStatsLast,
+	// the remaining stats queries are still performed. The per-server metrics
+	// of servers.bind are always omitted on failure.
+	FailedStats string
+
+	// ExpiryWarning, if non-zero, enables the dnsmasq_leases_expiring_soon
+	// metric, counting the leases which expire within this duration.
+	ExpiryWarning time.Duration
+
+	// MaxLeaseLineLength is the maximum length in bytes of a line in the
+	// leases file. Longer lines are skipped. Zero means
+	// DefaultMaxLeaseLineLength.
+	MaxLeaseLineLength int
+
+	// LeaseIPInclude, if non-empty, restricts the per-lease series to leases
+	// whose IP address is contained in one of the networks.
+	LeaseIPInclude []*net.IPNet
+
+	// LeaseIPExclude omits the per-lease series of leases whose IP address is
+	// contained in one of the networks.
+	LeaseIPExclude []*net.IPNet
+
+	// LeaseOUIFilter, if non-empty, limits the per-lease series to leases
+	// whose MAC address starts with one of the OUI prefixes (e.g.
+	// "00:1a:11"), compared case-insensitively and ignoring separators.
+	LeaseOUIFilter []string
+
+	// LeaseSampleRatio, if between 0 and 1 (exclusive), limits the per-lease
+	// series to this fraction of the clients, selected by a hash of the MAC
+	// address (or client ID for DHCPv6 leases) so that the same clients are
+	// sampled in every scrape.
+	LeaseSampleRatio float64
+
+	// VendorPrefixes maps MAC address prefixes (e.g. "00:1a:11", usually an
+	// OUI) to vendor names. If non-empty, leases are counted by vendor in
+	// dnsmasq_leases_by_vendor. Leases which match no prefix are counted as
+	// vendor "other".
+	VendorPrefixes map[string]string
+
+	// OUIVendors maps OUIs (e.g. "001a11", see DefaultOUIVendors and
+	// ParseOUIFile) to vendor names. If non-empty, leases whose MAC address
+	// matches no VendorPrefixes are classified by their OUI in
+	// dnsmasq_leases_by_vendor. Only vendors with leases are exposed.
+	OUIVendors map[string]string
+
+	// ExtraStatsRecords are queried in addition to the built-in stats DNS
+	// records, so that counters added in newer dnsmasq versions can be
+	// exposed without a code change. Each must be a single-value record.
+	ExtraStatsRecords []StatsRecord
+
+	// ComputeRates exposes dnsmasq_queries_per_second, the rate of cache
+	// hits and misses since the previous scrape, for monitoring systems
+	// which cannot compute rates themselves.
+	ComputeRates bool
+
+	// CounterRecords are the names of the stats DNS records (e.g.
+	// "hits.bind.") whose metrics are exposed as counters instead of gauges.
+	// Counters are named with a _total suffix, e.g. dnsmasq_hits_total.
+	CounterRecords []string
+
+	// ExportUnknownStats exposes TXT records in stats answers which are
+	// neither built-in nor ExtraStatsRecords, e.g. those a newer dnsmasq
+	// or a proxy adds, if they have a single numeric value. The metric name
+	// is derived from the record name: "foo-bar.bind." becomes
+	// dnsmasq_unknown_foo_bar.
+	ExportUnknownStats bool
+
+	// LeaseExpiryUnit is the unit of dnsmasq_lease_expiry:
+	// LeaseExpirySeconds (the default) or LeaseExpiryMilliseconds.
+	LeaseExpiryUnit string
+
+	// QueryID, if non-nil, returns the ID for each DNS query instead of
+	// dns.Id. Tests use it to replay recorded dnsmasq responses.
+	QueryID func() uint16
+
+	// HostnamePatterns, if non-empty, enables dnsmasq_leases_matched, which
+	// counts leases by the bucket of the first pattern matching their
+	// hostname. Leases matching no pattern are not counted.
+	HostnamePatterns []HostnamePattern
+
+	// LeasesGlob, if non-empty, is a glob pattern (see filepath.Glob) of
+	// leases files to read instead of LeasesPath, e.g. to include rotated
+	// backups. If several files contain a lease for the same IP address, the
+	// lease from the most recently modified file wins.
+	LeasesGlob string
+
+	// Tracer, if non-nil, records a span for each scrape, each stats query
+	// and reading the leases.
+	Tracer Tracer
+
+	// StripLeaseDomain, if non-empty, is a domain (e.g. "lan") which is
+	// removed from the end of lease hostnames (e.g. "host.lan" becomes
+	// "host").
+	StripLeaseDomain string
+
+	// DecodeIDNHostnames exposes the computer_name of the per-lease series
+	// decoded from punycode (e.g. "xn--mnchen-3ya" becomes "münchen"),
+	// adding the hostname as written in the leases file as
+	// computer_name_raw. Hostnames which cannot be decoded are exposed
+	// as-is.
+	DecodeIDNHostnames bool
+
+	// DnsCookies enables DNS cookies (RFC 7873) for stats queries: each
+	// query carries a client cookie, and responses which do not echo it back
+	// together with a server cookie are rejected.
+	DnsCookies bool
+
+	// StatsRetries is the number of times a failed stats query is retried
+	// within a scrape. The first retry waits RetryBackoff, and each further
+	// retry waits twice as long as the previous one.
+	StatsRetries int
+	RetryBackoff time.Duration
+
+	// RetryJitter randomizes each retry backoff by up to this fraction
+	// (between 0 and 1) in either direction, so that exporters retrying at
+	// the same time do not keep hitting a recovering dnsmasq in lockstep.
+	RetryJitter float64
+
+	// OpenLeases, if non-nil, opens the leases file at LeasesPath instead of
+	// os.Open, e.g. to read it from a remote host. It must return an error
+	// satisfying os.IsNotExist if the file does not exist. LeasesGlob is not
+	// supported with OpenLeases.
+	OpenLeases func(path string) (io.ReadCloser, error)
+
+	// Protocol is the transport used by DnsClient (e.g. "udp", "tcp" or
+	// "tcp-tls"), exposed as dnsmasq_exporter_transport_info. Empty means
+	// "udp", the dns.Client default. "auto" means that DnsClient uses UDP,
+	// and each query whose answer is truncated, or which times out or is
+	// disconnected, is repeated over FallbackClient, which must use TCP.
+	Protocol string
+
+	// FallbackClient, if non-nil, sends queries over FallbackProtocol, the
+	// alternate to Protocol (e.g. "tcp" for "udp"). If the stats queries
+	// of the first scrape fail, dnsmasq is probed once over FallbackClient.
+	// If it answers, a hint is logged and
+	// dnsmasq_protocol_fallback_suggested is 1. With ProtocolAuto, the
+	// collector then uses FallbackClient for all further queries.
+	FallbackClient   Exchanger
+	FallbackProtocol string
+	ProtocolAuto     bool
+
+	// StatsSource is where stats are queried from: StatsSourceDNS (the
+	// default) queries the CHAOS TXT records of the DNS server at
+	// DnsmasqAddr, StatsSourceHTTP fetches key-value stats from the URL in
+	// DnsmasqAddr (see parseHTTPStats). The per-server metrics of
+	// servers.bind are not available via HTTP.
+	StatsSource string
+
+	// StatsHTTPTimeout is the timeout for fetching the stats with
+	// StatsSourceHTTP. If zero, 2s is used.
+	StatsHTTPTimeout time.Duration
+
+	// DhcpLeaseTime, if non-zero, is the lease time configured in dnsmasq.
+	// It enables dnsmasq_leases_lifecycle, which estimates when each lease
+	// was issued as its expiry minus DhcpLeaseTime.
+	DhcpLeaseTime time.Duration
+
+	// OpenMetrics is set if the metrics are served in the OpenMetrics format,
+	// which carries the created timestamps of counters. Together with
+	// ExposeLeases and DhcpLeaseTime, it enables
+	// dnsmasq_lease_age_seconds_total.
+	OpenMetrics bool
+
+	// ClockSkewThreshold is the fraction of the (non-infinite) leases which
+	// must appear expired, or to expire more than DhcpLeaseTime from now,
+	// for dnsmasq_clock_skew_suspected to be 1. dnsmasq removes expired
+	// leases from the leases file, so such leases indicate that the clock of
+	// dnsmasq or of the exporter is off. If zero, 0.5 is used.
+	ClockSkewThreshold float64
+
+	// CacheLeases keeps the leases parsed from LeasesPath until the size or
+	// modification time of the file changes, so that frequent scrapes do
+	// not parse an unchanged file again. The lease metrics are still
+	// computed for every scrape, as some depend on the current time.
+	// Unparseable lines are only counted when the file is parsed.
+	// Ignored with LeasesGlob, OpenLeases or stdin.
+	CacheLeases bool
+
+	// CacheDuration, if non-zero, is how long the metrics of a scrape are
+	// reused for subsequent scrapes. Concurrent scrapes are coalesced into
+	// one. Unless the collector only collects leases, the age of the served
+	// metrics is exposed as dnsmasq_metrics_cache_age_seconds.
+	CacheDuration time.Duration
+
+	// DhcpPoolSize, if non-zero, is the number of addresses available
+	// across all DHCP ranges. It enables dnsmasq_dhcp_pool_utilization.
+	DhcpPoolSize int
+
+	// DhcpRanges are the DHCP ranges configured in dnsmasq. They enable
+	// dnsmasq_leases_range and dnsmasq_leases_range_high_water.
+	DhcpRanges []DhcpRange
+
+	// BreakerThreshold, if non-zero, is the number of consecutive scrapes
+	// with failed stats queries after which dnsmasq is no longer queried
+	// until BreakerCooldown has passed. Meanwhile, scrapes expose
+	// dnsmasq_up 0 without querying. After the cooldown, the next scrape
+	// queries dnsmasq again, and a failure restarts the cooldown.
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+
+	// Location is the time zone which determines midnight for
+	// dnsmasq_leases_issued_today. Nil means time.Local.
+	Location *time.Location
+
+	// ServerFilter, if non-nil, limits the per-server metrics of
+	// servers.bind to the upstream servers whose address (e.g.
+	// "127.0.0.1#53") it matches. dnsmasq_queries_forwarded_total still
+	// includes all servers.
+	ServerFilter *regexp.Regexp
+
+	// SplitServerAddr replaces the server label of the per-server metrics
+	// (e.g. "[2001:db8::1]#5353") with server_ip ("2001:db8::1") and
+	// server_port ("5353") labels. Addresses which cannot be split are
+	// exposed as server_ip with an empty server_port.
+	SplitServerAddr bool
+
+	// ServerExtraStats exposes the numeric fields which some dnsmasq
+	// versions or patches append to the upstream server entries of
+	// servers.bind as dnsmasq_servers_extra_stat. They are ignored
+	// otherwise.
+	ServerExtraStats bool
+
+	// SerialCollect queries the stats and reads the leases one after the
+	// other instead of concurrently, lowering the peak load of a scrape on
+	// small devices at the expense of its duration.
+	SerialCollect bool
+
+	// InfiniteLeaseExpiry, if non-zero, is the Unix time (in seconds)
+	// exposed as dnsmasq_lease_expiry for infinite leases instead of 0.
+	InfiniteLeaseExpiry int64
+
+	// LeaseChurnWindow, if non-zero, is the sliding window over which
+	// dnsmasq_leases_churn_per_minute averages the number of leases added
+	// or removed between scrapes.
+	LeaseChurnWindow time.Duration
+
+	// LeaseWebhook, if non-empty, is a URL to which the DHCP address leases
+	// added or removed since the previous scrape are POSTed as JSON, e.g. to
+	// notify an IPAM system. Sending is best-effort and happens in the
+	// background: failures (including batches dropped because too many are
+	// queued) are counted in dnsmasq_lease_webhook_failures_total but do not
+	// fail the scrape.
+	LeaseWebhook string
+
+	// LeaseWebhookTimeout limits each POST to LeaseWebhook (default 5s).
+	LeaseWebhookTimeout time.Duration
+
+	// PTRCheckAddr, if non-empty, is the address of a DNS server (typically
+	// dnsmasq itself) which is queried via DnsClient for the PTR records of
+	// the lease IP addresses, to expose dnsmasq_lease_ptr_mismatch. To limit
+	// the load on the DNS server, each lease is looked up at most once per
+	// PTRCheckInterval, and at most 16 leases per scrape.
+	PTRCheckAddr     string
+	PTRCheckInterval time.Duration
+}
+
+// Tracer records spans, e.g. by wrapping an OpenTelemetry tracer.
+type Tracer interface {
+	// Start starts a span with the given name as a child of the span in ctx,
+	// if any, and returns a context containing the new span. The returned
+	// function ends the span, recording err (if non-nil) as its error.
+	Start(ctx context.Context, name string) (_ context.Context, end func(err error))
+}
+
+// HostnamePattern assigns leases whose hostname matches Pattern (see
+// path.Match) to Bucket.
+type HostnamePattern struct {
+	Pattern string
+	Bucket  string
+}
+
+// DhcpRange is a range of addresses handed out by dnsmasq, from Start to End
+// inclusive.
+type DhcpRange struct {
+	Start net.IP
+	End   net.IP
+}
+
+// String returns the range as start-end, as used in the range label.
+func (r DhcpRange) String() string {
+	return r.Start.String() + "-" + r.End.String()
+}
+
+// contains reports whether ip is within r.
+func (r DhcpRange) contains(ip net.IP) bool {
+	ip = ip.To16()
+	return bytes.Compare(ip, r.Start.To16()) >= 0 && bytes.Compare(ip, r.End.To16()) <= 0
+}
+
+// Values for Config.LeaseExpiryUnit.
+const (
+	LeaseExpirySeconds      = "seconds"
+	LeaseExpiryMilliseconds = "milliseconds"
+)
+
+// StatsRecord describes a single-value dnsmasq stats DNS record and the gauge
+// it is exposed as.
+type StatsRecord struct {
+	Name   string // DNS record name, e.g. "cachesize.bind."
+	Metric string // metric name, e.g. "dnsmasq_cachesize"
+	Help   string
+}
+
+// DefaultMaxLeaseLineLength is the default for Config.MaxLeaseLineLength.
+const DefaultMaxLeaseLineLength = 1024 * 1024
+
+// Values for Config.FailedStats.
+const (
+	FailedStatsOmit = "omit"
+	FailedStatsNaN  = "nan"
+	FailedStatsLast = "last"
+)
+
+// Collector implements prometheus.Collector and exposes dnsmasq metrics.
+type Collector struct {
+	cfg Config
+
+	// floatMetrics are the built-in floatMetrics plus Config.ExtraStatsRecords.
+	floatMetrics  map[string]*prometheus.Desc
+	questionBinds []string
+
+	now func() time.Time
+
+	// httpClient fetches the stats with StatsSourceHTTP.
+	httpClient *http.Client
+
+	// scrapeErrors counts incomplete scrapes. Each increment carries an
+	// exemplar with the ID under which the error was logged.
+	scrapeErrors prometheus.Counter
+
+	// leaseErrors counts lease lines which could not be parsed (see
+	// dnsmasq_leases_skipped for lines skipped by design).
+	leaseErrors prometheus.Counter
+
+	// queryRetries counts the retries of failed stats queries, by record.
+	queryRetries *prometheus.CounterVec
+
+	// querySuccesses and queryFailures count the stats queries (including
+	// their retries) by record and outcome. A query whose answer cannot be
+	// parsed counts as failed.
+	querySuccesses *prometheus.CounterVec
+	queryFailures  *prometheus.CounterVec
+
+	// tcpFallbacks counts the stats queries repeated over TCP with
+	// Config.Protocol "auto".
+	tcpFallbacks prometheus.Counter
+
+	// webhookFailures counts the lease events which could not be POSTed to
+	// Config.LeaseWebhook.
+	webhookFailures prometheus.Counter
+
+	// ptrLookupErrors counts the failed PTR lookups, see Config.PTRCheckAddr.
+	ptrLookupErrors prometheus.Counter
+
+	// emptyResponses counts the stats queries answered without a TXT record
+	// for the queried name, by record.
+	emptyResponses *prometheus.CounterVec
+
+	// clientCookie is the DNS client cookie (hex-encoded) if
+	// Config.DnsCookies is set.
+	clientCookie string
+
+	mu          sync.Mutex
+	lastValues  map[string]float64   // keyed by stats DNS record
+	lastSuccess map[string]time.Time // keyed by stats DNS record
+
+	// hits and misses of the previous scrape, if prevRatesAt is non-zero,
+	// see Config.ComputeRates.
+	prevHits, prevMisses float64
+	prevRatesAt          time.Time
+
+	// evictions of the previous scrape, if prevEvictionsOk.
+	prevEvictions   float64
+	prevEvictionsOk bool
+	serverCookie    string // hex-encoded, from the last response
+
+	rangeHighWater map[string]int // keyed by DhcpRange.String()
+
+	// leaseCacheMu guards the parsed leases, see Config.CacheLeases, and is
+	// held while parsing them.
+	leaseCacheMu    sync.Mutex
+	leaseCacheKey   leaseFileKey
+	leaseCacheFile  os.FileInfo // to detect a file renamed into place
+	leaseCache      []lease
+	leaseCacheStats leaseFileStats // without errors, which are counted once
+
+	// Lease churn state, see Config.LeaseChurnWindow.
+	churnLeases map[string]lease // of the last scrape, see leaseSet
+	churnStart  time.Time        // first scrape
+	churnEvents []churnEvent     // within the window, oldest first
+
+	webhookLeases map[string]lease // of the last scrape, see Config.LeaseWebhook
+	webhookClient *http.Client
+	webhookQueue  chan leaseWebhookPayload
+
+	ptrResults map[string]ptrResult // keyed by IP address, see Config.PTRCheckAddr
+
+	// Protocol fallback state, see Config.FallbackClient.
+	probed            bool // whether the first scrape completed
+	fallbackSuggested bool
+	fallbackActive    bool // whether FallbackClient replaced DnsClient
+
+	// Circuit breaker state, see Config.BreakerThreshold.
+	failedScrapes    int // consecutive
+	breakerOpenUntil time.Time
+
+	// cacheMu guards the metrics cached for Config.CacheDuration, and is held
+	// while collecting them.
+	cacheMu  sync.Mutex
+	cached   []prometheus.Metric
+	cachedAt time.Time
+}
+
+// churnEvent is the number of leases added or removed since the previous
+// scrape.
+type churnEvent struct {
+	at      time.Time
+	changes int
+}
+
+type lease struct {
+	expiry       uint64
+	macAddress   string
+	ipAddress    string
+	computerName string
+	clientId     string
+
+	// iaid is the identity association ID of DHCPv6 leases, which are
+	// written with the IAID where DHCPv4 leases have the MAC address.
+	// macAddress is empty for DHCPv6 leases.
+	iaid string
+
+	// prefixLength is the length of the delegated prefix in ipAddress for
+	// DHCPv6 prefix delegation leases, and 0 for address leases.
+	prefixLength int
+}
+
+// Validate returns an error if cfg cannot be used to collect metrics, e.g.
+// because DnsClient is nil but stats are to be queried via DNS. New does not
+// validate its Config, so callers should call Validate first or use
+// NewValidated.
+func (cfg Config) Validate() error {
+	if cfg.DnsmasqAddr == "" && cfg.LeasesPath == "" && cfg.LeasesGlob == "" {
+		return fmt.Errorf("neither DnsmasqAddr nor LeasesPath nor LeasesGlob is set")
+	}
+	if cfg.PTRCheckAddr != "" && cfg.DnsClient == nil {
+		return fmt.Errorf("PTRCheckAddr is set but DnsClient is nil")
+	}
+	switch cfg.StatsSource {
+	case "", StatsSourceDNS:
+		if cfg.DnsmasqAddr != "" && cfg.DnsClient == nil {
+			return fmt.Errorf("DnsClient is nil")
+		}
+	case StatsSourceHTTP:
+	default:
+		return fmt.Errorf("invalid StatsSource %q", cfg.StatsSource)
+	}
+	switch cfg.FailedStats {
+	case "", FailedStatsOmit, FailedStatsNaN, FailedStatsLast:
+	default:
+		return fmt.Errorf("invalid FailedStats %q", cfg.FailedStats)
+	}
+	switch cfg.LeaseExpiryUnit {
+	case "", LeaseExpirySeconds, LeaseExpiryMilliseconds:
+	default:
+		return fmt.Errorf("invalid LeaseExpiryUnit %q", cfg.LeaseExpiryUnit)
+	}
+	if cfg.OpenLeases != nil && cfg.LeasesGlob != "" {
+		return fmt.Errorf("OpenLeases cannot be combined with LeasesGlob")
+	}
+	return nil
+}
+
+// NewValidated is like New, but returns an error if cfg is invalid, see
+// Config.Validate.
+func NewValidated(cfg Config) (*Collector, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return New(cfg), nil
+}
+
+// New creates a new Collector.
+func New(cfg Config) *Collector {
+	c := &Collector{
+		cfg:          cfg,
+		floatMetrics: make(map[string]*prometheus.Desc),
+		questionBinds: []string{
+			"cachesize.bind.",
+			"insertions.bind.",
+			"evictions.bind.",
+			"misses.bind.",
+			"hits.bind.",
+			"auth.bind.",
+			"servers.bind.",
+		},
+		now:        time.Now,
+		httpClient: &http.Client{Timeout: 2 * time.Second},
+		scrapeErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "dnsmasq_scrape_errors_total",
+			Help: "Number of scrapes which could not be completed",
+		}),
+		leaseErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "dnsmasq_lease_parse_errors_total",
+			Help: "Number of lease lines which could not be parsed",
+		}),
+		queryRetries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "dnsmasq_stats_query_retries_total",
+			Help: "Number of times a failed stats query was retried, by stats DNS record",
+		}, []string{"record"}),
+		querySuccesses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "dnsmasq_stats_query_success_total",
+			Help: "Number of successful stats queries, by stats DNS record",
+		}, []string{"record"}),
+		queryFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "dnsmasq_stats_query_failure_total",
+			Help: "Number of failed stats queries, by stats DNS record",
+		}, []string{"record"}),
+		tcpFallbacks: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "dnsmasq_stats_tcp_fallbacks_total",
+			Help: "Number of stats queries repeated over TCP after their UDP answer was truncated, timed out or was disconnected",
+		}),
+		webhookFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "dnsmasq_lease_webhook_failures_total",
+			Help: "Number of lease event batches which could not be POSTed to -lease_webhook",
+		}),
+		ptrLookupErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "dnsmasq_lease_ptr_lookup_errors_total",
+			Help: "Number of PTR lookups of lease IP addresses which failed, e.g. timed out",
+		}),
+		emptyResponses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "dnsmasq_stats_empty_responses_total",
+			Help: "Number of stats queries answered without a TXT record, by stats DNS record",
+		}, []string{"record"}),
+		lastValues:     make(map[string]float64),
+		lastSuccess:    make(map[string]time.Time),
+		rangeHighWater: make(map[string]int),
+	}
+	if cfg.StatsHTTPTimeout > 0 {
+		c.httpClient.Timeout = cfg.StatsHTTPTimeout
+	}
+	if cfg.LeaseWebhook != "" {
+		c.startLeaseWebhook()
+	}
+	for name, d := range floatMetrics {
+		c.floatMetrics[name] = d
+	}
+	for name, d := range counterMetrics {
+		if c.statsValueType(name) == prometheus.CounterValue {
+			c.floatMetrics[name] = d
+		}
+	}
+	for _, r := range cfg.ExtraStatsRecords {
+		name := dns.Fqdn(r.Name)
+		if _, ok := c.floatMetrics[name]; !ok {
+			c.questionBinds = append(c.questionBinds, name)
+		}
+		metric := r.Metric
+		if c.statsValueType(name) == prometheus.CounterValue && !strings.HasSuffix(metric, "_total") {
+			metric += "_total"
+		}
+		c.floatMetrics[name] = prometheus.NewDesc(metric, r.Help, nil, nil)
+	}
+	if cfg.StatsSource != StatsSourceHTTP {
+		for _, questionBind := range c.questionBinds {
+			c.querySuccesses.WithLabelValues(questionBind)
+			c.queryFailures.WithLabelValues(questionBind)
+			c.emptyResponses.WithLabelValues(questionBind)
+		}
+	}
+	if cfg.DnsCookies {
+		b := make([]byte, 8)
+		rand.Read(b)
+		c.clientCookie = hex.EncodeToString(b)
+	}
+	return c
+}
+
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	if c.cfg.DnsmasqAddr != "" {
+		for _, d := range c.floatMetrics {
+			ch <- d
+		}
+		if c.cfg.SplitServerAddr {
+			for _, d := range serversMetricsSplit {
+				ch <- d
+			}
+		} else {
+			for _, d := range serversMetrics {
+				ch <- d
+			}
+		}
+		if c.cfg.ServerExtraStats {
+			if c.cfg.SplitServerAddr {
+				ch <- serversExtraStatSplit
+			} else {
+				ch <- serversExtraStat
+			}
+		}
+		ch <- cacheHitRatio
+		ch <- cacheUndersized
+		if c.cfg.ComputeRates {
+			ch <- queriesPerSecond
+		}
+		ch <- statsResponseBytes
+		ch <- statsLastSuccess
+		ch <- queriesForwarded
+		ch <- transportInfo
+		if c.cfg.FallbackClient != nil {
+			ch <- protocolFallbackSuggested
+		}
+		if c.cfg.Protocol == "auto" {
+			ch <- c.tcpFallbacks.Desc()
+		}
+		ch <- up
+		ch <- c.scrapeErrors.Desc()
+		c.queryRetries.Describe(ch)
+		c.querySuccesses.Describe(ch)
+		c.queryFailures.Describe(ch)
+		c.emptyResponses.Describe(ch)
+		if c.cfg.CacheDuration > 0 {
+			ch <- cacheAge
+		}
+	}
+	if !c.leasesEnabled() {
+		return
+	}
+	ch <- leases
+	ch <- exposeLeasesDesc
+	if c.cfg.DecodeIDNHostnames {
+		ch <- leaseMetricsIDN
+	} else {
+		ch <- leaseMetrics
+	}
+	if c.exposeLeaseAge() {
+		ch <- leaseAge
+	}
+	ch <- leaseSeriesTruncated
+	ch <- leasesSkipped
+	ch <- c.leaseErrors.Desc()
+	ch <- leasesExpiringSoon
+	ch <- leasesByVendor
+	ch <- leasesUnknownHostname
+	ch <- leasesMatched
+	ch <- leasesFileMode
+	ch <- uniqueClients
+	ch <- leaseDUIDConflicts
+	ch <- leasesByClientIDType
+	ch <- leasesChurn
+	ch <- leaseRemaining
+	ch <- clockSkewSuspected
+	ch <- leasesLifecycle
+	ch <- leasesIssuedToday
+	ch <- oldestLeaseAge
+	ch <- pdLeasesDesc
+	ch <- leasesFileLines
+	ch <- leasesReadDuration
+	ch <- poolUtilization
+	ch <- leasesRange
+	ch <- leasesRangeHighWater
+	if c.cfg.LeaseWebhook != "" {
+		ch <- c.webhookFailures.Desc()
+	}
+	if c.cfg.PTRCheckAddr != "" {
+		ch <- leasePTRMismatch
+		ch <- c.ptrLookupErrors.Desc()
+	}
+}
+
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	if c.cfg.CacheDuration <= 0 {
+		c.collect(ch)
+		return
+	}
+
+	c.cacheMu.Lock()
+	defer c.cacheMu.Unlock()
+	now := c.now()
+	if c.cached == nil || now.Sub(c.cachedAt) >= c.cfg.CacheDuration {
+		metrics := make(chan prometheus.Metric)
+		done := make(chan struct{})
+		var collected []prometheus.Metric
+		go func() {
+			for m := range metrics {
+				collected = append(collected, m)
+			}
+			close(done)
+		}()
+		c.collect(metrics)
+		close(metrics)
+		<-done
+		c.cached = collected
+		c.cachedAt = now
+	}
+	for _, m := range c.cached {
+		ch <- m
+	}
+	if c.cfg.DnsmasqAddr != "" {
+		ch <- prometheus.MustNewConstMetric(cacheAge, prometheus.GaugeValue, now.Sub(c.cachedAt).Seconds())
+	}
+}
+
+// collect collects the metrics, see Collect.
+func (c *Collector) collect(ch chan<- prometheus.Metric) {
+	ctx, end := c.startSpan(context.Background(), "dnsmasq.collect")
+	var eg group = &errgroup.Group{}
+	if c.cfg.SerialCollect {
+		eg = &serialGroup{}
+	}
+
+	if c.leasesEnabled() {
+		var exposed float64
+		if c.cfg.ExposeLeases {
+			exposed = 1
+		}
+		ch <- prometheus.MustNewConstMetric(exposeLeasesDesc, prometheus.GaugeValue, exposed)
+	}
+
+	var statsOk bool
+	if c.cfg.DnsmasqAddr != "" && !c.breakerOpen() {
+		eg.Go(func() error {
+			err := c.collectStats(ctx, ch)
+			c.recordStatsResult(err)
+			statsOk = err == nil
+			return err
+		})
+	}
+	if c.leasesEnabled() {
+		eg.Go(func() error { return c.collectLeases(ctx, ch) })
+	}
+
+	err := eg.Wait()
+	end(err)
+	if c.cfg.DnsmasqAddr != "" && c.cfg.FallbackClient != nil && c.cfg.StatsSource != StatsSourceHTTP && c.cfg.Protocol != "auto" {
+		c.probeFallback(statsOk)
+	}
+	if err != nil {
+		id := errorID()
+		log.Printf("could not complete scrape (error_id=%s): %v", id, err)
+		if c.cfg.DnsmasqAddr != "" {
+			c.scrapeErrors.(prometheus.ExemplarAdder).AddWithExemplar(1, prometheus.Labels{"error_id": id})
+		}
+	}
+	if c.cfg.DnsmasqAddr != "" {
+		var v float64
+		if statsOk {
+			v = 1
+		}
+		ch <- prometheus.MustNewConstMetric(up, prometheus.GaugeValue, v)
+		ch <- c.scrapeErrors
+		c.queryRetries.Collect(ch)
+		c.querySuccesses.Collect(ch)
+		c.queryFailures.Collect(ch)
+		c.emptyResponses.Collect(ch)
+		c.mu.Lock()
+		for questionBind, t := range c.lastSuccess {
+			ch <- prometheus.MustNewConstMetric(statsLastSuccess, prometheus.GaugeValue, float64(t.UnixNano())/1e9, questionBind)
+		}
+		c.mu.Unlock()
+		_, protocol := c.dnsClient()
+		if protocol == "" {
+			protocol = "udp"
+		}
+		ch <- prometheus.MustNewConstMetric(transportInfo, prometheus.GaugeValue, 1, protocol)
+		if c.cfg.FallbackClient != nil {
+			c.mu.Lock()
+			var v float64
+			if c.fallbackSuggested {
+				v = 1
+			}
+			c.mu.Unlock()
+			ch <- prometheus.MustNewConstMetric(protocolFallbackSuggested, prometheus.GaugeValue, v)
+		}
+		if c.cfg.Protocol == "auto" {
+			ch <- c.tcpFallbacks
+		}
+	}
+}
+
+// dnsClient returns the Exchanger for the stats queries and its protocol.
+func (c *Collector) dnsClient() (Exchanger, string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.fallbackActive {
+		return c.cfg.FallbackClient, c.cfg.FallbackProtocol
+	}
+	return c.cfg.DnsClient, c.cfg.Protocol
+}
+
+// probeFallback probes dnsmasq over Config.FallbackClient if the stats
+// queries of the first scrape failed.
+func (c *Collector) probeFallback(statsOk bool) {
+	c.mu.Lock()
+	probed := c.probed
+	c.probed = true
+	c.mu.Unlock()
+	if probed || statsOk {
+		return
+	}
+	msg := &dns.Msg{
+		MsgHdr: dns.MsgHdr{
+			Id:               dns.Id(),
+			RecursionDesired: true,
+		},
+		Question: []dns.Question{
+			question("cachesize.bind."),
+		},
+	}
+	if _, _, err := c.cfg.FallbackClient.Exchange(msg, c.cfg.DnsmasqAddr); err != nil {
+		return
+	}
+	protocol := c.cfg.Protocol
+	if protocol == "" {
+		protocol = "udp"
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.fallbackSuggested = true
+	if c.cfg.ProtocolAuto {
+		c.fallbackActive = true
+		log.Printf("querying dnsmasq over %s failed but it answered over %s, using %s from now on", protocol, c.cfg.FallbackProtocol, c.cfg.FallbackProtocol)
+		return
+	}
+	log.Printf("querying dnsmasq over %s failed but it answered over %s, consider switching to %s", protocol, c.cfg.FallbackProtocol, c.cfg.FallbackProtocol)
+}
+
+// group runs the parts of a scrape, see errgroup.Group.
+type group interface {
+	Go(f func() error)
+	Wait() error
+}
+
+// serialGroup is a group which runs each function immediately.
+type serialGroup struct {
+	err error // first error
+}
+
+func (g *serialGroup) Go(f func() error) {
+	if err := f(); err != nil && g.err == nil {
+		g.err = err
+	}
+}
+
+func (g *serialGroup) Wait() error {
+	return g.err
+}
+
+// breakerOpen reports whether the circuit breaker currently prevents querying
+// dnsmasq.
+func (c *Collector) breakerOpen() bool {
+	if c.cfg.BreakerThreshold <= 0 {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now().Before(c.breakerOpenUntil)
+}
+
+// recordStatsResult updates the circuit breaker with the result of querying
+// the stats.
+func (c *Collector) recordStatsResult(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err == nil {
+		c.failedScrapes = 0
+		return
+	}
+	c.failedScrapes++
+	if c.cfg.BreakerThreshold > 0 && c.failedScrapes >= c.cfg.BreakerThreshold {
+		c.breakerOpenUntil = c.now().Add(c.cfg.BreakerCooldown)
+		log.Printf("%d consecutive scrapes failed, not querying dnsmasq for %v", c.failedScrapes, c.cfg.BreakerCooldown)
+	}
+}
+
+// collectStats queries the dnsmasq stats DNS records and exposes them.
+func (c *Collector) collectStats(ctx context.Context, ch chan<- prometheus.Metric) error {
+	var firstErr error
+	values := make(map[string]float64)
+	if c.cfg.StatsSource == StatsSourceHTTP {
+		if err := c.collectHTTPStats(ctx, ch, values); err != nil {
+			if c.cfg.FailedStats == "" || c.cfg.FailedStats == FailedStatsOmit {
+				return err
+			}
+			for _, questionBind := range c.questionBinds {
+				c.collectFailed(questionBind, ch)
+			}
+			firstErr = err
+		}
+	} else {
+		for _, questionBind := range c.questionBinds {
+			err := queryDnsmasq(ctx, questionBind, c, ch, values)
+
+			if err != nil {
+				if c.cfg.FailedStats == "" || c.cfg.FailedStats == FailedStatsOmit {
+					return err
+				}
+				c.collectFailed(questionBind, ch)
+				if firstErr == nil {
+					firstErr = err
+				}
+			}
+		}
+	}
+
+	if c.cfg.FailedStats == FailedStatsLast {
+		c.mu.Lock()
+		for name, f := range values {
+			c.lastValues[name] = f
+		}
+		c.mu.Unlock()
+	}
+
+	hits, hitsOk := values["hits.bind."]
+	misses, missesOk := values["misses.bind."]
+	if hitsOk && missesOk {
+		var ratio float64
+		if total := hits + misses; total > 0 {
+			ratio = hits / total
+		}
+		ch <- prometheus.MustNewConstMetric(cacheHitRatio, prometheus.GaugeValue, ratio)
+		if c.cfg.ComputeRates {
+			c.collectRates(hits, misses, ch)
+		}
+	}
+
+	if evictions, ok := values["evictions.bind."]; ok {
+		// dnsmasq only evicts entries before their expiry to make room in a
+		// full cache.
+		c.mu.Lock()
+		undersized := c.prevEvictionsOk && evictions > c.prevEvictions && values["cachesize.bind."] > 0
+		c.prevEvictions, c.prevEvictionsOk = evictions, true
+		c.mu.Unlock()
+		var v float64
+		if undersized {
+			v = 1
+		}
+		ch <- prometheus.MustNewConstMetric(cacheUndersized, prometheus.GaugeValue, v)
+	}
+
+	return firstErr
+}
+
+// collectRates exposes the rates of hits and misses since the previous
+// scrape, see Config.ComputeRates. Nothing is exposed in the first scrape and
+// after dnsmasq restarted (i.e. its counters decreased).
+func (c *Collector) collectRates(hits, misses float64, ch chan<- prometheus.Metric) {
+	now := c.now()
+	c.mu.Lock()
+	prevHits, prevMisses, prevAt := c.prevHits, c.prevMisses, c.prevRatesAt
+	c.prevHits, c.prevMisses, c.prevRatesAt = hits, misses, now
+	c.mu.Unlock()
+	elapsed := now.Sub(prevAt).Seconds()
+	if prevAt.IsZero() || elapsed <= 0 || hits < prevHits || misses < prevMisses {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(queriesPerSecond, prometheus.GaugeValue, (hits-prevHits)/elapsed, "hits")
+	ch <- prometheus.MustNewConstMetric(queriesPerSecond, prometheus.GaugeValue, (misses-prevMisses)/elapsed, "misses")
+}
+
+// collectLeases reads the DHCP leases file and exposes the lease metrics.
+func (c *Collector) collectLeases(ctx context.Context, ch chan<- prometheus.Metric) error {
+	_, end := c.startSpan(ctx, "dnsmasq.read_leases")
+	var stats leaseFileStats
+	start := time.Now()
+	activeLeases, err := c.readLeases(&stats)
+	ch <- prometheus.MustNewConstMetric(leasesReadDuration, prometheus.GaugeValue, time.Since(start).Seconds())
+	end(err)
+	c.leaseErrors.Add(float64(stats.errors))
+	defer func() {
+		ch <- c.leaseErrors
+		if c.cfg.LeaseWebhook != "" {
+			ch <- c.webhookFailures
+		}
+	}()
+	if err != nil {
+		return err
+	}
+	// Prefix delegation leases are only counted; all other lease metrics
+	// are about address leases.
+	var pdLeases int
+	addressLeases := activeLeases[:0]
+	for _, activeLease := range activeLeases {
+		if activeLease.prefixLength > 0 {
+			pdLeases++
+		} else {
+			addressLeases = append(addressLeases, activeLease)
+		}
+	}
+	activeLeases = addressLeases
+	ch <- prometheus.MustNewConstMetric(leases, prometheus.GaugeValue, float64(len(activeLeases)))
+	ch <- prometheus.MustNewConstMetric(leasesFileLines, prometheus.GaugeValue, float64(stats.lines))
+	ch <- prometheus.MustNewConstMetric(pdLeasesDesc, prometheus.GaugeValue, float64(pdLeases))
+	if c.cfg.DhcpPoolSize > 0 {
+		ch <- prometheus.MustNewConstMetric(poolUtilization, prometheus.GaugeValue, float64(len(activeLeases))/float64(c.cfg.DhcpPoolSize))
+	}
+	c.collectRanges(activeLeases, ch)
+
+	if c.cfg.LeasesGlob == "" && c.cfg.OpenLeases == nil && c.cfg.LeasesPath != "-" {
+		if fi, err := os.Stat(c.cfg.LeasesPath); err == nil {
+			ch <- prometheus.MustNewConstMetric(leasesFileMode, prometheus.GaugeValue, float64(fi.Mode().Perm()))
+		}
+	}
+
+	var unknownHostname int
+	for _, activeLease := range activeLeases {
+		if activeLease.computerName == "*" || activeLease.computerName == "" {
+			unknownHostname++
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(leasesUnknownHostname, prometheus.GaugeValue, float64(unknownHostname))
+
+	clients := make(map[string]bool)
+	for _, activeLease := range activeLeases {
+		clients[activeLease.clientKey()] = true
+	}
+	ch <- prometheus.MustNewConstMetric(uniqueClients, prometheus.GaugeValue, float64(len(clients)))
+	ch <- prometheus.MustNewConstMetric(leaseDUIDConflicts, prometheus.GaugeValue, float64(duidConflicts(activeLeases)))
+
+	byClientIDType := map[string]int{"mac": 0, "duid": 0, "other": 0}
+	for _, activeLease := range activeLeases {
+		byClientIDType[clientIDType(activeLease)]++
+	}
+	for typ, n := range byClientIDType {
+		ch <- prometheus.MustNewConstMetric(leasesByClientIDType, prometheus.GaugeValue, float64(n), typ)
+	}
+
+	ch <- leaseRemainingSummary(activeLeases, c.now())
+	var skew float64
+	if c.clockSkewSuspected(activeLeases) {
+		skew = 1
+	}
+	ch <- prometheus.MustNewConstMetric(clockSkewSuspected, prometheus.GaugeValue, skew)
+
+	if c.cfg.LeaseChurnWindow > 0 {
+		ch <- prometheus.MustNewConstMetric(leasesChurn, prometheus.GaugeValue, c.leaseChurn(activeLeases))
+	}
+	if c.cfg.LeaseWebhook != "" {
+		c.notifyLeaseWebhook(activeLeases)
+	}
+	if c.cfg.PTRCheckAddr != "" {
+		ch <- prometheus.MustNewConstMetric(leasePTRMismatch, prometheus.GaugeValue, float64(c.ptrMismatches(activeLeases)))
+		ch <- c.ptrLookupErrors
+	}
+
+	if c.cfg.ExpiryWarning > 0 {
+		now := c.now()
+		var expiringSoon int
+		for _, activeLease := range activeLeases {
+			if activeLease.expiry == 0 {
+				continue // infinite lease
+			}
+			remaining := time.Unix(int64(activeLease.expiry), 0).Sub(now)
+			if remaining > 0 && remaining < c.cfg.ExpiryWarning {
+				expiringSoon++
+			}
+		}
+		ch <- prometheus.MustNewConstMetric(leasesExpiringSoon, prometheus.GaugeValue, float64(expiringSoon))
+	}
+
+	if c.cfg.DhcpLeaseTime > 0 {
+		now := c.now()
+		var early, late int
+		for _, activeLease := range activeLeases {
+			if activeLease.expiry == 0 {
+				continue // infinite lease
+			}
+			remaining := time.Unix(int64(activeLease.expiry), 0).Sub(now)
+			if remaining <= 0 {
+				continue // expired
+			}
+			// The elapsed part of the lifetime is DhcpLeaseTime - remaining.
+			if remaining > c.cfg.DhcpLeaseTime/2 {
+				early++
+			} else {
+				late++
+			}
+		}
+		ch <- prometheus.MustNewConstMetric(leasesLifecycle, prometheus.GaugeValue, float64(early), "early")
+		ch <- prometheus.MustNewConstMetric(leasesLifecycle, prometheus.GaugeValue, float64(late), "late")
+
+		loc := c.cfg.Location
+		if loc == nil {
+			loc = time.Local
+		}
+		local := now.In(loc)
+		midnight := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc)
+		var issuedToday int
+		for _, activeLease := range activeLeases {
+			if activeLease.expiry == 0 {
+				continue // infinite lease
+			}
+			issued := time.Unix(int64(activeLease.expiry), 0).Add(-c.cfg.DhcpLeaseTime)
+			if !issued.Before(midnight) && !issued.After(now) {
+				issuedToday++
+			}
+		}
+		ch <- prometheus.MustNewConstMetric(leasesIssuedToday, prometheus.GaugeValue, float64(issuedToday))
+
+		// The lease with the smallest expiry was issued (or renewed)
+		// first.
+		var oldest uint64
+		for _, activeLease := range activeLeases {
+			if activeLease.expiry != 0 && (oldest == 0 || activeLease.expiry < oldest) {
+				oldest = activeLease.expiry
+			}
+		}
+		if oldest != 0 {
+			issued := time.Unix(int64(oldest), 0).Add(-c.cfg.DhcpLeaseTime)
+			ch <- prometheus.MustNewConstMetric(oldestLeaseAge, prometheus.GaugeValue, now.Sub(issued).Seconds())
+		}
+	}
+
+	if len(c.cfg.VendorPrefixes) > 0 || len(c.cfg.OUIVendors) > 0 {
+		byVendor := map[string]int{"other": 0}
+		for _, vendor := range c.cfg.VendorPrefixes {
+			byVendor[vendor] = 0
+		}
+		for _, activeLease := range activeLeases {
+			byVendor[c.vendor(activeLease.macAddress)]++
+		}
+		for vendor, n := range byVendor {
+			ch <- prometheus.MustNewConstMetric(leasesByVendor, prometheus.GaugeValue, float64(n), vendor)
+		}
+	}
+
+	if len(c.cfg.HostnamePatterns) > 0 {
+		matched := make(map[string]int)
+		for _, p := range c.cfg.HostnamePatterns {
+			matched[p.Bucket] = 0
+		}
+		for _, activeLease := range activeLeases {
+			for _, p := range c.cfg.HostnamePatterns {
+				if ok, _ := path.Match(p.Pattern, activeLease.computerName); ok {
+					matched[p.Bucket]++
+					break
+				}
+			}
+		}
+		for bucket, n := range matched {
+			ch <- prometheus.MustNewConstMetric(leasesMatched, prometheus.GaugeValue, float64(n), bucket)
+		}
+	}
+
+	if c.cfg.ExposeLeases {
+		seriesPerLease := 1
+		if c.exposeLeaseAge() {
+			seriesPerLease = 2
+		}
+		truncated := c.cfg.MaxLeaseSeries > 0 && len(activeLeases)*seriesPerLease > c.cfg.MaxLeaseSeries
+		if !truncated {
+			multiplier := float64(1)
+			if c.cfg.LeaseExpiryUnit == LeaseExpiryMilliseconds {
+				multiplier = 1000
+			}
+			now := c.now()
+			for _, activeLease := range activeLeases {
+				if !c.exposeLease(activeLease) {
+					stats.skip(skipIPFilter)
+					continue
+				}
+				if !c.matchesOUI(activeLease.macAddress) {
+					stats.skip(skipOUIFilter)
+					continue
+				}
+				if !c.sampled(activeLease) {
+					stats.skip(skipSampled)
+					continue
+				}
+				if c.exposeLeaseAge() && activeLease.expiry != 0 {
+					issued := time.Unix(int64(activeLease.expiry), 0).Add(-c.cfg.DhcpLeaseTime)
+					if age := now.Sub(issued); age >= 0 {
+						ch <- prometheus.MustNewConstMetricWithCreatedTimestamp(leaseAge, prometheus.CounterValue, age.Seconds(), issued,
+							activeLease.macAddress, activeLease.ipAddress, activeLease.computerName, activeLease.clientId, activeLease.iaid)
+					}
+				}
+				expiry := float64(activeLease.expiry)
+				if activeLease.expiry == 0 && c.cfg.InfiniteLeaseExpiry != 0 {
+					expiry = float64(c.cfg.InfiniteLeaseExpiry)
+				}
+				if c.cfg.DecodeIDNHostnames {
+					ch <- prometheus.MustNewConstMetric(leaseMetricsIDN, prometheus.GaugeValue, expiry*multiplier,
+						activeLease.macAddress, activeLease.ipAddress, decodeHostname(activeLease.computerName), activeLease.computerName, activeLease.clientId, activeLease.iaid)
+					continue
+				}
+				ch <- prometheus.MustNewConstMetric(leaseMetrics, prometheus.GaugeValue, expiry*multiplier,
+					activeLease.macAddress, activeLease.ipAddress, activeLease.computerName, activeLease.clientId, activeLease.iaid)
+			}
+		}
+		var v float64
+		if truncated {
+			v = 1
+		}
+		ch <- prometheus.MustNewConstMetric(leaseSeriesTruncated, prometheus.GaugeValue, v)
+	}
+	for _, reason := range skipReasons {
+		ch <- prometheus.MustNewConstMetric(leasesSkipped, prometheus.GaugeValue, float64(stats.skipped[reason]), reason)
+	}
+	return nil
+}
+
+// exposeLeaseAge returns whether dnsmasq_lease_age_seconds_total is exposed.
+func (c *Collector) exposeLeaseAge() bool {
+	return c.cfg.ExposeLeases && c.cfg.OpenMetrics && c.cfg.DhcpLeaseTime > 0
+}
+
+// leaseRemainingQuantiles are the quantiles of dnsmasq_lease_remaining_seconds.
+var leaseRemainingQuantiles = []float64{0.1, 0.5, 0.9}
+
+// leaseRemainingSummary returns dnsmasq_lease_remaining_seconds, which
+// observes the time from now until expiry of each lease.
+func leaseRemainingSummary(activeLeases []lease, now time.Time) prometheus.Metric {
+	var remaining []float64
+	var sum float64
+	for _, activeLease := range activeLeases {
+		if activeLease.expiry == 0 {
+			continue // infinite lease
+		}
+		r := time.Unix(int64(activeLease.expiry), 0).Sub(now).Seconds()
+		if r <= 0 {
+			continue // expired
+		}
+		remaining = append(remaining, r)
+		sum += r
+	}
+	sort.Float64s(remaining)
+	quantiles := make(map[float64]float64)
+	for _, q := range leaseRemainingQuantiles {
+		if len(remaining) == 0 {
+			quantiles[q] = math.NaN()
+			continue
+		}
+		// nearest rank
+		rank := int(math.Ceil(q*float64(len(remaining)))) - 1
+		if rank < 0 {
+			rank = 0
+		}
+		quantiles[q] = remaining[rank]
+	}
+	return prometheus.MustNewConstSummary(leaseRemaining, uint64(len(remaining)), sum, quantiles)
+}
+
+// clockSkewSuspected reports whether at least Config.ClockSkewThreshold of
+// the non-infinite activeLeases have an impossible expiry: in the past, or
+// further in the future than Config.DhcpLeaseTime (if set).
+func (c *Collector) clockSkewSuspected(activeLeases []lease) bool {
+	threshold := c.cfg.ClockSkewThreshold
+	if threshold == 0 {
+		threshold = 0.5
+	}
+	now := c.now()
+	var finite, impossible int
+	for _, activeLease := range activeLeases {
+		if activeLease.expiry == 0 {
+			continue // infinite lease
+		}
+		finite++
+		remaining := time.Unix(int64(activeLease.expiry), 0).Sub(now)
+		if remaining <= 0 || (c.cfg.DhcpLeaseTime > 0 && remaining > c.cfg.DhcpLeaseTime) {
+			impossible++
+		}
+	}
+	return finite > 0 && float64(impossible) >= threshold*float64(finite)
+}
+
+// startSpan starts a span as a child of the span in ctx using Config.Tracer,
+// if any.
+func (c *Collector) startSpan(ctx context.Context, name string) (_ context.Context, end func(err error)) {
+	if c.cfg.Tracer == nil {
+		return ctx, func(error) {}
+	}
+	return c.cfg.Tracer.Start(ctx, name)
+}
+
+// leasesEnabled reports whether the collector reads DHCP leases.
+func (c *Collector) leasesEnabled() bool {
+	return c.cfg.LeasesPath != "" || c.cfg.LeasesGlob != ""
+}
+
+// Leases reads the leases file(s) and returns the parsed leases, e.g. to
+// check the parsing of a leases file. Unlike the metrics, the leases are not
+// filtered.
+func (c *Collector) Leases() ([]Lease, error) {
+	if !c.leasesEnabled() {
+		return nil, fmt.Errorf("no leases file configured")
+	}
+	activeLeases, err := c.readLeases(nil)
+	if err != nil {
+		return nil, err
+	}
+	return exportLeases(activeLeases), nil
+}
+
+// readLeases reads the configured leases file(s), counting skipped and
+// unparseable lines in stats (if non-nil).
+func (c *Collector) readLeases(stats *leaseFileStats) ([]lease, error) {
+	var activeLeases []lease
+	var err error
+	if c.cfg.LeasesGlob != "" {
+		activeLeases, err = readLeaseFiles(c.cfg.LeasesGlob, c.cfg.MaxLeaseLineLength, stats)
+	} else if c.cfg.OpenLeases != nil {
+		activeLeases, err = openLeaseFile(c.cfg.LeasesPath, c.cfg.OpenLeases, c.cfg.MaxLeaseLineLength, stats)
+	} else if c.cfg.CacheLeases && c.cfg.LeasesPath != "-" {
+		activeLeases, err = c.readLeaseFileCached(stats)
+	} else {
+		activeLeases, err = readLeaseFile(c.cfg.LeasesPath, c.cfg.MaxLeaseLineLength, stats)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if c.cfg.StripLeaseDomain != "" {
+		for i := range activeLeases {
+			activeLeases[i].computerName = stripDomain(activeLeases[i].computerName, c.cfg.StripLeaseDomain)
+		}
+	}
+	return activeLeases, nil
+}
+
+// decodeHostname returns hostname with its punycode labels decoded to
+// Unicode, or hostname itself if it cannot be decoded.
+func decodeHostname(hostname string) string {
+	decoded, err := idna.ToUnicode(hostname)
+	if err != nil || decoded == "" {
+		return hostname
+	}
+	return decoded
+}
+
+// leaseFileKey identifies a version of the leases file.
+type leaseFileKey struct {
+	size    int64
+	modTime time.Time
+}
+
+// readLeaseFileCached is like readLeaseFile, but returns the leases parsed
+// by a previous call if the file is unchanged, see Config.CacheLeases. The
+// file is always opened by path, and a file renamed into place is a change
+// even if its size and modification time are those of the cached one.
+func (c *Collector) readLeaseFileCached(stats *leaseFileStats) ([]lease, error) {
+	fi, err := os.Stat(c.cfg.LeasesPath)
+	if err != nil {
+		// Let readLeaseFile handle a missing file.
+		return readLeaseFile(c.cfg.LeasesPath, c.cfg.MaxLeaseLineLength, stats)
+	}
+	key := leaseFileKey{size: fi.Size(), modTime: fi.ModTime()}
+
+	c.leaseCacheMu.Lock()
+	defer c.leaseCacheMu.Unlock()
+	if c.leaseCache != nil && c.leaseCacheKey == key && os.SameFile(c.leaseCacheFile, fi) {
+		if stats != nil {
+			stats.lines = c.leaseCacheStats.lines
+			stats.skipped = copySkipped(c.leaseCacheStats.skipped)
+		}
+		// The caller modifies the returned leases.
+		return append([]lease(nil), c.leaseCache...), nil
+	}
+	var fileStats leaseFileStats
+	activeLeases, err := readLeaseFile(c.cfg.LeasesPath, c.cfg.MaxLeaseLineLength, &fileStats)
+	if stats != nil {
+		*stats = fileStats
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.leaseCacheKey = key
+	c.leaseCacheFile = fi
+	c.leaseCache = append([]lease{}, activeLeases...)
+	c.leaseCacheStats = leaseFileStats{lines: fileStats.lines, skipped: copySkipped(fileStats.skipped)}
+	return activeLeases, nil
+}
+
+// stripDomain removes the domain from the end of hostname, if present.
+// Hostnames which consist of only the domain are returned unchanged.
+func stripDomain(hostname, domain string) string {
+	suffix := "." + strings.Trim(domain, ".")
+	if len(hostname) <= len(suffix) {
+		return hostname
+	}
+	if !strings.EqualFold(hostname[len(hostname)-len(suffix):], suffix) {
+		return hostname
+	}
+	return hostname[:len(hostname)-len(suffix)]
+}
+
+// errorID returns a random ID with which a logged error can be correlated
+// with the exemplar of dnsmasq_scrape_errors_total.
+func errorID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+// vendor returns the vendor of the MAC address mac according to
+// Config.VendorPrefixes, then Config.OUIVendors, or "other". If several
+// prefixes match, the longest one wins.
+func (c *Collector) vendor(mac string) string {
+	mac = strings.ToLower(mac)
+	vendor, matched := "other", ""
+	for prefix, v := range c.cfg.VendorPrefixes {
+		prefix = strings.ToLower(prefix)
+		if strings.HasPrefix(mac, prefix) && len(prefix) > len(matched) {
+			vendor, matched = v, prefix
+		}
+	}
+	if matched == "" {
+		if oui := normalizeMAC(mac); len(oui) >= 6 {
+			if v, ok := c.cfg.OUIVendors[oui[:6]]; ok {
+				vendor = v
+			}
+		}
+	}
+	return vendor
+}
+
+// exposeLease reports whether per-lease series should be exposed for l.
+func (c *Collector) exposeLease(l lease) bool {
+	if len(c.cfg.LeaseIPInclude) == 0 && len(c.cfg.LeaseIPExclude) == 0 {
+		return true
+	}
+	ip := net.ParseIP(l.ipAddress)
+	if ip == nil {
+		return len(c.cfg.LeaseIPInclude) == 0
+	}
+	if len(c.cfg.LeaseIPInclude) > 0 && !containsIP(c.cfg.LeaseIPInclude, ip) {
+		return false
+	}
+	return !containsIP(c.cfg.LeaseIPExclude, ip)
+}
+
+// matchesOUI reports whether mac starts with one of Config.LeaseOUIFilter,
+// or whether the filter is empty.
+func (c *Collector) matchesOUI(mac string) bool {
+	if len(c.cfg.LeaseOUIFilter) == 0 {
+		return true
+	}
+	mac = normalizeMAC(mac)
+	for _, oui := range c.cfg.LeaseOUIFilter {
+		if strings.HasPrefix(mac, normalizeMAC(oui)) {
+			return true
+		}
+	}
+	return false
+}
+
+// sampled reports whether l is among the leases sampled according to
+// Config.LeaseSampleRatio.
+func (c *Collector) sampled(l lease) bool {
+	ratio := c.cfg.LeaseSampleRatio
+	if ratio <= 0 || ratio >= 1 {
+		return true
+	}
+	sum := sha256.Sum256([]byte(l.clientKey()))
+	return float64(binary.BigEndian.Uint32(sum[:]))/(1<<32) < ratio
+}
+
+// normalizeMAC lower-cases mac and removes the separators.
+func normalizeMAC(mac string) string {
+	return strings.NewReplacer(":", "", "-", "", ".", "").Replace(strings.ToLower(mac))
+}
+
+// leaseSet returns activeLeases keyed by IP address and client, so that a
+// lease renewed with a new expiry is not considered changed.
+func leaseSet(activeLeases []lease) map[string]lease {
+	set := make(map[string]lease, len(activeLeases))
+	for _, l := range activeLeases {
+		set[l.ipAddress+" "+l.clientKey()] = l
+	}
+	return set
+}
+
+// diffLeases returns the leases in cur but not in prev (added) and those in
+// prev but not in cur (removed), both sorted by key.
+func diffLeases(prev, cur map[string]lease) (added, removed []lease) {
+	var addedKeys, removedKeys []string
+	for key := range cur {
+		if _, ok := prev[key]; !ok {
+			addedKeys = append(addedKeys, key)
+		}
+	}
+	for key := range prev {
+		if _, ok := cur[key]; !ok {
+			removedKeys = append(removedKeys, key)
+		}
+	}
+	sort.Strings(addedKeys)
+	sort.Strings(removedKeys)
+	for _, key := range addedKeys {
+		added = append(added, cur[key])
+	}
+	for _, key := range removedKeys {
+		removed = append(removed, prev[key])
+	}
+	return added, removed
+}
+
+// leaseChurn records the leases added or removed since the previous scrape
+// and returns the average number of changes per minute within
+// Config.LeaseChurnWindow (or since the first scrape, if that is more
+// recent).
+func (c *Collector) leaseChurn(activeLeases []lease) float64 {
+	current := leaseSet(activeLeases)
+	now := c.now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.churnLeases == nil {
+		c.churnStart = now
+	} else {
+		added, removed := diffLeases(c.churnLeases, current)
+		c.churnEvents = append(c.churnEvents, churnEvent{at: now, changes: len(added) + len(removed)})
+	}
+	c.churnLeases = current
+
+	cutoff := now.Add(-c.cfg.LeaseChurnWindow)
+	for len(c.churnEvents) > 0 && !c.churnEvents[0].at.After(cutoff) {
+		c.churnEvents = c.churnEvents[1:]
+	}
+	span := c.cfg.LeaseChurnWindow
+	if elapsed := now.Sub(c.churnStart); elapsed < span {
+		span = elapsed
+	}
+	if span <= 0 {
+		return 0
+	}
+	var changes int
+	for _, e := range c.churnEvents {
+		changes += e.changes
+	}
+	return float64(changes) / span.Minutes()
 }
 
-// Collector implements prometheus.Collector and exposes dnsmasq metrics.
-type Collector struct {
-	cfg Config
+// duidConflicts returns the number of client DUIDs which appear in DHCPv6
+// leases with more than one IAID, hinting at cloned or misbehaving clients.
+func duidConflicts(activeLeases []lease) int {
+	iaids := make(map[string]map[string]bool) // by DUID
+	for _, l := range activeLeases {
+		if l.iaid == "" || l.clientId == "" || l.clientId == "*" {
+			continue
+		}
+		if iaids[l.clientId] == nil {
+			iaids[l.clientId] = make(map[string]bool)
+		}
+		iaids[l.clientId][l.iaid] = true
+	}
+	var conflicts int
+	for _, set := range iaids {
+		if len(set) > 1 {
+			conflicts++
+		}
+	}
+	return conflicts
 }
 
-type lease struct {
-	expiry       uint64
-	macAddress   string
-	ipAddress    string
-	computerName string
-	clientId     string
+// collectRanges exposes the number of leases per Config.DhcpRanges and
+// updates their high-water marks.
+func (c *Collector) collectRanges(activeLeases []lease, ch chan<- prometheus.Metric) {
+	if len(c.cfg.DhcpRanges) == 0 {
+		return
+	}
+	counts := make([]int, len(c.cfg.DhcpRanges))
+	for _, l := range activeLeases {
+		ip := net.ParseIP(l.ipAddress)
+		if ip == nil {
+			continue
+		}
+		for i, r := range c.cfg.DhcpRanges {
+			if r.contains(ip) {
+				counts[i]++
+				break
+			}
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, r := range c.cfg.DhcpRanges {
+		name := r.String()
+		if counts[i] > c.rangeHighWater[name] {
+			c.rangeHighWater[name] = counts[i]
+		}
+		ch <- prometheus.MustNewConstMetric(leasesRange, prometheus.GaugeValue, float64(counts[i]), name)
+		ch <- prometheus.MustNewConstMetric(leasesRangeHighWater, prometheus.GaugeValue, float64(c.rangeHighWater[name]), name)
+	}
 }
 
-// New creates a new Collector.
-func New(cfg Config) *Collector {
-	return &Collector{
-		cfg: cfg,
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
 	}
+	return false
 }
 
-func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
-	for _, d := range floatMetrics {
-		ch <- d
+// collectFailed exposes the replacement value for the stats record
+// questionBind, whose query failed, according to Config.FailedStats.
+func (c *Collector) collectFailed(questionBind string, ch chan<- prometheus.Metric) {
+	g, ok := c.floatMetrics[questionBind]
+	if !ok {
+		return // servers.bind
 	}
-	for _, d := range serversMetrics {
-		ch <- d
+	v := math.NaN()
+	if c.cfg.FailedStats == FailedStatsLast {
+		c.mu.Lock()
+		last, ok := c.lastValues[questionBind]
+		c.mu.Unlock()
+		if !ok {
+			return
+		}
+		v = last
 	}
-	ch <- leases
-	ch <- leaseMetrics
+	ch <- prometheus.MustNewConstMetric(g, c.statsValueType(questionBind), v)
 }
 
-func (c *Collector) Collect(ch chan<- prometheus.Metric) {
-	var eg errgroup.Group
+// statsValueType returns the type of the metric of the stats DNS record
+// name, see Config.CounterRecords.
+func (c *Collector) statsValueType(name string) prometheus.ValueType {
+	for _, r := range c.cfg.CounterRecords {
+		if strings.EqualFold(dns.Fqdn(r), name) {
+			return prometheus.CounterValue
+		}
+	}
+	return prometheus.GaugeValue
+}
 
-	eg.Go(func() error {
-		questionBinds := []string{
-			"cachesize.bind.",
-			"insertions.bind.",
-			"evictions.bind.",
-			"misses.bind.",
-			"hits.bind.",
-			"auth.bind.",
-			"servers.bind.",
+// queryDnsmasq queries the stats DNS record questionBind and exposes the
+// answer. Values of single-value records are also stored in values, keyed by
+// record name.
+func queryDnsmasq(ctx context.Context, questionBind string, c *Collector, ch chan<- prometheus.Metric, values map[string]float64) error {
+	p, err := c.fetchStats(ctx, questionBind)
+	if p.answered {
+		ch <- prometheus.MustNewConstMetric(statsResponseBytes, prometheus.GaugeValue, float64(p.responseBytes), questionBind)
+		if p.empty {
+			c.emptyResponses.WithLabelValues(questionBind).Inc()
 		}
+	}
+	if err != nil {
+		c.queryFailures.WithLabelValues(questionBind).Inc()
+		return err
+	}
+	c.emitStats(p, ch, values)
+	c.querySuccesses.WithLabelValues(questionBind).Inc()
+	now := c.now()
+	c.mu.Lock()
+	c.lastSuccess[questionBind] = now
+	c.mu.Unlock()
+	return nil
+}
 
-		for _, questionBind := range questionBinds {
-			err := queryDnsmasq(questionBind, c, ch)
+// query queries the stats DNS record questionBind, retrying up to
+// Config.StatsRetries times.
+func (c *Collector) query(ctx context.Context, questionBind string) (*dns.Msg, error) {
+	_, end := c.startSpan(ctx, "dnsmasq.query "+questionBind)
+	in, err := c.exchange(questionBind)
+	for attempt := 0; err != nil && attempt < c.cfg.StatsRetries; attempt++ {
+		time.Sleep(c.backoff(attempt))
+		c.queryRetries.WithLabelValues(questionBind).Inc()
+		in, err = c.exchange(questionBind)
+	}
+	end(err)
+	return in, err
+}
 
-			if err != nil {
-				return err
+// Stats queries the stats and returns their values, keyed by stats DNS
+// record without the ".bind." suffix (e.g. "hits"), and the upstream servers
+// matching Config.ServerFilter. Unlike Collect, Stats fails if any query
+// fails. The upstream servers are not available with StatsSourceHTTP.
+func (c *Collector) Stats() (map[string]float64, []ServerStats, error) {
+	values := make(map[string]float64)
+	if c.cfg.StatsSource == StatsSourceHTTP {
+		fetched, err := c.fetchHTTPStats(context.Background())
+		if err != nil {
+			return nil, nil, err
+		}
+		for name, f := range fetched {
+			if _, ok := c.floatMetrics[name]; ok {
+				values[statsKey(name)] = f
 			}
 		}
-
-		return nil
-	})
-
-	eg.Go(func() error {
-		activeLeases, err := readLeaseFile(c.cfg.LeasesPath)
+		return values, nil, nil
+	}
+	servers := []ServerStats{}
+	for _, questionBind := range c.questionBinds {
+		p, err := c.fetchStats(context.Background(), questionBind)
 		if err != nil {
-			return err
+			return nil, nil, err
+		}
+		for name, f := range p.values {
+			values[statsKey(name)] = f
 		}
-		ch <- prometheus.MustNewConstMetric(leases, prometheus.GaugeValue, float64(len(activeLeases)))
+		servers = append(servers, p.servers...)
+	}
+	return values, servers, nil
+}
 
-		if c.cfg.ExposeLeases {
-			for _, activeLease := range activeLeases {
-				ch <- prometheus.MustNewConstMetric(leaseMetrics, prometheus.GaugeValue, float64(activeLease.expiry),
-					activeLease.macAddress, activeLease.ipAddress, activeLease.computerName, activeLease.clientId)
-			}
+// statsKey returns the stats DNS record name without the ".bind." suffix.
+func statsKey(name string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(name, "."), ".bind")
+}
+
+// hasTXT reports whether in answers the query for name with a TXT record.
+func hasTXT(in *dns.Msg, name string) bool {
+	for _, a := range in.Answer {
+		if txt, ok := a.(*dns.TXT); ok && strings.EqualFold(txt.Hdr.Name, name) {
+			return true
 		}
-		return nil
-	})
+	}
+	return false
+}
+
+// backoff returns how long to wait before retry number attempt (starting at
+// 0) of a failed stats query.
+func (c *Collector) backoff(attempt int) time.Duration {
+	d := float64(c.cfg.RetryBackoff) * math.Pow(2, float64(attempt))
+	if j := c.cfg.RetryJitter; j > 0 {
+		d *= 1 + j*(2*mathrand.Float64()-1)
+	}
+	return time.Duration(d)
+}
 
-	if err := eg.Wait(); err != nil {
-		log.Printf("could not complete scrape: %v", err)
+// Ping queries the cachesize.bind. stats DNS record to verify that dnsmasq is
+// reachable. It returns nil for collectors which only read leases.
+func (c *Collector) Ping() error {
+	if c.cfg.DnsmasqAddr == "" {
+		return nil
+	}
+	if c.cfg.StatsSource == StatsSourceHTTP {
+		_, err := c.fetchHTTPStats(context.Background())
+		return err
+	}
+	in, err := c.exchange("cachesize.bind.")
+	if err != nil {
+		return err
+	}
+	if len(in.Answer) == 0 {
+		return fmt.Errorf("dnsmasq at %s did not answer the cachesize.bind. query (rcode %d)", c.cfg.DnsmasqAddr, in.Rcode)
 	}
+	return nil
 }
 
-func queryDnsmasq(questionBind string, c *Collector, ch chan<- prometheus.Metric) error {
+// exchange sends the query for the stats DNS record questionBind to dnsmasq.
+func (c *Collector) exchange(questionBind string) (*dns.Msg, error) {
+	id := dns.Id
+	if c.cfg.QueryID != nil {
+		id = c.cfg.QueryID
+	}
 	msg := &dns.Msg{
 		MsgHdr: dns.MsgHdr{
-			Id:               dns.Id(),
+			Id:               id(),
 			RecursionDesired: true,
 		},
 		Question: []dns.Question{
 			question(questionBind),
 		},
 	}
-	in, _, err := c.cfg.DnsClient.Exchange(msg, c.cfg.DnsmasqAddr)
+	if c.cfg.DnsCookies {
+		c.mu.Lock()
+		cookie := c.clientCookie + c.serverCookie
+		c.mu.Unlock()
+		msg.SetEdns0(dns.DefaultMsgSize, false)
+		opt := msg.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{
+			Code:   dns.EDNS0COOKIE,
+			Cookie: cookie,
+		})
+	}
+	client, _ := c.dnsClient()
+	in, _, err := client.Exchange(msg, c.cfg.DnsmasqAddr)
+	if c.cfg.Protocol == "auto" && c.cfg.FallbackClient != nil && (isDisconnect(err) || err == nil && in.Truncated) {
+		c.tcpFallbacks.Inc()
+		in, _, err = c.cfg.FallbackClient.Exchange(msg, c.cfg.DnsmasqAddr)
+	}
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if c.cfg.DnsCookies {
+		if err := c.checkCookie(in); err != nil {
+			return nil, fmt.Errorf("%s: %v", questionBind, err)
+		}
+	}
+	return in, nil
+}
+
+// isDisconnect reports whether err means that a query timed out or its
+// connection was closed, after which it is worth retrying over TCP.
+func isDisconnect(err error) bool {
+	if err == nil {
+		return false
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return true
+	}
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// checkCookie verifies that the response in echoes our client cookie and
+// remembers its server cookie for the next query.
+func (c *Collector) checkCookie(in *dns.Msg) error {
+	opt := in.IsEdns0()
+	if opt == nil {
+		return fmt.Errorf("response carries no DNS cookie")
+	}
+	for _, o := range opt.Option {
+		cookie, ok := o.(*dns.EDNS0_COOKIE)
+		if !ok {
+			continue
+		}
+		// The client cookie is 8 bytes, the server cookie 8 to 32 bytes.
+		clientCookie, serverCookie := cookie.Cookie, ""
+		if len(clientCookie) > len(c.clientCookie) {
+			clientCookie, serverCookie = cookie.Cookie[:len(c.clientCookie)], cookie.Cookie[len(c.clientCookie):]
+		}
+		if !strings.EqualFold(clientCookie, c.clientCookie) {
+			return fmt.Errorf("DNS client cookie mismatch")
+		}
+		if len(serverCookie) < 16 || len(serverCookie) > 64 {
+			return fmt.Errorf("invalid DNS server cookie length: %d bytes", len(serverCookie)/2)
+		}
+		c.mu.Lock()
+		c.serverCookie = serverCookie
+		c.mu.Unlock()
+		return nil
 	}
+	return fmt.Errorf("response carries no DNS cookie")
+}
+
+// ServerStats are the stats of one upstream server, from servers.bind.
+type ServerStats struct {
+	Server        string  `json:"server"` // e.g. "127.0.0.1#53"
+	Queries       float64 `json:"queries"`
+	FailedQueries float64 `json:"queries_failed"`
+
+	// Extra are the numeric fields following FailedQueries, keyed by their
+	// index in the entry, see parseServerStats.
+	Extra map[int]float64 `json:"extra,omitempty"`
+}
+
+// parsedStats are the stats contained in an answer to a stats query.
+type parsedStats struct {
+	// answered is set if dnsmasq answered the query (even if the answer
+	// could not be parsed), with a response of responseBytes which is empty
+	// if it has no TXT record for the queried name.
+	answered      bool
+	responseBytes int
+	empty         bool
+
+	values map[string]float64 // keyed by stats DNS record
+
+	// servers are the upstream servers matching Config.ServerFilter, and
+	// forwarded the queries forwarded to all servers, if servers.bind was
+	// answered.
+	servers    []ServerStats
+	forwarded  float64
+	hasServers bool
+
+	unknown []*dns.TXT // records without a metric, in order
+}
+
+// parseStatsAnswer parses the stats contained in the answer in.
+func (c *Collector) parseStatsAnswer(in *dns.Msg) (parsedStats, error) {
+	p := parsedStats{values: make(map[string]float64)}
+	// Some proxies split values across several strings or TXT records,
+	// which are concatenated.
+	var names []string
+	parts := make(map[string][]string)
 	for _, a := range in.Answer {
 		txt, ok := a.(*dns.TXT)
 		if !ok {
@@ -212,39 +2320,193 @@ func queryDnsmasq(questionBind string, c *Collector, ch chan<- prometheus.Metric
 		}
 		switch txt.Hdr.Name {
 		case "servers.bind.":
+			p.hasServers = true
 			for _, str := range txt.Txt {
-				arr := strings.Fields(str)
-				if got, want := len(arr), 3; got != want {
-					return fmt.Errorf("stats DNS record servers.bind.: unexpeced number of argument in record: got %d, want %d", got, want)
-				}
-				queries, err := strconv.ParseFloat(arr[1], 64)
+				s, err := parseServerStats(str)
 				if err != nil {
-					return err
+					return parsedStats{}, err
 				}
-				failedQueries, err := strconv.ParseFloat(arr[2], 64)
-				if err != nil {
-					return err
+				p.forwarded += s.Queries
+				if c.cfg.ServerFilter != nil && !c.cfg.ServerFilter.MatchString(s.Server) {
+					continue
 				}
-				ch <- prometheus.MustNewConstMetric(serversMetrics["queries"], prometheus.GaugeValue, queries, arr[0])
-				ch <- prometheus.MustNewConstMetric(serversMetrics["queries_failed"], prometheus.GaugeValue, failedQueries, arr[0])
+				p.servers = append(p.servers, s)
 			}
 		default:
-			g, ok := floatMetrics[txt.Hdr.Name]
-			if !ok {
+			if _, ok := c.floatMetrics[txt.Hdr.Name]; !ok {
+				p.unknown = append(p.unknown, txt)
 				continue // ignore unexpected answer from dnsmasq
 			}
-			if got, want := len(txt.Txt), 1; got != want {
-				return fmt.Errorf("stats DNS record %q: unexpected number of replies: got %d, want %d", txt.Hdr.Name, got, want)
+			if _, ok := parts[txt.Hdr.Name]; !ok {
+				names = append(names, txt.Hdr.Name)
 			}
-			f, err := strconv.ParseFloat(txt.Txt[0], 64)
-			if err != nil {
-				return err
+			parts[txt.Hdr.Name] = append(parts[txt.Hdr.Name], txt.Txt...)
+		}
+	}
+
+	for _, name := range names {
+		if len(parts[name]) == 0 {
+			return parsedStats{}, fmt.Errorf("stats DNS record %q: no value", name)
+		}
+		f, err := strconv.ParseFloat(strings.Join(parts[name], ""), 64)
+		if err != nil {
+			return parsedStats{}, err
+		}
+		p.values[name] = f
+	}
+	return p, nil
+}
+
+// fetchStats queries the stats DNS record questionBind and parses the
+// answer. If the answer cannot be parsed, the returned parsedStats only
+// describe the response.
+func (c *Collector) fetchStats(ctx context.Context, questionBind string) (parsedStats, error) {
+	in, err := c.query(ctx, questionBind)
+	if err != nil {
+		return parsedStats{}, err
+	}
+	p, err := c.parseStatsAnswer(in)
+	p.answered = true
+	p.responseBytes = in.Len()
+	p.empty = !hasTXT(in, questionBind)
+	return p, err
+}
+
+// emitStats exposes the stats p, see queryDnsmasq.
+func (c *Collector) emitStats(p parsedStats, ch chan<- prometheus.Metric, values map[string]float64) {
+	if p.hasServers {
+		for _, s := range p.servers {
+			if c.cfg.SplitServerAddr {
+				ip, port := splitServerAddr(s.Server)
+				ch <- prometheus.MustNewConstMetric(serversMetricsSplit["queries"], prometheus.GaugeValue, s.Queries, ip, port)
+				ch <- prometheus.MustNewConstMetric(serversMetricsSplit["queries_failed"], prometheus.GaugeValue, s.FailedQueries, ip, port)
+			} else {
+				ch <- prometheus.MustNewConstMetric(serversMetrics["queries"], prometheus.GaugeValue, s.Queries, s.Server)
+				ch <- prometheus.MustNewConstMetric(serversMetrics["queries_failed"], prometheus.GaugeValue, s.FailedQueries, s.Server)
+			}
+			if !c.cfg.ServerExtraStats {
+				continue
+			}
+			for field, f := range s.Extra {
+				idx := strconv.Itoa(field)
+				if c.cfg.SplitServerAddr {
+					ip, port := splitServerAddr(s.Server)
+					ch <- prometheus.MustNewConstMetric(serversExtraStatSplit, prometheus.GaugeValue, f, ip, port, idx)
+					continue
+				}
+				ch <- prometheus.MustNewConstMetric(serversExtraStat, prometheus.GaugeValue, f, s.Server, idx)
 			}
-			ch <- prometheus.MustNewConstMetric(g, prometheus.GaugeValue, f)
 		}
+		ch <- prometheus.MustNewConstMetric(queriesForwarded, prometheus.CounterValue, p.forwarded)
 	}
+	if c.cfg.ExportUnknownStats {
+		for _, txt := range p.unknown {
+			collectUnknownStat(txt, ch, values)
+		}
+	}
+	for name, f := range p.values {
+		values[name] = f
+		ch <- prometheus.MustNewConstMetric(c.floatMetrics[name], c.statsValueType(name), f)
+	}
+}
 
-	return nil
+// parseServerStats parses one upstream server entry of servers.bind, which
+// dnsmasq formats as "address#port queries failed". The fields are parsed
+// by position so that format extensions do not break the per-server
+// metrics: further stats appended to a field after a slash (e.g. "10/3")
+// are ignored, and numeric trailing fields are returned in Extra, keyed by
+// their index in entry (non-numeric ones are ignored).
+func parseServerStats(entry string) (ServerStats, error) {
+	arr := strings.Fields(entry)
+	if got, want := len(arr), 3; got < want {
+		return ServerStats{}, fmt.Errorf("stats DNS record servers.bind.: unexpected number of fields in %q: got %d, want at least %d", entry, got, want)
+	}
+	queries, err := strconv.ParseFloat(beforeSlash(arr[1]), 64)
+	if err != nil {
+		return ServerStats{}, err
+	}
+	failedQueries, err := strconv.ParseFloat(beforeSlash(arr[2]), 64)
+	if err != nil {
+		return ServerStats{}, err
+	}
+	s := ServerStats{Server: arr[0], Queries: queries, FailedQueries: failedQueries}
+	for i, field := range arr[3:] {
+		f, err := strconv.ParseFloat(beforeSlash(field), 64)
+		if err != nil {
+			continue
+		}
+		if s.Extra == nil {
+			s.Extra = make(map[int]float64)
+		}
+		s.Extra[3+i] = f
+	}
+	return s, nil
+}
+
+// splitServerAddr splits the address of an upstream server as written by
+// dnsmasq (address#port, possibly with the IPv6 address in brackets) or as
+// host:port into its IP address and port. If server cannot be split, it is
+// returned as the IP address with an empty port.
+func splitServerAddr(server string) (ip, port string) {
+	if idx := strings.LastIndex(server, "#"); idx != -1 {
+		ip, port = server[:idx], server[idx+1:]
+	} else if host, p, err := net.SplitHostPort(server); err == nil {
+		ip, port = host, p
+	} else {
+		return server, ""
+	}
+	ip = strings.TrimSuffix(strings.TrimPrefix(ip, "["), "]")
+	if net.ParseIP(ip) == nil {
+		return server, ""
+	}
+	return ip, port
+}
+
+// beforeSlash returns s up to the first slash, if any.
+func beforeSlash(s string) string {
+	if idx := strings.Index(s, "/"); idx != -1 {
+		return s[:idx]
+	}
+	return s
+}
+
+// collectUnknownStat exposes the unknown stats record txt (see
+// Config.ExportUnknownStats) unless it is not numeric or was already exposed
+// in this scrape.
+func collectUnknownStat(txt *dns.TXT, ch chan<- prometheus.Metric, values map[string]float64) {
+	name := strings.ToLower(txt.Hdr.Name)
+	if _, ok := values[name]; ok || len(txt.Txt) != 1 {
+		return
+	}
+	metric := unknownStatMetricName(name)
+	if metric == "" {
+		return
+	}
+	f, err := strconv.ParseFloat(strings.TrimSpace(txt.Txt[0]), 64)
+	if err != nil {
+		return
+	}
+	values[name] = f
+	desc := prometheus.NewDesc(metric, "dnsmasq stats DNS record "+name, nil, nil)
+	ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, f)
+}
+
+// unknownStatMetricName returns the metric name for the unknown stats record
+// name, or "" if the record name contains nothing usable.
+func unknownStatMetricName(name string) string {
+	name = strings.TrimSuffix(strings.TrimSuffix(name, "."), ".bind")
+	var b strings.Builder
+	for _, r := range name {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' {
+			b.WriteRune(r)
+		} else {
+			b.WriteByte('_')
+		}
+	}
+	if strings.Trim(b.String(), "_") == "" {
+		return ""
+	}
+	return "dnsmasq_unknown_" + b.String()
 }
 
 func question(name string) dns.Question {
@@ -255,7 +2517,40 @@ func question(name string) dns.Question {
 	}
 }
 
+// clientKey identifies the client holding the lease: its MAC address, or its
+// client ID (DUID) for DHCPv6 leases, which carry no MAC address.
+func (l lease) clientKey() string {
+	if l.iaid != "" || l.macAddress == "*" {
+		return "id:" + l.clientId
+	}
+	return "mac:" + strings.ToLower(l.macAddress)
+}
+
+// clientIDType classifies the client ID of l as "mac" (a hardware type
+// followed by the MAC address, or a bare MAC address), "duid" (the DUID of a
+// DHCPv6 lease, or an RFC 4361 client ID of type 255) or "other".
+func clientIDType(l lease) string {
+	if l.clientId == "*" || l.clientId == "" {
+		return "other"
+	}
+	b, err := hex.DecodeString(strings.Replace(l.clientId, ":", "", -1))
+	if err != nil || len(b) == 0 {
+		return "other"
+	}
+	switch {
+	case l.iaid != "":
+		return "duid"
+	case b[0] == 0xff:
+		return "duid"
+	case len(b) == 7 && b[0] == 1, len(b) == 6:
+		return "mac"
+	}
+	return "other"
+}
+
 func parseLease(line string) (*lease, error) {
+	// Splitting at any white space also trims the fields, e.g. of the \r of
+	// files with CRLF line endings.
 	arr := strings.Fields(line)
 	if got, want := len(arr), 5; got != want {
 		return nil, fmt.Errorf("illegal lease: expected %d fields, got %d", want, got)
@@ -266,13 +2561,76 @@ func parseLease(line string) (*lease, error) {
 		return nil, err
 	}
 
-	return &lease{
+	l := &lease{
 		expiry:       expires,
 		macAddress:   arr[1],
 		ipAddress:    arr[2],
 		computerName: arr[3],
 		clientId:     arr[4],
-	}, nil
+	}
+
+	// Prefix delegation leases carry the delegated prefix in CIDR notation
+	// (e.g. 2001:db8:1::/56) where address leases carry the address.
+	ip := net.ParseIP(arr[2])
+	if strings.Contains(arr[2], "/") {
+		var prefix *net.IPNet
+		ip, prefix, err = net.ParseCIDR(arr[2])
+		if err != nil {
+			return nil, err
+		}
+		l.prefixLength, _ = prefix.Mask.Size()
+	}
+	if ip != nil && ip.To4() == nil {
+		l.iaid, l.macAddress = arr[1], ""
+	}
+	return l, nil
+}
+
+// Reasons for dnsmasq_leases_skipped.
+const (
+	skipDUID      = "duid"       // the DHCPv6 server DUID line
+	skipBlank     = "blank"      // empty lines
+	skipDuplicate = "duplicate"  // leases for an IP address already read from a newer file
+	skipIPFilter  = "ip_filter"  // leases excluded from the per-lease metrics by IP address
+	skipOUIFilter = "oui_filter" // leases excluded from the per-lease metrics by MAC address
+	skipSampled   = "sampled"    // leases not sampled for the per-lease metrics
+)
+
+// skipReasons are all reasons for dnsmasq_leases_skipped, which is exposed
+// for each of them.
+var skipReasons = []string{skipDUID, skipBlank, skipDuplicate, skipIPFilter, skipOUIFilter, skipSampled}
+
+// leaseFileStats counts the lines scanned and skipped while reading lease
+// files.
+type leaseFileStats struct {
+	lines   int
+	skipped map[string]int // by reason
+	errors  int
+}
+
+// copySkipped returns a copy of the skipped lines of a leaseFileStats.
+func copySkipped(skipped map[string]int) map[string]int {
+	c := make(map[string]int, len(skipped))
+	for reason, n := range skipped {
+		c[reason] = n
+	}
+	return c
+}
+
+func (s *leaseFileStats) skip(reason string) {
+	if s == nil {
+		return
+	}
+	if s.skipped == nil {
+		s.skipped = make(map[string]int)
+	}
+	s.skipped[reason]++
+}
+
+func (s *leaseFileStats) parseError() {
+	if s != nil {
+		s.errors++
+	}
 }
 
 // Read the DHCP lease file with the given path and return a list of leases.
@@ -286,8 +2644,23 @@ func parseLease(line string) (*lease, error) {
 //
 // The DHCP lease file is written to by lease_update_file() in
 // src/lease.c, and is read by lease_init().
-func readLeaseFile(path string) ([]lease, error) {
-	f, err := os.Open(path)
+//
+// A path of "-" reads the leases from standard input instead. Lines longer
+// than maxLineLength bytes are skipped.
+func readLeaseFile(path string, maxLineLength int, stats *leaseFileStats) ([]lease, error) {
+	if path == "-" {
+		return parseLeases(os.Stdin, maxLineLength, stats)
+	}
+	return openLeaseFile(path, openFile, maxLineLength, stats)
+}
+
+func openFile(path string) (io.ReadCloser, error) {
+	return os.Open(path)
+}
+
+// openLeaseFile reads the DHCP leases file at path, opened by open.
+func openLeaseFile(path string, open func(string) (io.ReadCloser, error), maxLineLength int, stats *leaseFileStats) ([]lease, error) {
+	f, err := open(path)
 	if err != nil {
 		if os.IsNotExist(err) {
 			// ignore
@@ -296,17 +2669,101 @@ func readLeaseFile(path string) ([]lease, error) {
 
 		return nil, err
 	}
-
 	defer f.Close()
+	return parseLeases(f, maxLineLength, stats)
+}
+
+// Lease is a DHCP lease as returned by ParseLeases.
+type Lease struct {
+	Expiry       uint64 `json:"expiry"`                // Unix time, 0 for infinite leases
+	MacAddress   string `json:"mac_address,omitempty"` // empty for DHCPv6 leases
+	IpAddress    string `json:"ip_address"`            // or the delegated prefix for DHCPv6 prefix delegation
+	ComputerName string `json:"computer_name"`
+	ClientId     string `json:"client_id"`
+	Iaid         string `json:"iaid,omitempty"` // DHCPv6 leases only
+}
+
+// ParseLeases parses DHCP leases in the format of the dnsmasq leases file
+// from r, e.g. to process leases from sources other than a file. Lines which
+// cannot be parsed are logged and skipped. To have a Collector read leases
+// from such a source, see Config.OpenLeases.
+func ParseLeases(r io.Reader) ([]Lease, error) {
+	leases, err := parseLeases(r, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	return exportLeases(leases), nil
+}
+
+// exportLeases converts leases to their exported representation.
+func exportLeases(leases []lease) []Lease {
+	result := make([]Lease, len(leases))
+	for i, l := range leases {
+		result[i] = Lease{
+			Expiry:       l.expiry,
+			MacAddress:   l.macAddress,
+			IpAddress:    l.ipAddress,
+			ComputerName: l.computerName,
+			ClientId:     l.clientId,
+			Iaid:         l.iaid,
+		}
+	}
+	return result
+}
 
-	scanner := bufio.NewScanner(f)
+// parseLeases parses the DHCP leases in r, skipping lines longer than
+// maxLineLength bytes and counting skipped and unparseable lines in stats
+// (if non-nil).
+func parseLeases(r io.Reader, maxLineLength int, stats *leaseFileStats) ([]lease, error) {
+	if maxLineLength <= 0 {
+		maxLineLength = DefaultMaxLeaseLineLength
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxLineLength)
+	// Lines which do not fit into the scanner's buffer are skipped instead of
+	// failing the whole read with bufio.ErrTooLong: the part which was read
+	// is discarded, and the remainder of the line is returned as an empty
+	// token with tooLong set.
+	var discarding, tooLong bool
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		advance, token, err := bufio.ScanLines(data, atEOF)
+		if advance == 0 && token == nil && err == nil && len(data) >= maxLineLength {
+			discarding = true
+			return len(data), nil, nil
+		}
+		if discarding && token != nil {
+			discarding = false
+			tooLong = true
+			return advance, []byte{}, nil
+		}
+		return advance, token, err
+	})
 	activeLeases := []lease{}
 	for i := 1; scanner.Scan(); i++ {
+		if stats != nil {
+			stats.lines++
+		}
+		if tooLong {
+			tooLong = false
+			log.Printf("Skipping lease (%d): line exceeds %d bytes", i, maxLineLength)
+			stats.parseError()
+			continue
+		}
 		leaseLine := scanner.Text()
+		fields := strings.Fields(leaseLine)
+		if len(fields) == 0 {
+			stats.skip(skipBlank)
+			continue
+		}
+		if fields[0] == "duid" {
+			stats.skip(skipDUID)
+			continue
+		}
 		if activeLease, err := parseLease(leaseLine); err == nil {
 			activeLeases = append(activeLeases, *activeLease)
 		} else {
 			log.Printf("Error parsing lease (%d, %q): %s", i, leaseLine, err)
+			stats.parseError()
 		}
 	}
 
@@ -316,3 +2773,50 @@ func readLeaseFile(path string) ([]lease, error) {
 
 	return activeLeases, nil
 }
+
+// readLeaseFiles reads all DHCP lease files matching the glob pattern and
+// returns the union of their leases. If several files contain a lease for the
+// same IP address, the lease from the most recently modified file wins.
+func readLeaseFiles(pattern string, maxLineLength int, stats *leaseFileStats) ([]lease, error) {
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	type file struct {
+		path  string
+		mtime time.Time
+	}
+	var files []file
+	for _, path := range paths {
+		fi, err := os.Stat(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue // removed since globbing
+			}
+			return nil, err
+		}
+		files = append(files, file{path, fi.ModTime()})
+	}
+	// newest first
+	sort.SliceStable(files, func(i, j int) bool {
+		return files[i].mtime.After(files[j].mtime)
+	})
+
+	seen := make(map[string]bool)
+	activeLeases := []lease{}
+	for _, f := range files {
+		fileLeases, err := readLeaseFile(f.path, maxLineLength, stats)
+		if err != nil {
+			return nil, err
+		}
+		for _, l := range fileLeases {
+			if seen[l.ipAddress] {
+				stats.skip(skipDuplicate)
+				continue
+			}
+			seen[l.ipAddress] = true
+			activeLeases = append(activeLeases, l)
+		}
+	}
+	return activeLeases, nil
+}
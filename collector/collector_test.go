@@ -15,6 +15,8 @@
 package collector
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net"
@@ -22,7 +24,13 @@ import (
 	"net/http/httptest"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -161,8 +169,8 @@ func TestDnsmasqExporter(t *testing.T) {
 			"dnsmasq_cachesize": "666",
 			"dnsmasq_hits":      "33",
 			"dnsmasq_misses":    "1",
-			"dnsmasq_lease_expiry{client_id=\"00:00:00:00:00:00\",computer_name=\"host-1\",ip_addr=\"10.10.10.10\",mac_addr=\"00:00:00:00:00:00\"}": "1.625595932e+09",
-			"dnsmasq_lease_expiry{client_id=\"00:00:00:00:00:01\",computer_name=\"host-2\",ip_addr=\"10.10.10.11\",mac_addr=\"00:00:00:00:00:01\"}": "0",
+			"dnsmasq_lease_expiry{client_id=\"00:00:00:00:00:00\",computer_name=\"host-1\",iaid=\"\",ip_addr=\"10.10.10.10\",mac_addr=\"00:00:00:00:00:00\"}": "1.625595932e+09",
+			"dnsmasq_lease_expiry{client_id=\"00:00:00:00:00:01\",computer_name=\"host-2\",iaid=\"\",ip_addr=\"10.10.10.11\",mac_addr=\"00:00:00:00:00:01\"}": "0",
 		}
 		for key, val := range want {
 			if got, want := metrics[key], val; got != want {
@@ -211,14 +219,2951 @@ func fetchMetrics(t *testing.T, c *Collector) map[string]string {
 		if strings.HasPrefix(line, "#") {
 			continue
 		}
-		parts := strings.Split(line, " ")
-		if len(parts) < 2 {
+		// Label values may contain spaces, the value may not.
+		idx := strings.LastIndex(line, " ")
+		if idx == -1 {
 			continue
 		}
-		if !strings.HasPrefix(parts[0], "dnsmasq_") {
+		if !strings.HasPrefix(line, "dnsmasq_") {
 			continue
 		}
-		metrics[parts[0]] = parts[1]
+		metrics[line[:idx]] = line[idx+1:]
 	}
 	return metrics
 }
+
+// fakeDnsmasq starts a DNS server on localhost which answers CHAOS TXT queries
+// from the records map (keyed by question name, e.g. "cachesize.bind.") and
+// returns its address.
+func fakeDnsmasq(t *testing.T, records map[string][]string) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{
+		PacketConn: pc,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetReply(r)
+			for _, q := range r.Question {
+				txt, ok := records[q.Name]
+				if !ok {
+					continue
+				}
+				m.Answer = append(m.Answer, &dns.TXT{
+					Hdr: dns.RR_Header{
+						Name:   q.Name,
+						Rrtype: dns.TypeTXT,
+						Class:  dns.ClassCHAOS,
+					},
+					Txt: txt,
+				})
+			}
+			w.WriteMsg(m)
+		}),
+	}
+	started := make(chan struct{})
+	srv.NotifyStartedFunc = func() { close(started) }
+	go srv.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { srv.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+var fakeRecords = map[string][]string{
+	"cachesize.bind.":  {"666"},
+	"insertions.bind.": {"1"},
+	"evictions.bind.":  {"0"},
+	"misses.bind.":     {"1"},
+	"hits.bind.":       {"5"},
+	"auth.bind.":       {"0"},
+	"servers.bind.":    {"127.0.0.1#53 10 2"},
+}
+
+// copyFakeRecords returns a copy of fakeRecords which a test can modify.
+func copyFakeRecords() map[string][]string {
+	records := make(map[string][]string, len(fakeRecords))
+	for k, v := range fakeRecords {
+		records[k] = v
+	}
+	return records
+}
+
+func TestMaxLeaseSeries(t *testing.T) {
+	cfg := Config{
+		DnsClient:    &dns.Client{},
+		DnsmasqAddr:  fakeDnsmasq(t, fakeRecords),
+		LeasesPath:   "testdata/dnsmasq.leases",
+		ExposeLeases: true,
+	}
+
+	for _, tt := range []struct {
+		max       int
+		truncated string
+		series    int
+	}{
+		{max: 0, truncated: "0", series: 2},
+		{max: 2, truncated: "0", series: 2},
+		{max: 1, truncated: "1", series: 0},
+	} {
+		t.Run(fmt.Sprintf("max=%d", tt.max), func(t *testing.T) {
+			cfg.MaxLeaseSeries = tt.max
+			metrics := fetchMetrics(t, New(cfg))
+			if got, want := metrics["dnsmasq_leases"], "2"; got != want {
+				t.Errorf("dnsmasq_leases: got %q, want %q", got, want)
+			}
+			if got, want := metrics["dnsmasq_lease_series_truncated"], tt.truncated; got != want {
+				t.Errorf("dnsmasq_lease_series_truncated: got %q, want %q", got, want)
+			}
+			var series int
+			for key := range metrics {
+				if strings.HasPrefix(key, "dnsmasq_lease_expiry") {
+					series++
+				}
+			}
+			if got, want := series, tt.series; got != want {
+				t.Errorf("dnsmasq_lease_expiry series: got %d, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestOpenMetrics(t *testing.T) {
+	c := New(Config{
+		DnsClient:   &dns.Client{},
+		DnsmasqAddr: fakeDnsmasq(t, fakeRecords),
+		LeasesPath:  "testdata/dnsmasq.leases",
+		// Counters are exposed with a _total suffix in OpenMetrics.
+		CounterRecords: []string{"hits.bind."},
+	})
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c)
+	handler := promhttp.HandlerFor(reg, promhttp.HandlerOpts{
+		EnableOpenMetrics: true,
+	})
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Accept", "application/openmetrics-text; version=0.0.1")
+	handler.ServeHTTP(rec, req)
+	resp := rec.Result()
+	if got, want := resp.Header.Get("Content-Type"), "application/openmetrics-text"; !strings.HasPrefix(got, want) {
+		t.Fatalf("unexpected Content-Type: got %q, want prefix %q", got, want)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"# TYPE dnsmasq_cachesize gauge",
+		"# TYPE dnsmasq_hits counter",
+		"dnsmasq_hits_total 5.0",
+		"# TYPE dnsmasq_misses gauge",
+		"# TYPE dnsmasq_servers_queries gauge",
+		"# TYPE dnsmasq_leases gauge",
+	} {
+		if !strings.Contains(string(body), want+"\n") {
+			t.Errorf("OpenMetrics output does not contain %q:\n%s", want, body)
+		}
+	}
+	if !strings.HasSuffix(string(body), "# EOF\n") {
+		t.Errorf("OpenMetrics output does not end with # EOF:\n%s", body)
+	}
+}
+
+func TestReadLeaseFileStdin(t *testing.T) {
+	f, err := os.Open("testdata/dnsmasq.leases")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	stdin := os.Stdin
+	os.Stdin = f
+	defer func() { os.Stdin = stdin }()
+
+	leases, err := readLeaseFile("-", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(leases), 2; got != want {
+		t.Fatalf("unexpected number of leases: got %d, want %d", got, want)
+	}
+	if got, want := leases[1].computerName, "host-2"; got != want {
+		t.Errorf("unexpected computer name: got %q, want %q", got, want)
+	}
+}
+
+func TestFailedStats(t *testing.T) {
+	for _, tt := range []struct {
+		failedStats string
+		hits        string
+		auth        string
+	}{
+		{failedStats: FailedStatsOmit, hits: "", auth: ""},
+		{failedStats: FailedStatsNaN, hits: "NaN", auth: "0"},
+		{failedStats: FailedStatsLast, hits: "5", auth: "0"},
+	} {
+		t.Run(tt.failedStats, func(t *testing.T) {
+			records := copyFakeRecords()
+			c := New(Config{
+				DnsClient:   &dns.Client{},
+				DnsmasqAddr: fakeDnsmasq(t, records),
+				LeasesPath:  "testdata/dnsmasq.leases",
+				FailedStats: tt.failedStats,
+			})
+			if got, want := fetchMetrics(t, c)["dnsmasq_hits"], "5"; got != want {
+				t.Fatalf("dnsmasq_hits: got %q, want %q", got, want)
+			}
+
+			records["hits.bind."] = []string{"not a number"}
+			metrics := fetchMetrics(t, c)
+			if got, want := metrics["dnsmasq_hits"], tt.hits; got != want {
+				t.Errorf("dnsmasq_hits: got %q, want %q", got, want)
+			}
+			if got, want := metrics["dnsmasq_auth"], tt.auth; got != want {
+				t.Errorf("dnsmasq_auth: got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestLeasesExpiringSoon(t *testing.T) {
+	now := time.Unix(1625590000, 0)
+	leasesPath := filepath.Join(t.TempDir(), "dnsmasq.leases")
+	leases := fmt.Sprintf(`%d 00:00:00:00:00:00 10.10.10.10 host-1 00:00:00:00:00:00
+%d 00:00:00:00:00:01 10.10.10.11 host-2 00:00:00:00:00:01
+%d 00:00:00:00:00:02 10.10.10.12 host-3 00:00:00:00:00:02
+0 00:00:00:00:00:03 10.10.10.13 host-4 00:00:00:00:00:03
+`,
+		now.Add(10*time.Minute).Unix(),
+		now.Add(2*time.Hour).Unix(),
+		now.Add(-time.Minute).Unix())
+	if err := os.WriteFile(leasesPath, []byte(leases), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := New(Config{
+		DnsClient:     &dns.Client{},
+		DnsmasqAddr:   fakeDnsmasq(t, fakeRecords),
+		LeasesPath:    leasesPath,
+		ExpiryWarning: time.Hour,
+	})
+	c.now = func() time.Time { return now }
+	metrics := fetchMetrics(t, c)
+	if got, want := metrics["dnsmasq_leases_expiring_soon"], "1"; got != want {
+		t.Errorf("dnsmasq_leases_expiring_soon: got %q, want %q", got, want)
+	}
+}
+
+func TestReadLeaseFileLongLine(t *testing.T) {
+	leasesPath := filepath.Join(t.TempDir(), "dnsmasq.leases")
+	leases := "1625595932 00:00:00:00:00:00 10.10.10.10 host-1 00:00:00:00:00:00\n" +
+		"0 00:00:00:00:00:01 10.10.10.11 host-2 " + strings.Repeat("ff:", 100000) + "ff\n" +
+		"0 00:00:00:00:00:02 10.10.10.12 host-3 00:00:00:00:00:02\n"
+	if err := os.WriteFile(leasesPath, []byte(leases), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		maxLineLength int
+		want          []string
+	}{
+		{maxLineLength: 4096, want: []string{"host-1", "host-3"}},
+		{maxLineLength: 0, want: []string{"host-1", "host-2", "host-3"}},
+	} {
+		parsed, err := readLeaseFile(leasesPath, tt.maxLineLength, nil)
+		if err != nil {
+			t.Fatalf("readLeaseFile(maxLineLength=%d): %v", tt.maxLineLength, err)
+		}
+		var got []string
+		for _, l := range parsed {
+			got = append(got, l.computerName)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("readLeaseFile(maxLineLength=%d): got leases %v, want %v", tt.maxLineLength, got, tt.want)
+		}
+	}
+}
+
+func TestCacheHitRatio(t *testing.T) {
+	for _, tt := range []struct {
+		hits, misses string
+		want         string
+	}{
+		{hits: "3", misses: "1", want: "0.75"},
+		{hits: "0", misses: "0", want: "0"},
+		{hits: "0", misses: "not a number", want: ""},
+	} {
+		t.Run(tt.hits+"/"+tt.misses, func(t *testing.T) {
+			records := copyFakeRecords()
+			records["hits.bind."] = []string{tt.hits}
+			records["misses.bind."] = []string{tt.misses}
+			c := New(Config{
+				DnsClient:   &dns.Client{},
+				DnsmasqAddr: fakeDnsmasq(t, records),
+				LeasesPath:  "testdata/dnsmasq.leases",
+			})
+			if got, want := fetchMetrics(t, c)["dnsmasq_cache_hit_ratio"], tt.want; got != want {
+				t.Errorf("dnsmasq_cache_hit_ratio: got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestLeaseIPFilter(t *testing.T) {
+	mustParseCIDR := func(s string) *net.IPNet {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	for _, tt := range []struct {
+		name    string
+		include []*net.IPNet
+		exclude []*net.IPNet
+		want    []string
+	}{
+		{name: "none", want: []string{"10.10.10.10", "10.10.10.11"}},
+		{name: "include", include: []*net.IPNet{mustParseCIDR("10.10.10.11/32")}, want: []string{"10.10.10.11"}},
+		{name: "exclude", exclude: []*net.IPNet{mustParseCIDR("10.10.10.11/32")}, want: []string{"10.10.10.10"}},
+		{name: "both", include: []*net.IPNet{mustParseCIDR("10.0.0.0/8")}, exclude: []*net.IPNet{mustParseCIDR("10.10.10.10/32")}, want: []string{"10.10.10.11"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c := New(Config{
+				DnsClient:      &dns.Client{},
+				DnsmasqAddr:    fakeDnsmasq(t, fakeRecords),
+				LeasesPath:     "testdata/dnsmasq.leases",
+				ExposeLeases:   true,
+				LeaseIPInclude: tt.include,
+				LeaseIPExclude: tt.exclude,
+			})
+			metrics := fetchMetrics(t, c)
+			if got, want := metrics["dnsmasq_leases"], "2"; got != want {
+				t.Errorf("dnsmasq_leases: got %q, want %q", got, want)
+			}
+			var got []string
+			for key := range metrics {
+				if !strings.HasPrefix(key, "dnsmasq_lease_expiry{") {
+					continue
+				}
+				idx := strings.Index(key, `ip_addr="`)
+				ip := key[idx+len(`ip_addr="`):]
+				got = append(got, ip[:strings.Index(ip, `"`)])
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("exposed leases: got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLeasesByVendor(t *testing.T) {
+	c := New(Config{
+		DnsClient:   &dns.Client{},
+		DnsmasqAddr: fakeDnsmasq(t, fakeRecords),
+		LeasesPath:  "testdata/dnsmasq.leases",
+		VendorPrefixes: map[string]string{
+			"00:00:00":       "zero",
+			"00:00:00:00:00": "zeroer",
+			"aa:bb:cc":       "unused",
+		},
+	})
+	metrics := fetchMetrics(t, c)
+	want := map[string]string{
+		`dnsmasq_leases_by_vendor{vendor="zeroer"}`: "2",
+		`dnsmasq_leases_by_vendor{vendor="zero"}`:   "0",
+		`dnsmasq_leases_by_vendor{vendor="unused"}`: "0",
+		`dnsmasq_leases_by_vendor{vendor="other"}`:  "0",
+	}
+	for key, val := range want {
+		if got, want := metrics[key], val; got != want {
+			t.Errorf("metric %q: got %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestExtraStatsRecords(t *testing.T) {
+	records := copyFakeRecords()
+	records["leases.bind."] = []string{"42"}
+	records["hits.bind."] = []string{"7"}
+	c := New(Config{
+		DnsClient:   &dns.Client{},
+		DnsmasqAddr: fakeDnsmasq(t, records),
+		LeasesPath:  "testdata/dnsmasq.leases",
+		ExtraStatsRecords: []StatsRecord{
+			{Name: "leases.bind", Metric: "dnsmasq_leases_bind", Help: "leases"},
+			{Name: "hits.bind.", Metric: "dnsmasq_hits_renamed", Help: "hits"},
+		},
+	})
+	metrics := fetchMetrics(t, c)
+	want := map[string]string{
+		"dnsmasq_leases_bind":  "42",
+		"dnsmasq_hits_renamed": "7",
+		"dnsmasq_hits":         "",
+		"dnsmasq_cachesize":    "666",
+	}
+	for key, val := range want {
+		if got, want := metrics[key], val; got != want {
+			t.Errorf("metric %q: got %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestServersIPv6(t *testing.T) {
+	records := copyFakeRecords()
+	records["servers.bind."] = []string{
+		"127.0.0.1#53 10 2",
+		"2001:db8::1#53 20 3",
+		"[2001:db8::2]#5353 30 4",
+	}
+	c := New(Config{
+		DnsClient:   &dns.Client{},
+		DnsmasqAddr: fakeDnsmasq(t, records),
+		LeasesPath:  "testdata/dnsmasq.leases",
+	})
+	metrics := fetchMetrics(t, c)
+	want := map[string]string{
+		`dnsmasq_servers_queries{server="127.0.0.1#53"}`:              "10",
+		`dnsmasq_servers_queries_failed{server="127.0.0.1#53"}`:       "2",
+		`dnsmasq_servers_queries{server="2001:db8::1#53"}`:            "20",
+		`dnsmasq_servers_queries_failed{server="2001:db8::1#53"}`:     "3",
+		`dnsmasq_servers_queries{server="[2001:db8::2]#5353"}`:        "30",
+		`dnsmasq_servers_queries_failed{server="[2001:db8::2]#5353"}`: "4",
+		"dnsmasq_queries_forwarded_total":                             "60",
+	}
+	for key, val := range want {
+		if got, want := metrics[key], val; got != want {
+			t.Errorf("metric %q: got %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestLeaseExpiryUnit(t *testing.T) {
+	const key = `dnsmasq_lease_expiry{client_id="00:00:00:00:00:00",computer_name="host-1",iaid="",ip_addr="10.10.10.10",mac_addr="00:00:00:00:00:00"}`
+	for _, tt := range []struct {
+		unit string
+		want string
+	}{
+		{unit: "", want: "1.625595932e+09"},
+		{unit: LeaseExpirySeconds, want: "1.625595932e+09"},
+		{unit: LeaseExpiryMilliseconds, want: "1.625595932e+12"},
+	} {
+		t.Run(tt.unit, func(t *testing.T) {
+			c := New(Config{
+				DnsClient:       &dns.Client{},
+				DnsmasqAddr:     fakeDnsmasq(t, fakeRecords),
+				LeasesPath:      "testdata/dnsmasq.leases",
+				ExposeLeases:    true,
+				LeaseExpiryUnit: tt.unit,
+			})
+			if got, want := fetchMetrics(t, c)[key], tt.want; got != want {
+				t.Errorf("metric %q: got %q, want %q", key, got, want)
+			}
+		})
+	}
+}
+
+func TestScrapeErrorsExemplar(t *testing.T) {
+	records := copyFakeRecords()
+	records["cachesize.bind."] = []string{"not a number"}
+	c := New(Config{
+		DnsClient:   &dns.Client{},
+		DnsmasqAddr: fakeDnsmasq(t, records),
+		LeasesPath:  "testdata/dnsmasq.leases",
+	})
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c)
+	handler := promhttp.HandlerFor(reg, promhttp.HandlerOpts{
+		EnableOpenMetrics: true,
+	})
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Accept", "application/openmetrics-text; version=0.0.1")
+	handler.ServeHTTP(rec, req)
+	body, err := io.ReadAll(rec.Result().Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var line string
+	for _, l := range strings.Split(string(body), "\n") {
+		if strings.HasPrefix(l, "dnsmasq_scrape_errors_total ") {
+			line = l
+		}
+	}
+	if !strings.HasPrefix(line, `dnsmasq_scrape_errors_total 1.0 # {error_id="`) {
+		t.Errorf("dnsmasq_scrape_errors_total has no exemplar: %q", line)
+	}
+}
+
+func TestSelfTest(t *testing.T) {
+	records := copyFakeRecords()
+	c := New(Config{
+		DnsClient:   &dns.Client{},
+		DnsmasqAddr: fakeDnsmasq(t, records),
+		LeasesPath:  "testdata/dnsmasq.leases",
+	})
+
+	var buf strings.Builder
+	if err := c.SelfTest(&buf); err != nil {
+		t.Fatalf("SelfTest: %v\n%s", err, buf.String())
+	}
+	for _, want := range []string{
+		"OK   cachesize.bind.: 1 metrics",
+		"OK   servers.bind.: 3 metrics",
+		"OK   2 leases parsed\n",
+		"2 lines scanned\n",
+		"0 lines skipped\n",
+		"0 parse errors",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("SelfTest output does not contain %q:\n%s", want, buf.String())
+		}
+	}
+
+	delete(records, "hits.bind.")
+	buf.Reset()
+	if err := c.SelfTest(&buf); err == nil {
+		t.Fatalf("SelfTest unexpectedly succeeded:\n%s", buf.String())
+	}
+	if want := "FAIL hits.bind.: no answer"; !strings.Contains(buf.String(), want) {
+		t.Errorf("SelfTest output does not contain %q:\n%s", want, buf.String())
+	}
+}
+
+func TestSelfTestLeaseFileStats(t *testing.T) {
+	leasesPath := filepath.Join(t.TempDir(), "dnsmasq.leases")
+	leases := `0 00:00:00:00:00:00 10.10.10.10 host-1 *
+
+invalid
+duid 00:01:00:01:2a:2b:2c:2d:00:00:00:00:00:ff
+0 12345 2001:db8::10 host-2 00:01:00:01:11:11:11:11:00:00:00:00:00:02
+`
+	if err := os.WriteFile(leasesPath, []byte(leases), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := New(Config{LeasesPath: leasesPath})
+
+	var buf strings.Builder
+	if err := c.SelfTest(&buf); err != nil {
+		t.Fatalf("SelfTest: %v\n%s", err, buf.String())
+	}
+	for _, want := range []string{
+		"OK   2 leases parsed\n",
+		"5 lines scanned\n",
+		"2 lines skipped (blank: 1, duid: 1)\n",
+		"1 parse errors",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("SelfTest output does not contain %q:\n%s", want, buf.String())
+		}
+	}
+}
+
+func TestLeasesUnknownHostname(t *testing.T) {
+	leasesPath := filepath.Join(t.TempDir(), "dnsmasq.leases")
+	leases := `1625595932 00:00:00:00:00:00 10.10.10.10 host-1 00:00:00:00:00:00
+1625595932 00:00:00:00:00:01 10.10.10.11 * 00:00:00:00:00:01
+1625595932 00:00:00:00:00:02 10.10.10.12 * *
+`
+	if err := os.WriteFile(leasesPath, []byte(leases), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := New(Config{
+		DnsClient:   &dns.Client{},
+		DnsmasqAddr: fakeDnsmasq(t, fakeRecords),
+		LeasesPath:  leasesPath,
+	})
+	if got, want := fetchMetrics(t, c)["dnsmasq_leases_unknown_hostname"], "2"; got != want {
+		t.Errorf("dnsmasq_leases_unknown_hostname: got %q, want %q", got, want)
+	}
+}
+
+// replayExchanger answers queries with recorded responses (in wire format),
+// keyed by question name. Like a real DNS client, it rejects responses whose
+// ID does not match the query.
+type replayExchanger map[string][]byte
+
+func (r replayExchanger) Exchange(m *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+	in := new(dns.Msg)
+	if err := in.Unpack(r[m.Question[0].Name]); err != nil {
+		return nil, 0, err
+	}
+	if in.Id != m.Id {
+		return nil, 0, dns.ErrId
+	}
+	return in, 0, nil
+}
+
+func TestQueryID(t *testing.T) {
+	const id = 4242
+	replay := make(replayExchanger)
+	for name, txt := range fakeRecords {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeTXT)
+		m.Id = id
+		m.Response = true
+		m.Answer = []dns.RR{&dns.TXT{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS},
+			Txt: txt,
+		}}
+		b, err := m.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		replay[name] = b
+	}
+
+	c := New(Config{
+		DnsClient:   replay,
+		DnsmasqAddr: "replay",
+		LeasesPath:  "testdata/dnsmasq.leases",
+		QueryID:     func() uint16 { return id },
+	})
+	metrics := fetchMetrics(t, c)
+	want := map[string]string{
+		"dnsmasq_cachesize": "666",
+		"dnsmasq_hits":      "5",
+		`dnsmasq_servers_queries{server="127.0.0.1#53"}`: "10",
+	}
+	for key, val := range want {
+		if got, want := metrics[key], val; got != want {
+			t.Errorf("metric %q: got %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestMultipleInstances(t *testing.T) {
+	records := copyFakeRecords()
+	records["cachesize.bind."] = []string{"150"}
+	first := fakeDnsmasq(t, fakeRecords)
+	second := fakeDnsmasq(t, records)
+
+	reg := prometheus.NewRegistry()
+	for _, addr := range []string{first, second} {
+		c := New(Config{
+			DnsClient:   &dns.Client{},
+			DnsmasqAddr: addr,
+		})
+		prometheus.WrapRegistererWith(prometheus.Labels{"dnsmasq_addr": addr}, reg).MustRegister(c)
+	}
+	reg.MustRegister(New(Config{
+		LeasesPath: "testdata/dnsmasq.leases",
+	}))
+
+	handler := promhttp.HandlerFor(reg, promhttp.HandlerOpts{})
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if got, want := rec.Code, http.StatusOK; got != want {
+		t.Fatalf("unexpected HTTP status: got %v (%s), want %v", got, rec.Body.String(), want)
+	}
+	body := rec.Body.String()
+	for _, want := range []string{
+		`dnsmasq_cachesize{dnsmasq_addr="` + first + `"} 666`,
+		`dnsmasq_cachesize{dnsmasq_addr="` + second + `"} 150`,
+		"dnsmasq_leases 2",
+	} {
+		if !strings.Contains(body, want+"\n") {
+			t.Errorf("metrics do not contain %q:\n%s", want, body)
+		}
+	}
+}
+
+func TestStatsResponseBytes(t *testing.T) {
+	records := copyFakeRecords()
+	var servers []string
+	for i := 0; i < 20; i++ {
+		servers = append(servers, fmt.Sprintf("10.0.0.%d#53 100 0", i))
+	}
+	records["servers.bind."] = servers
+	c := New(Config{
+		DnsClient:   &dns.Client{},
+		DnsmasqAddr: fakeDnsmasq(t, records),
+	})
+	metrics := fetchMetrics(t, c)
+	small, err := strconv.Atoi(metrics[`dnsmasq_stats_response_bytes{record="cachesize.bind."}`])
+	if err != nil {
+		t.Fatal(err)
+	}
+	large, err := strconv.Atoi(metrics[`dnsmasq_stats_response_bytes{record="servers.bind."}`])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if small <= 0 || large <= small {
+		t.Errorf("unexpected response sizes: cachesize.bind. = %d, servers.bind. = %d", small, large)
+	}
+}
+
+func TestLeasesMatched(t *testing.T) {
+	leasesPath := filepath.Join(t.TempDir(), "dnsmasq.leases")
+	leases := `0 00:00:00:00:00:00 10.10.10.10 android-1234 *
+0 00:00:00:00:00:01 10.10.10.11 android-tv *
+0 00:00:00:00:00:02 10.10.10.12 iPhone *
+0 00:00:00:00:00:03 10.10.10.13 laptop *
+`
+	if err := os.WriteFile(leasesPath, []byte(leases), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := New(Config{
+		LeasesPath: leasesPath,
+		HostnamePatterns: []HostnamePattern{
+			{Pattern: "android-tv", Bucket: "tv"},
+			{Pattern: "android-*", Bucket: "mobile"},
+			{Pattern: "iPhone*", Bucket: "mobile"},
+			{Pattern: "printer-*", Bucket: "printer"},
+		},
+	})
+	metrics := fetchMetrics(t, c)
+	want := map[string]string{
+		`dnsmasq_leases_matched{bucket="mobile"}`:  "2",
+		`dnsmasq_leases_matched{bucket="tv"}`:      "1",
+		`dnsmasq_leases_matched{bucket="printer"}`: "0",
+	}
+	for key, val := range want {
+		if got, want := metrics[key], val; got != want {
+			t.Errorf("metric %q: got %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestLeasesFileMode(t *testing.T) {
+	leasesPath := filepath.Join(t.TempDir(), "dnsmasq.leases")
+	if err := os.WriteFile(leasesPath, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(leasesPath, 0640); err != nil {
+		t.Fatal(err)
+	}
+	c := New(Config{
+		LeasesPath: leasesPath,
+	})
+	if got, want := fetchMetrics(t, c)["dnsmasq_leases_file_mode"], "416"; got != want {
+		t.Errorf("dnsmasq_leases_file_mode: got %q, want %q", got, want)
+	}
+
+	c.cfg.LeasesPath = filepath.Join(t.TempDir(), "does.not.exist")
+	if got, want := fetchMetrics(t, c)["dnsmasq_leases_file_mode"], ""; got != want {
+		t.Errorf("dnsmasq_leases_file_mode: got %q, want %q", got, want)
+	}
+}
+
+func TestLeasesGlob(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	for _, f := range []struct {
+		name   string
+		mtime  time.Time
+		leases string
+	}{
+		{
+			name:  "dnsmasq.leases",
+			mtime: now,
+			leases: `0 00:00:00:00:00:00 10.10.10.10 new-host *
+0 00:00:00:00:00:01 10.10.10.11 host-2 *
+`,
+		},
+		{
+			name:  "dnsmasq.leases.1",
+			mtime: now.Add(-time.Hour),
+			leases: `0 00:00:00:00:00:09 10.10.10.10 old-host *
+0 00:00:00:00:00:03 10.10.10.13 host-3 *
+`,
+		},
+	} {
+		path := filepath.Join(dir, f.name)
+		if err := os.WriteFile(path, []byte(f.leases), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, f.mtime, f.mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := New(Config{
+		LeasesGlob:   filepath.Join(dir, "dnsmasq.leases*"),
+		ExposeLeases: true,
+	})
+	metrics := fetchMetrics(t, c)
+	want := map[string]string{
+		"dnsmasq_leases": "3",
+		`dnsmasq_lease_expiry{client_id="*",computer_name="new-host",iaid="",ip_addr="10.10.10.10",mac_addr="00:00:00:00:00:00"}`: "0",
+		`dnsmasq_lease_expiry{client_id="*",computer_name="old-host",iaid="",ip_addr="10.10.10.10",mac_addr="00:00:00:00:00:09"}`: "",
+		`dnsmasq_lease_expiry{client_id="*",computer_name="host-3",iaid="",ip_addr="10.10.10.13",mac_addr="00:00:00:00:00:03"}`:   "0",
+	}
+	for key, val := range want {
+		if got, want := metrics[key], val; got != want {
+			t.Errorf("metric %q: got %q, want %q", key, got, want)
+		}
+	}
+}
+
+type recordingTracer struct {
+	mu      sync.Mutex
+	spans   []string
+	parents map[string]string // span name to parent span name
+}
+
+type spanNameKey struct{}
+
+func (r *recordingTracer) Start(ctx context.Context, name string) (context.Context, func(error)) {
+	parent, _ := ctx.Value(spanNameKey{}).(string)
+	return context.WithValue(ctx, spanNameKey{}, name), func(err error) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.parents == nil {
+			r.parents = make(map[string]string)
+		}
+		r.parents[name] = parent
+		if err != nil {
+			name += " (error)"
+		}
+		r.spans = append(r.spans, name)
+	}
+}
+
+func TestTracer(t *testing.T) {
+	tracer := &recordingTracer{}
+	c := New(Config{
+		DnsClient:   &dns.Client{},
+		DnsmasqAddr: fakeDnsmasq(t, fakeRecords),
+		LeasesPath:  "testdata/dnsmasq.leases",
+		Tracer:      tracer,
+	})
+	fetchMetrics(t, c)
+	got := make(map[string]bool)
+	for _, span := range tracer.spans {
+		got[span] = true
+	}
+	for _, want := range []string{
+		"dnsmasq.collect",
+		"dnsmasq.read_leases",
+		"dnsmasq.query cachesize.bind.",
+		"dnsmasq.query servers.bind.",
+	} {
+		if !got[want] {
+			t.Errorf("span %q not recorded, got %v", want, tracer.spans)
+		}
+	}
+
+	// The stats queries and reading the leases are part of the scrape.
+	for span, want := range map[string]string{
+		"dnsmasq.collect":               "",
+		"dnsmasq.read_leases":           "dnsmasq.collect",
+		"dnsmasq.query cachesize.bind.": "dnsmasq.collect",
+		"dnsmasq.query servers.bind.":   "dnsmasq.collect",
+	} {
+		if got := tracer.parents[span]; got != want {
+			t.Errorf("span %q: got parent %q, want %q", span, got, want)
+		}
+	}
+}
+
+func TestPing(t *testing.T) {
+	c := New(Config{
+		DnsClient:   &dns.Client{},
+		DnsmasqAddr: fakeDnsmasq(t, fakeRecords),
+	})
+	if err := c.Ping(); err != nil {
+		t.Errorf("Ping: %v", err)
+	}
+
+	c = New(Config{
+		DnsClient:   &dns.Client{},
+		DnsmasqAddr: fakeDnsmasq(t, nil),
+	})
+	if err := c.Ping(); err == nil {
+		t.Errorf("Ping unexpectedly succeeded without an answer")
+	}
+
+	c = New(Config{
+		LeasesPath: "testdata/dnsmasq.leases",
+	})
+	if err := c.Ping(); err != nil {
+		t.Errorf("Ping of a leases-only collector: %v", err)
+	}
+}
+
+func TestStripDomain(t *testing.T) {
+	for _, tt := range []struct {
+		hostname, domain, want string
+	}{
+		{hostname: "host.lan", domain: "lan", want: "host"},
+		{hostname: "host.lan", domain: ".lan", want: "host"},
+		{hostname: "host.LAN", domain: "lan", want: "host"},
+		{hostname: "a.b.lan", domain: "lan", want: "a.b"},
+		{hostname: "host.example.lan", domain: "example.lan", want: "host"},
+		{hostname: "lan", domain: "lan", want: "lan"},
+		{hostname: ".lan", domain: "lan", want: ".lan"},
+		{hostname: "hostlan", domain: "lan", want: "hostlan"},
+		{hostname: "host.lan.example", domain: "lan", want: "host.lan.example"},
+		{hostname: "*", domain: "lan", want: "*"},
+	} {
+		if got := stripDomain(tt.hostname, tt.domain); got != tt.want {
+			t.Errorf("stripDomain(%q, %q): got %q, want %q", tt.hostname, tt.domain, got, tt.want)
+		}
+	}
+}
+
+func TestUniqueClients(t *testing.T) {
+	leasesPath := filepath.Join(t.TempDir(), "dnsmasq.leases")
+	leases := `0 00:00:00:00:00:00 10.10.10.10 host-1 01:00:00:00:00:00:00
+0 00:00:00:00:00:00 10.10.20.10 host-1 01:00:00:00:00:00:00
+0 00:00:00:00:00:01 10.10.10.11 host-2 *
+duid 00:01:00:01:2a:2b:2c:2d:00:00:00:00:00:ff
+0 12345 2001:db8::10 host-3 00:01:00:01:11:11:11:11:00:00:00:00:00:03
+0 23456 2001:db8::11 host-3 00:01:00:01:11:11:11:11:00:00:00:00:00:03
+0 12345 2001:db8::12 host-4 00:01:00:01:11:11:11:11:00:00:00:00:00:04
+`
+	if err := os.WriteFile(leasesPath, []byte(leases), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := New(Config{
+		LeasesPath: leasesPath,
+	})
+	if got, want := fetchMetrics(t, c)["dnsmasq_unique_clients"], "4"; got != want {
+		t.Errorf("dnsmasq_unique_clients: got %q, want %q", got, want)
+	}
+}
+
+// cookieExchanger answers with fakeRecords and echoes the client cookie
+// followed by serverCookie. It records the cookie of each query.
+type cookieExchanger struct {
+	serverCookie string
+	corrupt      bool // whether to corrupt the client cookie
+	queried      []string
+}
+
+func (e *cookieExchanger) Exchange(m *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+	r := new(dns.Msg)
+	r.SetReply(m)
+	name := m.Question[0].Name
+	r.Answer = []dns.RR{&dns.TXT{
+		Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS},
+		Txt: fakeRecords[name],
+	}}
+	var cookie string
+	if opt := m.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if c, ok := o.(*dns.EDNS0_COOKIE); ok {
+				cookie = c.Cookie
+			}
+		}
+	}
+	e.queried = append(e.queried, cookie)
+	clientCookie := cookie[:16]
+	if e.corrupt {
+		clientCookie = "0000000000000000"
+	}
+	r.SetEdns0(dns.DefaultMsgSize, false)
+	r.IsEdns0().Option = []dns.EDNS0{&dns.EDNS0_COOKIE{
+		Code:   dns.EDNS0COOKIE,
+		Cookie: clientCookie + e.serverCookie,
+	}}
+	return r, 0, nil
+}
+
+func TestDnsCookies(t *testing.T) {
+	const serverCookie = "0123456789abcdef0123456789abcdef"
+	exchanger := &cookieExchanger{serverCookie: serverCookie}
+	c := New(Config{
+		DnsClient:   exchanger,
+		DnsmasqAddr: "cookie",
+		DnsCookies:  true,
+	})
+
+	t.Run("Valid", func(t *testing.T) {
+		if got, want := fetchMetrics(t, c)["dnsmasq_cachesize"], "666"; got != want {
+			t.Errorf("dnsmasq_cachesize: got %q, want %q", got, want)
+		}
+		if got, want := len(exchanger.queried[0]), 16; got != want {
+			t.Errorf("first query: got a %d character cookie, want %d", got, want)
+		}
+		if got, want := exchanger.queried[1], c.clientCookie+serverCookie; got != want {
+			t.Errorf("second query: got cookie %q, want %q", got, want)
+		}
+	})
+
+	t.Run("Mismatch", func(t *testing.T) {
+		exchanger.corrupt = true
+		if got, ok := fetchMetrics(t, c)["dnsmasq_cachesize"]; ok {
+			t.Errorf("dnsmasq_cachesize: got %q, want no metric", got)
+		}
+	})
+}
+
+func TestLeasesSkipped(t *testing.T) {
+	leasesPath := filepath.Join(t.TempDir(), "dnsmasq.leases")
+	leases := `0 00:00:00:00:00:00 10.10.10.10 host-1 *
+0 00:00:00:00:00:01 192.168.0.10 host-2 *
+
+invalid
+duid 00:01:00:01:2a:2b:2c:2d:00:00:00:00:00:ff
+0 12345 2001:db8::10 host-3 00:01:00:01:11:11:11:11:00:00:00:00:00:03
+`
+	if err := os.WriteFile(leasesPath, []byte(leases), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, include, err := net.ParseCIDR("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cacheLeases := range []bool{false, true} {
+		c := New(Config{
+			LeasesPath:     leasesPath,
+			ExposeLeases:   true,
+			LeaseIPInclude: []*net.IPNet{include},
+			CacheLeases:    cacheLeases,
+		})
+		// The skipped leases are those of the last scrape, not a sum over
+		// all scrapes of the unchanged file.
+		for scrape := 1; scrape <= 2; scrape++ {
+			metrics := fetchMetrics(t, c)
+			want := map[string]string{
+				`dnsmasq_leases_skipped{reason="blank"}`:     "1",
+				`dnsmasq_leases_skipped{reason="duid"}`:      "1",
+				`dnsmasq_leases_skipped{reason="duplicate"}`: "0",
+				`dnsmasq_leases_skipped{reason="ip_filter"}`: "2",
+				"dnsmasq_leases_file_lines":                  "6",
+				"dnsmasq_leases":                             "3",
+			}
+			if scrape == 1 {
+				want["dnsmasq_lease_parse_errors_total"] = "1"
+			}
+			for key, val := range want {
+				if got := metrics[key]; got != val {
+					t.Errorf("CacheLeases=%v, scrape %d: %s: got %q, want %q", cacheLeases, scrape, key, got, val)
+				}
+			}
+		}
+	}
+}
+
+// flakyExchanger fails the first failures queries, then answers with
+// fakeRecords.
+type flakyExchanger struct {
+	failures int
+}
+
+func (e *flakyExchanger) Exchange(m *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+	if e.failures > 0 {
+		e.failures--
+		return nil, 0, fmt.Errorf("i/o timeout")
+	}
+	r := new(dns.Msg)
+	r.SetReply(m)
+	name := m.Question[0].Name
+	r.Answer = []dns.RR{&dns.TXT{
+		Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS},
+		Txt: fakeRecords[name],
+	}}
+	return r, 0, nil
+}
+
+func TestStatsRetries(t *testing.T) {
+	c := New(Config{
+		DnsClient:    &flakyExchanger{failures: 2},
+		DnsmasqAddr:  "flaky",
+		StatsRetries: 2,
+		RetryBackoff: time.Millisecond,
+	})
+	metrics := fetchMetrics(t, c)
+	if got, want := metrics["dnsmasq_cachesize"], "666"; got != want {
+		t.Errorf("dnsmasq_cachesize: got %q, want %q", got, want)
+	}
+	if got, want := metrics[`dnsmasq_stats_query_retries_total{record="cachesize.bind."}`], "2"; got != want {
+		t.Errorf("dnsmasq_stats_query_retries_total: got %q, want %q", got, want)
+	}
+	if got, ok := metrics[`dnsmasq_stats_query_retries_total{record="hits.bind."}`]; ok {
+		t.Errorf("dnsmasq_stats_query_retries_total for hits.bind.: got %q, want no metric", got)
+	}
+}
+
+func TestRetryBackoffJitter(t *testing.T) {
+	c := New(Config{
+		RetryBackoff: 100 * time.Millisecond,
+		RetryJitter:  0.2,
+	})
+	for attempt, want := range []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+	} {
+		lo := time.Duration(float64(want) * 0.8)
+		hi := time.Duration(float64(want) * 1.2)
+		distinct := make(map[time.Duration]bool)
+		for i := 0; i < 100; i++ {
+			got := c.backoff(attempt)
+			if got < lo || got > hi {
+				t.Errorf("backoff(%d) = %v, want within [%v, %v]", attempt, got, lo, hi)
+			}
+			distinct[got] = true
+		}
+		if len(distinct) < 2 {
+			t.Errorf("backoff(%d) is not jittered: always %v", attempt, want)
+		}
+	}
+
+	c = New(Config{RetryBackoff: 100 * time.Millisecond})
+	if got, want := c.backoff(1), 200*time.Millisecond; got != want {
+		t.Errorf("backoff(1) without jitter = %v, want %v", got, want)
+	}
+}
+
+func TestOpenLeases(t *testing.T) {
+	var opened string
+	c := New(Config{
+		LeasesPath: "/remote/dnsmasq.leases",
+		OpenLeases: func(path string) (io.ReadCloser, error) {
+			opened = path
+			return io.NopCloser(strings.NewReader("0 00:00:00:00:00:00 10.10.10.10 host-1 *\n")), nil
+		},
+	})
+	if got, want := fetchMetrics(t, c)["dnsmasq_leases"], "1"; got != want {
+		t.Errorf("dnsmasq_leases: got %q, want %q", got, want)
+	}
+	if got, want := opened, "/remote/dnsmasq.leases"; got != want {
+		t.Errorf("OpenLeases: got path %q, want %q", got, want)
+	}
+
+	c = New(Config{
+		LeasesPath: "/remote/dnsmasq.leases",
+		OpenLeases: func(path string) (io.ReadCloser, error) {
+			return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+		},
+	})
+	if got, want := fetchMetrics(t, c)["dnsmasq_leases"], "0"; got != want {
+		t.Errorf("dnsmasq_leases for a missing file: got %q, want %q", got, want)
+	}
+}
+
+func TestLeaseRemaining(t *testing.T) {
+	now := time.Unix(1625590000, 0)
+	leasesPath := filepath.Join(t.TempDir(), "dnsmasq.leases")
+	var leases strings.Builder
+	for i := 1; i <= 10; i++ {
+		fmt.Fprintf(&leases, "%d 00:00:00:00:00:%02d 10.10.10.%d host-%d *\n", now.Add(time.Duration(i)*time.Minute).Unix(), i, i, i)
+	}
+	// Infinite and expired leases are not observed.
+	fmt.Fprintf(&leases, "0 00:00:00:00:00:11 10.10.10.11 host-11 *\n")
+	fmt.Fprintf(&leases, "%d 00:00:00:00:00:12 10.10.10.12 host-12 *\n", now.Add(-time.Minute).Unix())
+	if err := os.WriteFile(leasesPath, []byte(leases.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := New(Config{
+		LeasesPath: leasesPath,
+	})
+	c.now = func() time.Time { return now }
+	metrics := fetchMetrics(t, c)
+	want := map[string]string{
+		`dnsmasq_lease_remaining_seconds{quantile="0.1"}`: "60",
+		`dnsmasq_lease_remaining_seconds{quantile="0.5"}`: "300",
+		`dnsmasq_lease_remaining_seconds{quantile="0.9"}`: "540",
+		"dnsmasq_lease_remaining_seconds_sum":             "3300",
+		"dnsmasq_lease_remaining_seconds_count":           "10",
+	}
+	for key, val := range want {
+		if got := metrics[key]; got != val {
+			t.Errorf("%s: got %q, want %q", key, got, val)
+		}
+	}
+}
+
+func TestLeaseAgeCreated(t *testing.T) {
+	c := New(Config{
+		LeasesPath:    "testdata/dnsmasq.leases",
+		ExposeLeases:  true,
+		DhcpLeaseTime: 12 * time.Hour,
+		OpenMetrics:   true,
+	})
+	c.now = func() time.Time { return time.Unix(1625590000, 0) }
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c)
+	handler := promhttp.HandlerFor(reg, promhttp.HandlerOpts{
+		EnableOpenMetrics:                   true,
+		EnableOpenMetricsTextCreatedSamples: true,
+	})
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Accept", "application/openmetrics-text; version=1.0.0")
+	handler.ServeHTTP(rec, req)
+	body := rec.Body.String()
+	// host-1 was issued at 1625595932 - 12h = 1625552732, the infinite lease
+	// of host-2 is omitted.
+	labels := `{client_id="00:00:00:00:00:00",computer_name="host-1",iaid="",ip_addr="10.10.10.10",mac_addr="00:00:00:00:00:00"}`
+	for _, want := range []string{
+		"# TYPE dnsmasq_lease_age_seconds counter",
+		"dnsmasq_lease_age_seconds_total" + labels + " 37268.0",
+		"dnsmasq_lease_age_seconds_created" + labels + " 1.625552732e+09",
+	} {
+		if !strings.Contains(body, want+"\n") {
+			t.Errorf("metrics do not contain %q:\n%s", want, body)
+		}
+	}
+	if got, want := strings.Count(body, "dnsmasq_lease_age_seconds_total{"), 1; got != want {
+		t.Errorf("got %d dnsmasq_lease_age_seconds_total series, want %d:\n%s", got, want, body)
+	}
+}
+
+func TestLeaseAgeOpenMetricsOnly(t *testing.T) {
+	for _, tt := range []struct {
+		openMetrics bool
+		want        bool
+	}{
+		{openMetrics: false, want: false},
+		{openMetrics: true, want: true},
+	} {
+		c := New(Config{
+			LeasesPath:    "testdata/dnsmasq.leases",
+			ExposeLeases:  true,
+			DhcpLeaseTime: 12 * time.Hour,
+			OpenMetrics:   tt.openMetrics,
+		})
+		c.now = func() time.Time { return time.Unix(1625590000, 0) }
+		var got bool
+		for key := range fetchMetrics(t, c) {
+			if strings.HasPrefix(key, "dnsmasq_lease_age_seconds_total{") {
+				got = true
+			}
+		}
+		if got != tt.want {
+			t.Errorf("OpenMetrics=%v: dnsmasq_lease_age_seconds_total exposed: got %v, want %v", tt.openMetrics, got, tt.want)
+		}
+	}
+}
+
+func TestLeaseAgeMaxLeaseSeries(t *testing.T) {
+	// The 2 leases take 4 series with dnsmasq_lease_age_seconds_total.
+	for _, tt := range []struct {
+		openMetrics bool
+		want        string
+	}{
+		{openMetrics: false, want: "0"},
+		{openMetrics: true, want: "1"},
+	} {
+		c := New(Config{
+			LeasesPath:     "testdata/dnsmasq.leases",
+			ExposeLeases:   true,
+			MaxLeaseSeries: 3,
+			DhcpLeaseTime:  12 * time.Hour,
+			OpenMetrics:    tt.openMetrics,
+		})
+		c.now = func() time.Time { return time.Unix(1625590000, 0) }
+		metrics := fetchMetrics(t, c)
+		if got := metrics["dnsmasq_lease_series_truncated"]; got != tt.want {
+			t.Errorf("OpenMetrics=%v: dnsmasq_lease_series_truncated: got %q, want %q", tt.openMetrics, got, tt.want)
+		}
+		for key := range metrics {
+			if tt.want == "1" && (strings.HasPrefix(key, "dnsmasq_lease_age_seconds_total{") || strings.HasPrefix(key, "dnsmasq_lease_expiry{")) {
+				t.Errorf("OpenMetrics=%v: unexpected per-lease series %s", tt.openMetrics, key)
+			}
+		}
+	}
+}
+
+func TestTransportInfo(t *testing.T) {
+	for _, tt := range []struct {
+		protocol string
+		want     string
+	}{
+		{protocol: "", want: "udp"},
+		{protocol: "tcp", want: "tcp"},
+	} {
+		c := New(Config{
+			DnsClient:   &flakyExchanger{},
+			DnsmasqAddr: "fake",
+			Protocol:    tt.protocol,
+		})
+		key := fmt.Sprintf(`dnsmasq_exporter_transport_info{protocol=%q}`, tt.want)
+		if got, want := fetchMetrics(t, c)[key], "1"; got != want {
+			t.Errorf("Protocol %q: %s: got %q, want %q", tt.protocol, key, got, want)
+		}
+	}
+}
+
+func TestHTTPStats(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `# dnsmasq stats
+cachesize=666
+insertions: 1
+evictions 0
+misses.bind 1
+hits=5
+unknown=42
+`)
+	}))
+	defer srv.Close()
+
+	c := New(Config{
+		DnsmasqAddr: srv.URL,
+		StatsSource: StatsSourceHTTP,
+	})
+	metrics := fetchMetrics(t, c)
+	want := map[string]string{
+		"dnsmasq_cachesize":       "666",
+		"dnsmasq_insertions":      "1",
+		"dnsmasq_evictions":       "0",
+		"dnsmasq_misses":          "1",
+		"dnsmasq_hits":            "5",
+		"dnsmasq_cache_hit_ratio": "0.8333333333333334",
+	}
+	for key, val := range want {
+		if got := metrics[key]; got != val {
+			t.Errorf("%s: got %q, want %q", key, got, val)
+		}
+	}
+	if got, ok := metrics["dnsmasq_auth"]; ok {
+		t.Errorf("dnsmasq_auth: got %q, want no metric", got)
+	}
+	if err := c.Ping(); err != nil {
+		t.Errorf("Ping: %v", err)
+	}
+}
+
+func TestLeasesLifecycle(t *testing.T) {
+	now := time.Unix(1625590000, 0)
+	leasesPath := filepath.Join(t.TempDir(), "dnsmasq.leases")
+	leases := fmt.Sprintf(`%d 00:00:00:00:00:00 10.10.10.10 host-1 *
+%d 00:00:00:00:00:01 10.10.10.11 host-2 *
+%d 00:00:00:00:00:02 10.10.10.12 host-3 *
+%d 00:00:00:00:00:03 10.10.10.13 host-4 *
+0 00:00:00:00:00:04 10.10.10.14 host-5 *
+`,
+		now.Add(11*time.Hour).Unix(),
+		now.Add(7*time.Hour).Unix(),
+		now.Add(time.Hour).Unix(),
+		now.Add(-time.Minute).Unix())
+	if err := os.WriteFile(leasesPath, []byte(leases), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := New(Config{
+		LeasesPath:    leasesPath,
+		DhcpLeaseTime: 12 * time.Hour,
+	})
+	c.now = func() time.Time { return now }
+	metrics := fetchMetrics(t, c)
+	want := map[string]string{
+		`dnsmasq_leases_lifecycle{phase="early"}`: "2",
+		`dnsmasq_leases_lifecycle{phase="late"}`:  "1",
+	}
+	for key, val := range want {
+		if got := metrics[key]; got != val {
+			t.Errorf("%s: got %q, want %q", key, got, val)
+		}
+	}
+}
+
+func TestPrefixDelegationLeases(t *testing.T) {
+	c := New(Config{
+		LeasesPath:   "testdata/dnsmasq-v6pd.leases",
+		ExposeLeases: true,
+	})
+	metrics := fetchMetrics(t, c)
+	want := map[string]string{
+		"dnsmasq_leases":    "2",
+		"dnsmasq_pd_leases": "2",
+	}
+	for key, val := range want {
+		if got := metrics[key]; got != val {
+			t.Errorf("%s: got %q, want %q", key, got, val)
+		}
+	}
+	for key := range metrics {
+		if strings.HasPrefix(key, "dnsmasq_lease_expiry{") && strings.Contains(key, "/") {
+			t.Errorf("prefix delegation lease exposed as %s", key)
+		}
+	}
+
+	leases, err := readLeaseFile("testdata/dnsmasq-v6pd.leases", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var prefixLengths []int
+	for _, l := range leases {
+		prefixLengths = append(prefixLengths, l.prefixLength)
+	}
+	if want := []int{0, 0, 56, 60}; !reflect.DeepEqual(prefixLengths, want) {
+		t.Errorf("prefix lengths: got %v, want %v", prefixLengths, want)
+	}
+}
+
+func TestCacheDuration(t *testing.T) {
+	now := time.Unix(1625590000, 0)
+	exchanger := &countingExchanger{}
+	c := New(Config{
+		DnsClient:     exchanger,
+		DnsmasqAddr:   "fake",
+		CacheDuration: 10 * time.Second,
+	})
+	c.now = func() time.Time { return now }
+
+	for _, tt := range []struct {
+		elapsed time.Duration
+		age     string
+		queries int
+	}{
+		{elapsed: 0, age: "0", queries: 7},
+		{elapsed: 4 * time.Second, age: "4", queries: 7},
+		{elapsed: 6 * time.Second, age: "0", queries: 14},
+	} {
+		now = now.Add(tt.elapsed)
+		metrics := fetchMetrics(t, c)
+		if got, want := metrics["dnsmasq_metrics_cache_age_seconds"], tt.age; got != want {
+			t.Errorf("dnsmasq_metrics_cache_age_seconds: got %q, want %q", got, want)
+		}
+		if got, want := metrics["dnsmasq_cachesize"], "666"; got != want {
+			t.Errorf("dnsmasq_cachesize: got %q, want %q", got, want)
+		}
+		if got, want := exchanger.queries, tt.queries; got != want {
+			t.Errorf("queries: got %d, want %d", got, want)
+		}
+	}
+}
+
+// countingExchanger answers with fakeRecords and counts the queries.
+type countingExchanger struct {
+	flakyExchanger
+	queries int
+}
+
+func (e *countingExchanger) Exchange(m *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+	e.queries++
+	return e.flakyExchanger.Exchange(m, address)
+}
+
+func TestDhcpPoolUtilization(t *testing.T) {
+	c := New(Config{
+		LeasesPath:   "testdata/dnsmasq.leases",
+		DhcpPoolSize: 8,
+	})
+	if got, want := fetchMetrics(t, c)["dnsmasq_dhcp_pool_utilization"], "0.25"; got != want {
+		t.Errorf("dnsmasq_dhcp_pool_utilization: got %q, want %q", got, want)
+	}
+}
+
+func TestLeaseIAID(t *testing.T) {
+	c := New(Config{
+		LeasesPath:   "testdata/dnsmasq-v6.leases",
+		ExposeLeases: true,
+	})
+	metrics := fetchMetrics(t, c)
+	want := map[string]string{
+		`dnsmasq_lease_expiry{client_id="01:00:00:00:00:00:00",computer_name="host-1",iaid="",ip_addr="10.10.10.10",mac_addr="00:00:00:00:00:00"}`:           "1.625595932e+09",
+		`dnsmasq_lease_expiry{client_id="00:01:00:01:11:11:11:11:00:00:00:00:00:02",computer_name="host-2",iaid="12345",ip_addr="2001:db8::10",mac_addr=""}`: "1.625595932e+09",
+	}
+	for key, val := range want {
+		if got := metrics[key]; got != val {
+			t.Errorf("metric %q: got %q, want %q", key, got, val)
+		}
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Unix(1625590000, 0)
+	exchanger := &countingExchanger{flakyExchanger: flakyExchanger{failures: 3}}
+	c := New(Config{
+		DnsClient:        exchanger,
+		DnsmasqAddr:      "fake",
+		BreakerThreshold: 2,
+		BreakerCooldown:  time.Minute,
+	})
+	c.now = func() time.Time { return now }
+
+	for _, tt := range []struct {
+		elapsed time.Duration
+		up      string
+		queries int
+	}{
+		{elapsed: 0, up: "0", queries: 1},                 // failure 1
+		{elapsed: 10 * time.Second, up: "0", queries: 2},  // failure 2 opens the breaker
+		{elapsed: 10 * time.Second, up: "0", queries: 2},  // open
+		{elapsed: 50 * time.Second, up: "0", queries: 3},  // failure 3 reopens the breaker
+		{elapsed: 30 * time.Second, up: "0", queries: 3},  // open
+		{elapsed: 30 * time.Second, up: "1", queries: 10}, // success
+	} {
+		now = now.Add(tt.elapsed)
+		metrics := fetchMetrics(t, c)
+		if got, want := metrics["dnsmasq_up"], tt.up; got != want {
+			t.Errorf("dnsmasq_up: got %q, want %q", got, want)
+		}
+		if got, want := exchanger.queries, tt.queries; got != want {
+			t.Errorf("queries: got %d, want %d", got, want)
+		}
+	}
+}
+
+func TestLeasesIssuedToday(t *testing.T) {
+	loc := time.FixedZone("UTC+2", 2*60*60)
+	now := time.Date(2021, 7, 6, 10, 0, 0, 0, loc)
+	leasesPath := filepath.Join(t.TempDir(), "dnsmasq.leases")
+	// With a lease time of 12h, the leases were issued at 09:00, 01:00 and
+	// 23:00 the day before.
+	leases := fmt.Sprintf(`%d 00:00:00:00:00:00 10.10.10.10 host-1 *
+%d 00:00:00:00:00:01 10.10.10.11 host-2 *
+%d 00:00:00:00:00:02 10.10.10.12 host-3 *
+0 00:00:00:00:00:03 10.10.10.13 host-4 *
+`,
+		now.Add(11*time.Hour).Unix(),
+		now.Add(3*time.Hour).Unix(),
+		now.Add(time.Hour).Unix())
+	if err := os.WriteFile(leasesPath, []byte(leases), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := New(Config{
+		LeasesPath:    leasesPath,
+		DhcpLeaseTime: 12 * time.Hour,
+		Location:      loc,
+	})
+	c.now = func() time.Time { return now.UTC() }
+	if got, want := fetchMetrics(t, c)["dnsmasq_leases_issued_today"], "2"; got != want {
+		t.Errorf("dnsmasq_leases_issued_today: got %q, want %q", got, want)
+	}
+}
+
+func TestServerFilter(t *testing.T) {
+	records := copyFakeRecords()
+	records["servers.bind."] = []string{
+		"127.0.0.1#53 10 2",
+		"192.168.1.1#53 20 3",
+		"10.64.0.7#53 30 4",
+	}
+	c := New(Config{
+		DnsClient:    &dns.Client{},
+		DnsmasqAddr:  fakeDnsmasq(t, records),
+		ServerFilter: regexp.MustCompile(`^(127\.|192\.168\.)`),
+	})
+	metrics := fetchMetrics(t, c)
+	want := map[string]string{
+		`dnsmasq_servers_queries{server="127.0.0.1#53"}`:          "10",
+		`dnsmasq_servers_queries_failed{server="127.0.0.1#53"}`:   "2",
+		`dnsmasq_servers_queries{server="192.168.1.1#53"}`:        "20",
+		`dnsmasq_servers_queries_failed{server="192.168.1.1#53"}`: "3",
+		"dnsmasq_queries_forwarded_total":                         "60",
+	}
+	for key, val := range want {
+		if got := metrics[key]; got != val {
+			t.Errorf("metric %q: got %q, want %q", key, got, val)
+		}
+	}
+	for _, key := range []string{
+		`dnsmasq_servers_queries{server="10.64.0.7#53"}`,
+		`dnsmasq_servers_queries_failed{server="10.64.0.7#53"}`,
+	} {
+		if got, ok := metrics[key]; ok {
+			t.Errorf("metric %q: got %q, want no metric", key, got)
+		}
+	}
+}
+
+func TestParseLeases(t *testing.T) {
+	f, err := os.Open("testdata/dnsmasq-v6.leases")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	got, err := ParseLeases(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Lease{
+		{
+			Expiry:       1625595932,
+			MacAddress:   "00:00:00:00:00:00",
+			IpAddress:    "10.10.10.10",
+			ComputerName: "host-1",
+			ClientId:     "01:00:00:00:00:00:00",
+		},
+		{
+			Expiry:       1625595932,
+			IpAddress:    "2001:db8::10",
+			ComputerName: "host-2",
+			ClientId:     "00:01:00:01:11:11:11:11:00:00:00:00:00:02",
+			Iaid:         "12345",
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseLeases: got %+v, want %+v", got, want)
+	}
+}
+
+func TestLeaseOUIFilter(t *testing.T) {
+	leasesPath := filepath.Join(t.TempDir(), "dnsmasq.leases")
+	leases := `0 00:1a:11:00:00:01 10.10.10.10 host-1 *
+0 00:1A:11:00:00:02 10.10.10.11 host-2 *
+0 f4:f5:d8:00:00:03 10.10.10.12 host-3 *
+0 aa:bb:cc:00:00:04 10.10.10.13 host-4 *
+`
+	if err := os.WriteFile(leasesPath, []byte(leases), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := New(Config{
+		LeasesPath:     leasesPath,
+		ExposeLeases:   true,
+		LeaseOUIFilter: []string{"00:1a:11", "F4-F5-D8"},
+	})
+	metrics := fetchMetrics(t, c)
+	var exposed []string
+	for key := range metrics {
+		if strings.HasPrefix(key, "dnsmasq_lease_expiry{") {
+			exposed = append(exposed, key)
+		}
+	}
+	sort.Strings(exposed)
+	want := []string{
+		`dnsmasq_lease_expiry{client_id="*",computer_name="host-1",iaid="",ip_addr="10.10.10.10",mac_addr="00:1a:11:00:00:01"}`,
+		`dnsmasq_lease_expiry{client_id="*",computer_name="host-2",iaid="",ip_addr="10.10.10.11",mac_addr="00:1A:11:00:00:02"}`,
+		`dnsmasq_lease_expiry{client_id="*",computer_name="host-3",iaid="",ip_addr="10.10.10.12",mac_addr="f4:f5:d8:00:00:03"}`,
+	}
+	if !reflect.DeepEqual(exposed, want) {
+		t.Errorf("exposed leases: got %v, want %v", exposed, want)
+	}
+	if got, want := metrics["dnsmasq_leases"], "4"; got != want {
+		t.Errorf("dnsmasq_leases: got %q, want %q", got, want)
+	}
+	if got, want := metrics[`dnsmasq_leases_skipped{reason="oui_filter"}`], "1"; got != want {
+		t.Errorf("dnsmasq_leases_skipped{reason=\"oui_filter\"}: got %q, want %q", got, want)
+	}
+}
+
+func TestReadLeaseFileCRLF(t *testing.T) {
+	var stats leaseFileStats
+	got, err := readLeaseFile("testdata/dnsmasq-crlf.leases", 0, &stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []lease{
+		{expiry: 1625595932, macAddress: "00:00:00:00:00:00", ipAddress: "10.10.10.10", computerName: "host-1", clientId: "00:00:00:00:00:00"},
+		{expiry: 0, macAddress: "00:00:00:00:00:01", ipAddress: "10.10.10.11", computerName: "host-2", clientId: "00:00:00:00:00:01"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("readLeaseFile: got %+v, want %+v", got, want)
+	}
+	if stats.errors != 0 {
+		t.Errorf("readLeaseFile: got %d parse errors, want 0", stats.errors)
+	}
+	if got, want := stats.skipped[skipDUID], 1; got != want {
+		t.Errorf("readLeaseFile: got %d skipped duid lines, want %d", got, want)
+	}
+}
+
+func TestLeaseSampleRatio(t *testing.T) {
+	const n = 10000
+	leasesPath := filepath.Join(t.TempDir(), "dnsmasq.leases")
+	var leases strings.Builder
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&leases, "0 02:00:00:00:%02x:%02x 10.0.%d.%d host-%d *\n", i/256, i%256, i/256, i%256, i)
+	}
+	if err := os.WriteFile(leasesPath, []byte(leases.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := New(Config{
+		LeasesPath:       leasesPath,
+		ExposeLeases:     true,
+		LeaseSampleRatio: 0.25,
+	})
+	exposed := func() map[string]bool {
+		keys := make(map[string]bool)
+		for key := range fetchMetrics(t, c) {
+			if strings.HasPrefix(key, "dnsmasq_lease_expiry{") {
+				keys[key] = true
+			}
+		}
+		return keys
+	}
+	first := exposed()
+	if got := float64(len(first)) / n; got < 0.22 || got > 0.28 {
+		t.Errorf("sampled %d of %d leases (%.3f), want about 0.25", len(first), n, got)
+	}
+	if second := exposed(); !reflect.DeepEqual(first, second) {
+		t.Errorf("sampled leases differ between scrapes")
+	}
+	if got, want := fetchMetrics(t, c)["dnsmasq_leases"], strconv.Itoa(n); got != want {
+		t.Errorf("dnsmasq_leases: got %q, want %q", got, want)
+	}
+}
+
+func TestLeasesReadDuration(t *testing.T) {
+	c := New(Config{
+		LeasesPath: "testdata/dnsmasq.leases",
+	})
+	got, ok := fetchMetrics(t, c)["dnsmasq_leases_read_duration_seconds"]
+	if !ok {
+		t.Fatalf("dnsmasq_leases_read_duration_seconds: not found")
+	}
+	if f, err := strconv.ParseFloat(got, 64); err != nil || f < 0 {
+		t.Errorf("dnsmasq_leases_read_duration_seconds: got %q, want a non-negative number", got)
+	}
+}
+
+func TestSerialCollect(t *testing.T) {
+	for _, serial := range []bool{false, true} {
+		t.Run(fmt.Sprintf("serial=%v", serial), func(t *testing.T) {
+			c := New(Config{
+				DnsClient:     &flakyExchanger{},
+				DnsmasqAddr:   "fake",
+				LeasesPath:    "testdata/dnsmasq.leases",
+				SerialCollect: serial,
+			})
+			metrics := fetchMetrics(t, c)
+			want := map[string]string{
+				"dnsmasq_cachesize": "666",
+				"dnsmasq_leases":    "2",
+				"dnsmasq_up":        "1",
+			}
+			for key, val := range want {
+				if got := metrics[key]; got != val {
+					t.Errorf("%s: got %q, want %q", key, got, val)
+				}
+			}
+		})
+	}
+
+	t.Run("FirstError", func(t *testing.T) {
+		var g serialGroup
+		var ran []int
+		g.Go(func() error { ran = append(ran, 1); return fmt.Errorf("first") })
+		g.Go(func() error { ran = append(ran, 2); return fmt.Errorf("second") })
+		if err := g.Wait(); err == nil || err.Error() != "first" {
+			t.Errorf("Wait: got %v, want first", err)
+		}
+		if want := []int{1, 2}; !reflect.DeepEqual(ran, want) {
+			t.Errorf("ran: got %v, want %v", ran, want)
+		}
+	})
+}
+
+func TestStatsQueryOutcomes(t *testing.T) {
+	records := copyFakeRecords()
+	records["servers.bind."] = []string{"127.0.0.1#53 not-a-number 2"}
+	c := New(Config{
+		DnsClient:   &dns.Client{},
+		DnsmasqAddr: fakeDnsmasq(t, records),
+		FailedStats: FailedStatsNaN,
+	})
+	fetchMetrics(t, c)
+	metrics := fetchMetrics(t, c)
+	want := map[string]string{
+		`dnsmasq_stats_query_success_total{record="cachesize.bind."}`: "2",
+		`dnsmasq_stats_query_failure_total{record="cachesize.bind."}`: "0",
+		`dnsmasq_stats_query_success_total{record="servers.bind."}`:   "0",
+		`dnsmasq_stats_query_failure_total{record="servers.bind."}`:   "2",
+	}
+	for key, val := range want {
+		if got := metrics[key]; got != val {
+			t.Errorf("%s: got %q, want %q", key, got, val)
+		}
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	for _, tt := range []struct {
+		desc    string
+		cfg     Config
+		wantErr bool
+	}{
+		{
+			desc: "stats and leases",
+			cfg:  Config{DnsClient: &dns.Client{}, DnsmasqAddr: "localhost:53", LeasesPath: "testdata/dnsmasq.leases"},
+		},
+		{
+			desc: "leases only",
+			cfg:  Config{LeasesPath: "testdata/dnsmasq.leases"},
+		},
+		{
+			desc: "HTTP stats without DnsClient",
+			cfg:  Config{DnsmasqAddr: "http://localhost/stats", StatsSource: StatsSourceHTTP},
+		},
+		{
+			desc:    "nothing to collect",
+			cfg:     Config{DnsClient: &dns.Client{}},
+			wantErr: true,
+		},
+		{
+			desc:    "nil DnsClient",
+			cfg:     Config{DnsmasqAddr: "localhost:53"},
+			wantErr: true,
+		},
+		{
+			desc:    "invalid FailedStats",
+			cfg:     Config{LeasesPath: "testdata/dnsmasq.leases", FailedStats: "zero"},
+			wantErr: true,
+		},
+		{
+			desc:    "OpenLeases with LeasesGlob",
+			cfg:     Config{LeasesGlob: "*.leases", OpenLeases: func(string) (io.ReadCloser, error) { return nil, nil }},
+			wantErr: true,
+		},
+	} {
+		err := tt.cfg.Validate()
+		if gotErr := err != nil; gotErr != tt.wantErr {
+			t.Errorf("%s: Validate() = %v, want error: %v", tt.desc, err, tt.wantErr)
+		}
+		c, err := NewValidated(tt.cfg)
+		if gotErr := err != nil; gotErr != tt.wantErr {
+			t.Errorf("%s: NewValidated() = %v, want error: %v", tt.desc, err, tt.wantErr)
+		}
+		if gotNil := c == nil; gotNil != tt.wantErr {
+			t.Errorf("%s: NewValidated() returned Collector %v, want nil: %v", tt.desc, c, tt.wantErr)
+		}
+	}
+}
+
+func TestInfiniteLeaseExpiry(t *testing.T) {
+	const key = `dnsmasq_lease_expiry{client_id="00:00:00:00:00:01",computer_name="host-2",iaid="",ip_addr="10.10.10.11",mac_addr="00:00:00:00:00:01"}`
+	for _, tt := range []struct {
+		infinite int64
+		unit     string
+		want     string
+	}{
+		{infinite: 0, want: "0"},
+		{infinite: 253402300799, want: "2.53402300799e+11"},
+		{infinite: 253402300799, unit: LeaseExpiryMilliseconds, want: "2.53402300799e+14"},
+	} {
+		c := New(Config{
+			LeasesPath:          "testdata/dnsmasq.leases",
+			ExposeLeases:        true,
+			LeaseExpiryUnit:     tt.unit,
+			InfiniteLeaseExpiry: tt.infinite,
+		})
+		if got := fetchMetrics(t, c)[key]; got != tt.want {
+			t.Errorf("InfiniteLeaseExpiry=%d, unit %q: got %q, want %q", tt.infinite, tt.unit, got, tt.want)
+		}
+	}
+}
+
+func TestStatsEmptyResponses(t *testing.T) {
+	records := copyFakeRecords()
+	delete(records, "auth.bind.")
+	c := New(Config{
+		DnsClient:   &dns.Client{},
+		DnsmasqAddr: fakeDnsmasq(t, records),
+	})
+	metrics := fetchMetrics(t, c)
+	want := map[string]string{
+		`dnsmasq_stats_empty_responses_total{record="auth.bind."}`:      "1",
+		`dnsmasq_stats_empty_responses_total{record="cachesize.bind."}`: "0",
+	}
+	for key, val := range want {
+		if got := metrics[key]; got != val {
+			t.Errorf("%s: got %q, want %q", key, got, val)
+		}
+	}
+}
+
+func TestLeasesRangeHighWater(t *testing.T) {
+	dir := t.TempDir()
+	leasesPath := filepath.Join(dir, "dnsmasq.leases")
+	if err := os.WriteFile(leasesPath, []byte("0 00:00:00:00:00:00 10.10.10.10 host-1 *\n0 00:00:00:00:00:01 10.10.10.11 host-2 *\n0 00:00:00:00:00:02 10.10.20.10 host-3 *\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := New(Config{
+		LeasesPath: leasesPath,
+		DhcpRanges: []DhcpRange{
+			{Start: net.ParseIP("10.10.10.1"), End: net.ParseIP("10.10.10.254")},
+			{Start: net.ParseIP("10.10.20.1"), End: net.ParseIP("10.10.20.254")},
+		},
+	})
+	const (
+		current1   = `dnsmasq_leases_range{range="10.10.10.1-10.10.10.254"}`
+		highWater1 = `dnsmasq_leases_range_high_water{range="10.10.10.1-10.10.10.254"}`
+		highWater2 = `dnsmasq_leases_range_high_water{range="10.10.20.1-10.10.20.254"}`
+	)
+	metrics := fetchMetrics(t, c)
+	for key, want := range map[string]string{current1: "2", highWater1: "2", highWater2: "1"} {
+		if got := metrics[key]; got != want {
+			t.Errorf("%s: got %q, want %q", key, got, want)
+		}
+	}
+
+	if err := os.WriteFile(leasesPath, []byte("0 00:00:00:00:00:00 10.10.10.10 host-1 *\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	metrics = fetchMetrics(t, c)
+	for key, want := range map[string]string{current1: "1", highWater1: "2", highWater2: "1"} {
+		if got := metrics[key]; got != want {
+			t.Errorf("%s: got %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestLeaseDUIDConflicts(t *testing.T) {
+	for _, tt := range []struct {
+		leasesPath string
+		want       string
+	}{
+		{"testdata/dnsmasq-v6.leases", "0"},
+		{"testdata/dnsmasq-v6-duid.leases", "1"},
+	} {
+		c := New(Config{
+			LeasesPath: tt.leasesPath,
+		})
+		if got := fetchMetrics(t, c)["dnsmasq_lease_duid_conflicts"]; got != tt.want {
+			t.Errorf("%s: dnsmasq_lease_duid_conflicts: got %q, want %q", tt.leasesPath, got, tt.want)
+		}
+	}
+}
+
+func TestProtocolFallback(t *testing.T) {
+	for _, auto := range []bool{false, true} {
+		c := New(Config{
+			DnsClient:        &flakyExchanger{failures: 1000},
+			DnsmasqAddr:      "fake",
+			Protocol:         "udp",
+			FallbackClient:   &flakyExchanger{},
+			FallbackProtocol: "tcp",
+			ProtocolAuto:     auto,
+		})
+		metrics := fetchMetrics(t, c)
+		if got, want := metrics["dnsmasq_protocol_fallback_suggested"], "1"; got != want {
+			t.Errorf("auto=%v: dnsmasq_protocol_fallback_suggested: got %q, want %q", auto, got, want)
+		}
+		if got, want := metrics["dnsmasq_up"], "0"; got != want {
+			t.Errorf("auto=%v: first scrape: dnsmasq_up: got %q, want %q", auto, got, want)
+		}
+
+		up, protocol := "0", "udp"
+		if auto {
+			up, protocol = "1", "tcp"
+		}
+		metrics = fetchMetrics(t, c)
+		if got := metrics["dnsmasq_up"]; got != up {
+			t.Errorf("auto=%v: second scrape: dnsmasq_up: got %q, want %q", auto, got, up)
+		}
+		key := `dnsmasq_exporter_transport_info{protocol="` + protocol + `"}`
+		if got, want := metrics[key], "1"; got != want {
+			t.Errorf("auto=%v: %s: got %q, want %q", auto, key, got, want)
+		}
+	}
+
+	// The alternate protocol is not probed if the first scrape succeeds.
+	fallback := &countingExchanger{}
+	c := New(Config{
+		DnsClient:        &flakyExchanger{},
+		DnsmasqAddr:      "fake",
+		FallbackClient:   fallback,
+		FallbackProtocol: "tcp",
+	})
+	if got, want := fetchMetrics(t, c)["dnsmasq_protocol_fallback_suggested"], "0"; got != want {
+		t.Errorf("dnsmasq_protocol_fallback_suggested: got %q, want %q", got, want)
+	}
+	if fallback.queries != 0 {
+		t.Errorf("fallback client got %d queries, want 0", fallback.queries)
+	}
+}
+
+// fakeDualDnsmasq is like fakeDnsmasq with fakeRecords, but also listens on
+// TCP on the same port. Over UDP, it answers with truncated responses if
+// truncate is set, and does not answer otherwise.
+func fakeDualDnsmasq(t *testing.T, truncate bool) string {
+	t.Helper()
+	// The TCP port of the UDP port may be in use, so try a few UDP ports.
+	var pc net.PacketConn
+	var ln net.Listener
+	for i := 0; ln == nil; i++ {
+		var err error
+		pc, err = net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ln, err = net.Listen("tcp", pc.LocalAddr().String())
+		if err != nil {
+			pc.Close()
+			if i == 9 {
+				t.Fatal(err)
+			}
+		}
+	}
+	t.Cleanup(func() { pc.Close() })
+	tcpSrv := &dns.Server{
+		Listener: ln,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetReply(r)
+			name := r.Question[0].Name
+			m.Answer = []dns.RR{&dns.TXT{
+				Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS},
+				Txt: fakeRecords[name],
+			}}
+			w.WriteMsg(m)
+		}),
+	}
+	started := make(chan struct{})
+	tcpSrv.NotifyStartedFunc = func() { close(started) }
+	go tcpSrv.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { tcpSrv.Shutdown() })
+
+	if !truncate {
+		// Leave the UDP queries unanswered.
+		return pc.LocalAddr().String()
+	}
+	udpSrv := &dns.Server{
+		PacketConn: pc,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetReply(r)
+			m.Truncated = true
+			w.WriteMsg(m)
+		}),
+	}
+	started = make(chan struct{})
+	udpSrv.NotifyStartedFunc = func() { close(started) }
+	go udpSrv.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { udpSrv.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+func TestProtocolAutoTCPFallback(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		truncate bool
+	}{
+		{"truncated", true},
+		{"timeout", false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c := New(Config{
+				DnsClient:      &dns.Client{Net: "udp", Timeout: 100 * time.Millisecond},
+				DnsmasqAddr:    fakeDualDnsmasq(t, tt.truncate),
+				Protocol:       "auto",
+				FallbackClient: &dns.Client{Net: "tcp"},
+			})
+			metrics := fetchMetrics(t, c)
+			want := map[string]string{
+				"dnsmasq_cachesize":                                "666",
+				"dnsmasq_stats_tcp_fallbacks_total":                "7",
+				`dnsmasq_exporter_transport_info{protocol="auto"}`: "1",
+			}
+			for key, val := range want {
+				if got := metrics[key]; got != val {
+					t.Errorf("%s: got %q, want %q", key, got, val)
+				}
+			}
+		})
+	}
+}
+
+func TestLeasesChurn(t *testing.T) {
+	now := time.Unix(1625590000, 0)
+	leasesPath := filepath.Join(t.TempDir(), "dnsmasq.leases")
+	c := New(Config{
+		LeasesPath:       leasesPath,
+		LeaseChurnWindow: 10 * time.Minute,
+	})
+	c.now = func() time.Time { return now }
+
+	for _, tt := range []struct {
+		elapsed time.Duration
+		leases  string
+		want    string
+	}{
+		// The first scrape only takes a snapshot.
+		{0, "0 00:00:00:00:00:00 10.10.10.10 host-1 *\n", "0"},
+		// One lease added, one removed within 2 minutes.
+		{2 * time.Minute, "0 00:00:00:00:00:01 10.10.10.11 host-2 *\n", "1"},
+		// Unchanged: 2 changes within 4 minutes.
+		{4 * time.Minute, "0 00:00:00:00:00:01 10.10.10.11 host-2 *\n", "0.5"},
+		// The first changes have left the 10 minute window.
+		{13 * time.Minute, "0 00:00:00:00:00:01 10.10.10.11 host-2 *\n0 00:00:00:00:00:02 10.10.10.12 host-3 *\n", "0.1"},
+	} {
+		if err := os.WriteFile(leasesPath, []byte(tt.leases), 0644); err != nil {
+			t.Fatal(err)
+		}
+		now = time.Unix(1625590000, 0).Add(tt.elapsed)
+		if got := fetchMetrics(t, c)["dnsmasq_leases_churn_per_minute"]; got != tt.want {
+			t.Errorf("after %v: dnsmasq_leases_churn_per_minute: got %q, want %q", tt.elapsed, got, tt.want)
+		}
+	}
+}
+
+func TestExposeLeasesInfo(t *testing.T) {
+	for _, expose := range []bool{false, true} {
+		c := New(Config{
+			LeasesPath:   "testdata/dnsmasq.leases",
+			ExposeLeases: expose,
+		})
+		want := "0"
+		if expose {
+			want = "1"
+		}
+		if got := fetchMetrics(t, c)["dnsmasq_exporter_expose_leases"]; got != want {
+			t.Errorf("ExposeLeases=%v: dnsmasq_exporter_expose_leases: got %q, want %q", expose, got, want)
+		}
+	}
+}
+
+func TestParseServerStats(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		entry string
+		want  ServerStats
+	}{
+		// The "address#port queries failed" format of dnsmasq.
+		{"IPv4", "8.8.8.8#53 1284 7", ServerStats{Server: "8.8.8.8#53", Queries: 1284, FailedQueries: 7}},
+		{"IPv6", "2001:4860:4860::8888#53 310 0", ServerStats{Server: "2001:4860:4860::8888#53", Queries: 310, FailedQueries: 0}},
+		{"non-default port", "192.168.1.1#5353 42 3", ServerStats{Server: "192.168.1.1#5353", Queries: 42, FailedQueries: 3}},
+		// Possible extensions of the format.
+		{"extra whitespace", "  8.8.8.8#53\t10   2 ", ServerStats{Server: "8.8.8.8#53", Queries: 10, FailedQueries: 2}},
+		{"trailing fields", "8.8.8.8#53 10 2 150 9", ServerStats{Server: "8.8.8.8#53", Queries: 10, FailedQueries: 2, Extra: map[int]float64{3: 150, 4: 9}}},
+		{"non-numeric trailing field", "8.8.8.8#53 10 2 up 9", ServerStats{Server: "8.8.8.8#53", Queries: 10, FailedQueries: 2, Extra: map[int]float64{4: 9}}},
+		{"stats after slash", "8.8.8.8#53 10/8 2/1", ServerStats{Server: "8.8.8.8#53", Queries: 10, FailedQueries: 2}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseServerStats(tt.entry)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseServerStats(%q) = %+v, want %+v", tt.entry, got, tt.want)
+			}
+		})
+	}
+
+	for _, entry := range []string{"8.8.8.8#53 10", "8.8.8.8#53 ten 2", "8.8.8.8#53 10 /2"} {
+		if _, err := parseServerStats(entry); err == nil {
+			t.Errorf("parseServerStats(%q): unexpectedly succeeded", entry)
+		}
+	}
+}
+
+func TestServerExtraStats(t *testing.T) {
+	records := copyFakeRecords()
+	records["servers.bind."] = []string{"127.0.0.1#53 10 2 150 9"}
+	for _, tt := range []struct {
+		cfg  Config
+		want map[string]string
+	}{
+		{
+			cfg: Config{ServerExtraStats: true},
+			want: map[string]string{
+				`dnsmasq_servers_queries{server="127.0.0.1#53"}`:              "10",
+				`dnsmasq_servers_extra_stat{field="3",server="127.0.0.1#53"}`: "150",
+				`dnsmasq_servers_extra_stat{field="4",server="127.0.0.1#53"}`: "9",
+			},
+		},
+		{
+			cfg: Config{ServerExtraStats: true, SplitServerAddr: true},
+			want: map[string]string{
+				`dnsmasq_servers_extra_stat{field="3",server_ip="127.0.0.1",server_port="53"}`: "150",
+			},
+		},
+		{
+			cfg: Config{},
+			want: map[string]string{
+				`dnsmasq_servers_queries{server="127.0.0.1#53"}`:              "10",
+				`dnsmasq_servers_extra_stat{field="3",server="127.0.0.1#53"}`: "",
+			},
+		},
+	} {
+		tt.cfg.DnsClient = &dns.Client{}
+		tt.cfg.DnsmasqAddr = fakeDnsmasq(t, records)
+		metrics := fetchMetrics(t, New(tt.cfg))
+		for key, val := range tt.want {
+			if got := metrics[key]; got != val {
+				t.Errorf("%+v: metric %q: got %q, want %q", tt.cfg, key, got, val)
+			}
+		}
+	}
+}
+
+func TestDecodeIDNHostnames(t *testing.T) {
+	c := New(Config{
+		LeasesPath:         "testdata/dnsmasq-idn.leases",
+		ExposeLeases:       true,
+		DecodeIDNHostnames: true,
+	})
+	metrics := fetchMetrics(t, c)
+	for _, key := range []string{
+		`dnsmasq_lease_expiry{client_id="00:00:00:00:00:00",computer_name="münchen",computer_name_raw="xn--mnchen-3ya",iaid="",ip_addr="10.10.10.10",mac_addr="00:00:00:00:00:00"}`,
+		// Invalid punycode is exposed as-is.
+		`dnsmasq_lease_expiry{client_id="00:00:00:00:00:01",computer_name="xn--zz",computer_name_raw="xn--zz",iaid="",ip_addr="10.10.10.11",mac_addr="00:00:00:00:00:01"}`,
+		`dnsmasq_lease_expiry{client_id="00:00:00:00:00:02",computer_name="host-3",computer_name_raw="host-3",iaid="",ip_addr="10.10.10.12",mac_addr="00:00:00:00:00:02"}`,
+	} {
+		if got, want := metrics[key], "1.625595932e+09"; got != want {
+			t.Errorf("%s: got %q, want %q", key, got, want)
+		}
+	}
+}
+
+// recordsExchanger answers with its records.
+type recordsExchanger map[string][]string
+
+func (r recordsExchanger) Exchange(m *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+	in := new(dns.Msg)
+	in.SetReply(m)
+	name := m.Question[0].Name
+	in.Answer = []dns.RR{&dns.TXT{
+		Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS},
+		Txt: r[name],
+	}}
+	return in, 0, nil
+}
+
+func TestCacheUndersized(t *testing.T) {
+	records := recordsExchanger(copyFakeRecords())
+	c := New(Config{
+		DnsClient:   records,
+		DnsmasqAddr: "fake",
+	})
+	for _, tt := range []struct {
+		cachesize string
+		evictions string
+		want      string
+	}{
+		{"150", "10", "0"}, // no previous scrape
+		{"150", "10", "0"},
+		{"150", "12", "1"},
+		{"150", "12", "0"},
+		{"0", "13", "0"}, // caching disabled
+	} {
+		records["cachesize.bind."] = []string{tt.cachesize}
+		records["evictions.bind."] = []string{tt.evictions}
+		if got := fetchMetrics(t, c)["dnsmasq_cache_undersized"]; got != tt.want {
+			t.Errorf("cachesize %s, evictions %s: dnsmasq_cache_undersized: got %q, want %q", tt.cachesize, tt.evictions, got, tt.want)
+		}
+	}
+}
+
+func TestSplitStatsValues(t *testing.T) {
+	replay := make(replayExchanger)
+	for name, txt := range fakeRecords {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeTXT)
+		m.Id = 42
+		m.Response = true
+		switch name {
+		case "cachesize.bind.":
+			// One TXT record with several strings.
+			txt = []string{"1", "50"}
+		case "hits.bind.":
+			// Several TXT records.
+			m.Answer = append(m.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS},
+				Txt: []string{"12"},
+			})
+			txt = []string{"34"}
+		}
+		m.Answer = append(m.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS},
+			Txt: txt,
+		})
+		b, err := m.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		replay[name] = b
+	}
+	c := New(Config{
+		DnsClient:   replay,
+		DnsmasqAddr: "replay",
+		QueryID:     func() uint16 { return 42 },
+	})
+	metrics := fetchMetrics(t, c)
+	for key, want := range map[string]string{
+		"dnsmasq_cachesize": "150",
+		"dnsmasq_hits":      "1234",
+		"dnsmasq_misses":    "1",
+	} {
+		if got := metrics[key]; got != want {
+			t.Errorf("%s: got %q, want %q", key, got, want)
+		}
+	}
+}
+
+// unknownStatsExchanger answers like flakyExchanger, adding extra TXT
+// records to each answer.
+type unknownStatsExchanger map[string][]string
+
+func (u unknownStatsExchanger) Exchange(m *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+	in, rtt, err := (&flakyExchanger{}).Exchange(m, address)
+	for name, txt := range u {
+		in.Answer = append(in.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS},
+			Txt: txt,
+		})
+	}
+	return in, rtt, err
+}
+
+func TestExportUnknownStats(t *testing.T) {
+	exchanger := unknownStatsExchanger{
+		"queries-tcp.bind.": {"42"},
+		"version.bind.":     {"dnsmasq-2.90"},
+		"split.bind.":       {"1", "2"},
+		"-.bind.":           {"3"},
+	}
+	for _, export := range []bool{false, true} {
+		c := New(Config{
+			DnsClient:          exchanger,
+			DnsmasqAddr:        "fake",
+			ExportUnknownStats: export,
+		})
+		metrics := fetchMetrics(t, c)
+		var unknown []string
+		for key := range metrics {
+			if strings.HasPrefix(key, "dnsmasq_unknown_") {
+				unknown = append(unknown, key)
+			}
+		}
+		var want []string
+		if export {
+			want = []string{"dnsmasq_unknown_queries_tcp"}
+		}
+		if !reflect.DeepEqual(unknown, want) {
+			t.Errorf("ExportUnknownStats=%v: got unknown stats %v, want %v", export, unknown, want)
+		}
+		if export {
+			if got, want := metrics["dnsmasq_unknown_queries_tcp"], "42"; got != want {
+				t.Errorf("dnsmasq_unknown_queries_tcp: got %q, want %q", got, want)
+			}
+		}
+	}
+}
+
+func TestOUIVendors(t *testing.T) {
+	f, err := os.Open("testdata/oui.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	ouis, err := ParseOUIFile(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"001a11": "Google, Inc.", "b827eb": "Raspberry Pi Foundation"}; !reflect.DeepEqual(ouis, want) {
+		t.Errorf("ParseOUIFile: got %v, want %v", ouis, want)
+	}
+
+	leasesPath := filepath.Join(t.TempDir(), "dnsmasq.leases")
+	leases := `0 00:1a:11:00:00:01 10.10.10.10 host-1 *
+0 B8:27:EB:00:00:02 10.10.10.11 host-2 *
+0 aa:bb:cc:00:00:03 10.10.10.12 host-3 *
+0 00:1a:11:00:00:04 10.10.10.13 host-4 *
+`
+	if err := os.WriteFile(leasesPath, []byte(leases), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := New(Config{
+		LeasesPath: leasesPath,
+		// Explicit prefixes take precedence over the OUI vendors.
+		VendorPrefixes: map[string]string{"00:1a:11:00:00:04": "mine"},
+		OUIVendors:     ouis,
+	})
+	metrics := fetchMetrics(t, c)
+	want := map[string]string{
+		`dnsmasq_leases_by_vendor{vendor="Google, Inc."}`:            "1",
+		`dnsmasq_leases_by_vendor{vendor="Raspberry Pi Foundation"}`: "1",
+		`dnsmasq_leases_by_vendor{vendor="mine"}`:                    "1",
+		`dnsmasq_leases_by_vendor{vendor="other"}`:                   "1",
+	}
+	for key, val := range want {
+		if got := metrics[key]; got != val {
+			t.Errorf("metric %q: got %q, want %q", key, got, val)
+		}
+	}
+	if got, want := DefaultOUIVendors["001a11"], "google"; got != want {
+		t.Errorf("DefaultOUIVendors[%q]: got %q, want %q", "001a11", got, want)
+	}
+}
+
+func TestCacheLeases(t *testing.T) {
+	leasesPath := filepath.Join(t.TempDir(), "dnsmasq.leases")
+	mtime := time.Unix(1625590000, 0)
+	writeLeases := func(leases string, mtime time.Time) {
+		t.Helper()
+		if err := os.WriteFile(leasesPath, []byte(leases), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(leasesPath, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := New(Config{
+		LeasesPath:   leasesPath,
+		CacheLeases:  true,
+		ExposeLeases: true,
+	})
+
+	writeLeases("0 00:00:00:00:00:00 10.10.10.10 host-1 *\n0 00:00:00:00:00:01 10.10.10.11 host-2 *\n", mtime)
+	if got, want := fetchMetrics(t, c)["dnsmasq_leases"], "2"; got != want {
+		t.Errorf("dnsmasq_leases: got %q, want %q", got, want)
+	}
+
+	// The same size and modification time hit the cache, even though the
+	// contents differ.
+	writeLeases("0 00:00:00:00:00:00 10.10.10.10 host-1 *\nnot a lease, of the same size...........\n", mtime)
+	if got, want := fetchMetrics(t, c)["dnsmasq_leases"], "2"; got != want {
+		t.Errorf("cached: dnsmasq_leases: got %q, want %q", got, want)
+	}
+
+	// A new modification time invalidates the cache.
+	writeLeases("0 00:00:00:00:00:00 10.10.10.10 host-1 *\nnot a lease, of the same size...........\n", mtime.Add(time.Second))
+	metrics := fetchMetrics(t, c)
+	if got, want := metrics["dnsmasq_leases"], "1"; got != want {
+		t.Errorf("modified: dnsmasq_leases: got %q, want %q", got, want)
+	}
+	if got, want := metrics["dnsmasq_lease_parse_errors_total"], "1"; got != want {
+		t.Errorf("modified: dnsmasq_lease_parse_errors_total: got %q, want %q", got, want)
+	}
+
+	// So does a new size.
+	writeLeases("", mtime.Add(time.Second))
+	if got, want := fetchMetrics(t, c)["dnsmasq_leases"], "0"; got != want {
+		t.Errorf("truncated: dnsmasq_leases: got %q, want %q", got, want)
+	}
+
+	// So does a new file of the same size and modification time renamed
+	// into place.
+	writeLeases("0 00:00:00:00:00:00 10.10.10.10 host-1 *\n", mtime)
+	if got, want := fetchMetrics(t, c)["dnsmasq_leases"], "1"; got != want {
+		t.Errorf("rewritten: dnsmasq_leases: got %q, want %q", got, want)
+	}
+	tmpPath := leasesPath + ".new"
+	if err := os.WriteFile(tmpPath, []byte("0 00:00:00:00:00:01 10.10.10.11 host-2 *\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(tmpPath, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmpPath, leasesPath); err != nil {
+		t.Fatal(err)
+	}
+	metrics = fetchMetrics(t, c)
+	if got, want := metrics[`dnsmasq_lease_expiry{client_id="*",computer_name="host-2",iaid="",ip_addr="10.10.10.11",mac_addr="00:00:00:00:00:01"}`], "0"; got != want {
+		t.Errorf("renamed: host-2 lease: got %q, want %q", got, want)
+	}
+}
+
+func TestSplitServerAddr(t *testing.T) {
+	records := copyFakeRecords()
+	records["servers.bind."] = []string{
+		"127.0.0.1#53 10 2",
+		"127.0.0.1#5353 20 3",
+		"2001:db8::1#53 30 4",
+		"[2001:db8::2]#5353 40 5",
+		"198.51.100.1:53 50 6",
+		"/run/dnsmasq.sock 60 7",
+	}
+	c := New(Config{
+		DnsClient:       &dns.Client{},
+		DnsmasqAddr:     fakeDnsmasq(t, records),
+		SplitServerAddr: true,
+	})
+	metrics := fetchMetrics(t, c)
+	want := map[string]string{
+		`dnsmasq_servers_queries{server_ip="127.0.0.1",server_port="53"}`:              "10",
+		`dnsmasq_servers_queries{server_ip="127.0.0.1",server_port="5353"}`:            "20",
+		`dnsmasq_servers_queries_failed{server_ip="127.0.0.1",server_port="5353"}`:     "3",
+		`dnsmasq_servers_queries{server_ip="2001:db8::1",server_port="53"}`:            "30",
+		`dnsmasq_servers_queries{server_ip="2001:db8::2",server_port="5353"}`:          "40",
+		`dnsmasq_servers_queries{server_ip="198.51.100.1",server_port="53"}`:           "50",
+		`dnsmasq_servers_queries{server_ip="/run/dnsmasq.sock",server_port=""}`:        "60",
+		`dnsmasq_servers_queries_failed{server_ip="/run/dnsmasq.sock",server_port=""}`: "7",
+	}
+	for key, val := range want {
+		if got := metrics[key]; got != val {
+			t.Errorf("metric %q: got %q, want %q", key, got, val)
+		}
+	}
+}
+
+func TestLeaseWebhook(t *testing.T) {
+	var mu sync.Mutex
+	var payloads []leaseWebhookPayload
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p leaseWebhookPayload
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		payloads = append(payloads, p)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	leasesPath := filepath.Join(t.TempDir(), "dnsmasq.leases")
+	write := func(leases string) {
+		if err := os.WriteFile(leasesPath, []byte(leases), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`1625595932 00:00:00:00:00:00 10.10.10.10 host-1 00:00:00:00:00:00
+1625595932 00:00:00:00:00:01 10.10.10.11 host-2 00:00:00:00:00:01
+`)
+	c := New(Config{
+		LeasesPath:   leasesPath,
+		LeaseWebhook: srv.URL,
+	})
+	now := time.Unix(1625590000, 0)
+	c.now = func() time.Time { return now }
+	fetchMetrics(t, c)
+	// A renewed lease is not a change.
+	write(`1625599999 00:00:00:00:00:00 10.10.10.10 host-1 00:00:00:00:00:00
+1625595932 00:00:00:00:00:02 10.10.10.12 host-3 00:00:00:00:00:02
+`)
+	fetchMetrics(t, c)
+	// The events are POSTed in the background.
+	var got []leaseWebhookPayload
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		mu.Lock()
+		got = payloads
+		mu.Unlock()
+		if len(got) > 0 {
+			break
+		}
+	}
+	if got, want := fetchMetrics(t, c)["dnsmasq_lease_webhook_failures_total"], "0"; got != want {
+		t.Errorf("dnsmasq_lease_webhook_failures_total: got %q, want %q", got, want)
+	}
+	want := []leaseWebhookPayload{{
+		Time: now.Unix(),
+		Events: []leaseEvent{
+			{Type: "added", MACAddress: "00:00:00:00:00:02", IPAddress: "10.10.10.12", ComputerName: "host-3", ClientID: "00:00:00:00:00:02", Expiry: 1625595932},
+			{Type: "removed", MACAddress: "00:00:00:00:00:01", IPAddress: "10.10.10.11", ComputerName: "host-2", ClientID: "00:00:00:00:00:01", Expiry: 1625595932},
+		},
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("webhook payloads: got %+v, want %+v", got, want)
+	}
+
+	srv.Close()
+	write("")
+	fetchMetrics(t, c)
+	var failures string
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if failures = fetchMetrics(t, c)["dnsmasq_lease_webhook_failures_total"]; failures != "0" {
+			break
+		}
+	}
+	if want := "1"; failures != want {
+		t.Errorf("dnsmasq_lease_webhook_failures_total: got %q, want %q", failures, want)
+	}
+}
+
+func TestStatsLastSuccess(t *testing.T) {
+	records := copyFakeRecords()
+	c := New(Config{
+		DnsClient:   &dns.Client{},
+		DnsmasqAddr: fakeDnsmasq(t, records),
+		FailedStats: FailedStatsNaN,
+	})
+	now := time.Unix(1625595932, 0)
+	c.now = func() time.Time { return now }
+	fetchMetrics(t, c)
+
+	// hits.bind starts failing while the other records still succeed.
+	records["hits.bind."] = []string{"not a number"}
+	now = now.Add(time.Minute)
+	metrics := fetchMetrics(t, c)
+	for record, want := range map[string]string{
+		"hits.bind.":      "1.625595932e+09",
+		"cachesize.bind.": "1.625595992e+09",
+		"servers.bind.":   "1.625595992e+09",
+	} {
+		key := `dnsmasq_stats_last_success_timestamp_seconds{record="` + record + `"}`
+		if got := metrics[key]; got != want {
+			t.Errorf("metric %q: got %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestClockSkewSuspected(t *testing.T) {
+	leasesPath := filepath.Join(t.TempDir(), "dnsmasq.leases")
+	leases := `1625595932 00:00:00:00:00:00 10.10.10.10 host-1 00:00:00:00:00:00
+1625599532 00:00:00:00:00:01 10.10.10.11 host-2 00:00:00:00:00:01
+1625682332 00:00:00:00:00:02 10.10.10.12 host-3 00:00:00:00:00:02
+0 00:00:00:00:00:03 10.10.10.13 host-4 00:00:00:00:00:03
+`
+	if err := os.WriteFile(leasesPath, []byte(leases), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		now           int64
+		dhcpLeaseTime time.Duration
+		want          string
+	}{
+		{now: 1625595000, want: "0"},
+		// One of three leases expired.
+		{now: 1625596000, want: "0"},
+		// Two of three leases expired.
+		{now: 1625600000, want: "1"},
+		// One lease expired, one expires in 24h despite a 12h lease time.
+		{now: 1625596000, dhcpLeaseTime: 12 * time.Hour, want: "1"},
+	} {
+		c := New(Config{
+			LeasesPath:    leasesPath,
+			DhcpLeaseTime: tt.dhcpLeaseTime,
+		})
+		now := time.Unix(tt.now, 0)
+		c.now = func() time.Time { return now }
+		if got := fetchMetrics(t, c)["dnsmasq_clock_skew_suspected"]; got != tt.want {
+			t.Errorf("now=%d, dhcp_lease_time=%v: dnsmasq_clock_skew_suspected: got %q, want %q", tt.now, tt.dhcpLeaseTime, got, tt.want)
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	c := New(Config{
+		DnsClient:   &dns.Client{},
+		DnsmasqAddr: fakeDnsmasq(t, fakeRecords),
+	})
+	values, servers, err := c.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantValues := map[string]float64{
+		"cachesize":  666,
+		"insertions": 1,
+		"evictions":  0,
+		"misses":     1,
+		"hits":       5,
+		"auth":       0,
+	}
+	if !reflect.DeepEqual(values, wantValues) {
+		t.Errorf("Stats values: got %v, want %v", values, wantValues)
+	}
+	wantServers := []ServerStats{{Server: "127.0.0.1#53", Queries: 10, FailedQueries: 2}}
+	if !reflect.DeepEqual(servers, wantServers) {
+		t.Errorf("Stats servers: got %+v, want %+v", servers, wantServers)
+	}
+}
+
+func TestFetchStats(t *testing.T) {
+	records := copyFakeRecords()
+	records["hits.bind."] = []string{"not a number"}
+	c := New(Config{
+		DnsClient:   &dns.Client{},
+		DnsmasqAddr: fakeDnsmasq(t, records),
+	})
+
+	p, err := c.fetchStats(context.Background(), "servers.bind.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.answered || p.empty || p.responseBytes == 0 {
+		t.Errorf("servers.bind.: answered=%v, empty=%v, responseBytes=%d; want an answered, non-empty response", p.answered, p.empty, p.responseBytes)
+	}
+	if want := []ServerStats{{Server: "127.0.0.1#53", Queries: 10, FailedQueries: 2}}; !reflect.DeepEqual(p.servers, want) {
+		t.Errorf("servers.bind.: got servers %+v, want %+v", p.servers, want)
+	}
+	if !p.hasServers || p.forwarded != 10 {
+		t.Errorf("servers.bind.: got hasServers=%v, forwarded=%v, want true, 10", p.hasServers, p.forwarded)
+	}
+
+	p, err = c.fetchStats(context.Background(), "cachesize.bind.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]float64{"cachesize.bind.": 666}; !reflect.DeepEqual(p.values, want) {
+		t.Errorf("cachesize.bind.: got values %v, want %v", p.values, want)
+	}
+
+	// The response to an unparseable answer is still described.
+	p, err = c.fetchStats(context.Background(), "hits.bind.")
+	if err == nil {
+		t.Fatal("hits.bind.: unexpectedly succeeded")
+	}
+	if !p.answered || p.responseBytes == 0 {
+		t.Errorf("hits.bind.: answered=%v, responseBytes=%d; want an answered response", p.answered, p.responseBytes)
+	}
+}
+
+func TestParseStatsAnswer(t *testing.T) {
+	c := New(Config{ServerFilter: regexp.MustCompile(`^127\.`)})
+	txt := func(name string, txt ...string) dns.RR {
+		return &dns.TXT{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS},
+			Txt: txt,
+		}
+	}
+	in := new(dns.Msg)
+	in.Answer = []dns.RR{
+		txt("hits.bind.", "12", "34"),
+		txt("servers.bind.", "127.0.0.1#53 10 2", "192.0.2.1#53 5 1"),
+		txt("future.bind.", "7"),
+	}
+	p, err := c.parseStatsAnswer(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]float64{"hits.bind.": 1234}; !reflect.DeepEqual(p.values, want) {
+		t.Errorf("values: got %v, want %v", p.values, want)
+	}
+	if want := []ServerStats{{Server: "127.0.0.1#53", Queries: 10, FailedQueries: 2}}; !reflect.DeepEqual(p.servers, want) {
+		t.Errorf("servers: got %+v, want %+v", p.servers, want)
+	}
+	if p.forwarded != 15 {
+		t.Errorf("forwarded: got %v, want 15", p.forwarded)
+	}
+	if len(p.unknown) != 1 || p.unknown[0].Hdr.Name != "future.bind." {
+		t.Errorf("unknown: got %v, want future.bind.", p.unknown)
+	}
+
+	in.Answer = []dns.RR{txt("servers.bind.", "127.0.0.1#53 10")}
+	if _, err := c.parseStatsAnswer(in); err == nil {
+		t.Errorf("servers.bind. with 2 fields: unexpectedly succeeded")
+	}
+}
+
+// ptrExchanger answers PTR queries with the name in its map, keyed by
+// reverse name, or NXDOMAIN for an empty name. Queries for other names fail.
+type ptrExchanger struct {
+	names   map[string]string
+	lookups int
+}
+
+func (e *ptrExchanger) Exchange(m *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+	e.lookups++
+	q := m.Question[0]
+	name, ok := e.names[q.Name]
+	if !ok {
+		return nil, 0, fmt.Errorf("i/o timeout")
+	}
+	in := new(dns.Msg)
+	in.SetReply(m)
+	if name == "" {
+		in.Rcode = dns.RcodeNameError
+		return in, 0, nil
+	}
+	in.Answer = append(in.Answer, &dns.PTR{
+		Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET},
+		Ptr: name,
+	})
+	return in, 0, nil
+}
+
+func TestLeasePTRMismatch(t *testing.T) {
+	leasesPath := filepath.Join(t.TempDir(), "dnsmasq.leases")
+	leases := `1625595932 00:00:00:00:00:00 10.10.10.10 host-1 00:00:00:00:00:00
+1625595932 00:00:00:00:00:01 10.10.10.11 host-2 00:00:00:00:00:01
+1625595932 00:00:00:00:00:02 10.10.10.12 host-3 00:00:00:00:00:02
+1625595932 00:00:00:00:00:03 10.10.10.13 host-4 00:00:00:00:00:03
+1625595932 00:00:00:00:00:04 10.10.10.14 * 00:00:00:00:00:04
+`
+	if err := os.WriteFile(leasesPath, []byte(leases), 0644); err != nil {
+		t.Fatal(err)
+	}
+	e := &ptrExchanger{names: map[string]string{
+		"10.10.10.10.in-addr.arpa.": "host-1.lan.",
+		"11.10.10.10.in-addr.arpa.": "stale.lan.",
+		"12.10.10.10.in-addr.arpa.": "",
+		// 10.10.10.13 times out.
+	}}
+	c := New(Config{
+		DnsClient:        e,
+		LeasesPath:       leasesPath,
+		PTRCheckAddr:     "127.0.0.1:53",
+		PTRCheckInterval: time.Hour,
+	})
+	now := time.Unix(1625590000, 0)
+	c.now = func() time.Time { return now }
+	metrics := fetchMetrics(t, c)
+	if got, want := metrics["dnsmasq_lease_ptr_mismatch"], "2"; got != want {
+		t.Errorf("dnsmasq_lease_ptr_mismatch: got %q, want %q", got, want)
+	}
+	if got, want := metrics["dnsmasq_lease_ptr_lookup_errors_total"], "1"; got != want {
+		t.Errorf("dnsmasq_lease_ptr_lookup_errors_total: got %q, want %q", got, want)
+	}
+	if got, want := e.lookups, 4; got != want {
+		t.Errorf("PTR lookups: got %d, want %d", got, want)
+	}
+
+	// Within PTRCheckInterval, only the failed lookup is repeated.
+	e.names["13.10.10.10.in-addr.arpa."] = "host-4."
+	if got, want := fetchMetrics(t, c)["dnsmasq_lease_ptr_mismatch"], "2"; got != want {
+		t.Errorf("dnsmasq_lease_ptr_mismatch: got %q, want %q", got, want)
+	}
+	if got, want := e.lookups, 5; got != want {
+		t.Errorf("PTR lookups: got %d, want %d", got, want)
+	}
+}
+
+func TestHostnameMatches(t *testing.T) {
+	for _, tt := range []struct {
+		computerName string
+		names        []string
+		want         bool
+	}{
+		{"host-1", []string{"host-1."}, true},
+		{"host-1", []string{"HOST-1.lan."}, true},
+		{"host-1", []string{"host-10.lan."}, false},
+		{"host-1", []string{"other.lan.", "host-1.lan."}, true},
+		{"host-1", nil, false},
+	} {
+		if got := hostnameMatches(tt.computerName, tt.names); got != tt.want {
+			t.Errorf("hostnameMatches(%q, %q) = %v, want %v", tt.computerName, tt.names, got, tt.want)
+		}
+	}
+}
+
+func TestCounterRecords(t *testing.T) {
+	for _, tt := range []struct {
+		counterRecords []string
+		wantCounters   map[string]bool
+	}{
+		{
+			counterRecords: nil,
+			wantCounters:   map[string]bool{},
+		},
+		{
+			counterRecords: []string{"insertions.bind.", "evictions.bind.", "hits.bind.", "misses.bind.", "auth.bind."},
+			wantCounters: map[string]bool{
+				"dnsmasq_insertions": true,
+				"dnsmasq_evictions":  true,
+				"dnsmasq_hits":       true,
+				"dnsmasq_misses":     true,
+				"dnsmasq_auth":       true,
+			},
+		},
+	} {
+		reg := prometheus.NewRegistry()
+		reg.MustRegister(New(Config{
+			DnsClient:      &dns.Client{},
+			DnsmasqAddr:    fakeDnsmasq(t, fakeRecords),
+			CounterRecords: tt.counterRecords,
+		}))
+		mfs, err := reg.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		types := make(map[string]string)
+		for _, mf := range mfs {
+			types[mf.GetName()] = mf.GetType().String()
+		}
+		for _, name := range []string{"dnsmasq_cachesize", "dnsmasq_insertions", "dnsmasq_evictions", "dnsmasq_hits", "dnsmasq_misses", "dnsmasq_auth"} {
+			// Counters are named with a _total suffix.
+			want := "GAUGE"
+			if tt.wantCounters[name] {
+				name += "_total"
+				want = "COUNTER"
+			}
+			if got := types[name]; got != want {
+				t.Errorf("CounterRecords %v: %s has type %q, want %s", tt.counterRecords, name, got, want)
+			}
+		}
+	}
+}
+
+func TestComputeRates(t *testing.T) {
+	records := copyFakeRecords()
+	c := New(Config{
+		DnsClient:    &dns.Client{},
+		DnsmasqAddr:  fakeDnsmasq(t, records),
+		ComputeRates: true,
+	})
+	now := time.Unix(1625595932, 0)
+	c.now = func() time.Time { return now }
+	if _, ok := fetchMetrics(t, c)[`dnsmasq_queries_per_second{type="hits"}`]; ok {
+		t.Errorf("dnsmasq_queries_per_second exposed in the first scrape")
+	}
+
+	records["hits.bind."] = []string{"65"}
+	records["misses.bind."] = []string{"31"}
+	now = now.Add(30 * time.Second)
+	metrics := fetchMetrics(t, c)
+	for key, want := range map[string]string{
+		`dnsmasq_queries_per_second{type="hits"}`:   "2",
+		`dnsmasq_queries_per_second{type="misses"}`: "1",
+	} {
+		if got := metrics[key]; got != want {
+			t.Errorf("metric %q: got %q, want %q", key, got, want)
+		}
+	}
+
+	// dnsmasq restarted.
+	records["hits.bind."] = []string{"1"}
+	now = now.Add(30 * time.Second)
+	if _, ok := fetchMetrics(t, c)[`dnsmasq_queries_per_second{type="hits"}`]; ok {
+		t.Errorf("dnsmasq_queries_per_second exposed after the counters decreased")
+	}
+}
+
+func TestLeasesByClientIDType(t *testing.T) {
+	c := New(Config{LeasesPath: "testdata/dnsmasq-clientid.leases"})
+	metrics := fetchMetrics(t, c)
+	for typ, want := range map[string]string{
+		"mac":   "2",
+		"duid":  "2",
+		"other": "3",
+	} {
+		key := `dnsmasq_leases_by_clientid_type{type="` + typ + `"}`
+		if got := metrics[key]; got != want {
+			t.Errorf("metric %q: got %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestClientIDType(t *testing.T) {
+	for _, tt := range []struct {
+		clientID string
+		iaid     string
+		want     string
+	}{
+		{clientID: "01:00:00:00:00:00:00", want: "mac"},
+		{clientID: "00:00:00:00:00:01", want: "mac"},
+		{clientID: "ff:00:00:00:02:00:01:00:01:2a:2b:2c:2d:00:00:00:00:00:02", want: "duid"},
+		{clientID: "00:01:00:01:11:11:11:11:00:00:00:00:00:01", iaid: "12345", want: "duid"},
+		{clientID: "00:68:6f:73:74:2d:35", want: "other"},
+		{clientID: "*", want: "other"},
+		{clientID: "", want: "other"},
+		{clientID: ":", want: "other"},
+		{clientID: "zz", want: "other"},
+	} {
+		if got := clientIDType(lease{clientId: tt.clientID, iaid: tt.iaid}); got != tt.want {
+			t.Errorf("clientIDType(%q, iaid %q): got %q, want %q", tt.clientID, tt.iaid, got, tt.want)
+		}
+	}
+}
+
+func TestOldestLeaseAge(t *testing.T) {
+	now := time.Unix(1625590000, 0)
+	for _, tt := range []struct {
+		name   string
+		leases string
+		want   string // empty if not exposed
+	}{
+		{
+			name: "dynamic",
+			leases: `1625620000 00:00:00:00:00:00 10.10.10.10 host-1 *
+1625600000 00:00:00:00:00:01 10.10.10.11 host-2 *
+0 00:00:00:00:00:02 10.10.10.12 host-3 *
+`,
+			// Issued at 1625600000 - 12h = 1625556800.
+			want: "33200",
+		},
+		{
+			name: "static",
+			leases: `0 00:00:00:00:00:00 10.10.10.10 host-1 *
+`,
+			want: "",
+		},
+	} {
+		leasesPath := filepath.Join(t.TempDir(), "dnsmasq.leases")
+		if err := os.WriteFile(leasesPath, []byte(tt.leases), 0644); err != nil {
+			t.Fatal(err)
+		}
+		c := New(Config{
+			LeasesPath:    leasesPath,
+			DhcpLeaseTime: 12 * time.Hour,
+		})
+		c.now = func() time.Time { return now }
+		got, ok := fetchMetrics(t, c)["dnsmasq_oldest_lease_age_seconds"]
+		if tt.want == "" {
+			if ok {
+				t.Errorf("%s: dnsmasq_oldest_lease_age_seconds unexpectedly exposed: %q", tt.name, got)
+			}
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: dnsmasq_oldest_lease_age_seconds: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
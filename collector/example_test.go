@@ -0,0 +1,43 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector_test
+
+import (
+	"crypto/tls"
+	"log"
+	"time"
+
+	"github.com/google/dnsmasq_exporter/collector"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// This example queries dnsmasq over DNS-over-TLS with custom timeouts by
+// passing a customized *dns.Client.
+func ExampleNew_customClient() {
+	cfg := collector.Config{
+		DnsClient: &dns.Client{
+			Net:       "tcp-tls",
+			TLSConfig: &tls.Config{ServerName: "dnsmasq.example.net"},
+			Timeout:   5 * time.Second,
+		},
+		DnsmasqAddr: "dnsmasq.example.net:853",
+		LeasesPath:  "/var/lib/misc/dnsmasq.leases",
+	}
+	if err := cfg.Validate(); err != nil {
+		log.Fatal(err)
+	}
+	prometheus.MustRegister(collector.New(cfg))
+}
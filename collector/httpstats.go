@@ -0,0 +1,102 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Values for Config.StatsSource.
+const (
+	StatsSourceDNS  = "dns"
+	StatsSourceHTTP = "http"
+)
+
+// fetchHTTPStats fetches the stats from the URL in Config.DnsmasqAddr, see
+// parseHTTPStats.
+func (c *Collector) fetchHTTPStats(ctx context.Context) (map[string]float64, error) {
+	_, end := c.startSpan(ctx, "dnsmasq.query "+c.cfg.DnsmasqAddr)
+	values, err := func() (map[string]float64, error) {
+		resp, err := c.httpClient.Get(c.cfg.DnsmasqAddr)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("%s: unexpected HTTP status %s", c.cfg.DnsmasqAddr, resp.Status)
+		}
+		return parseHTTPStats(resp.Body)
+	}()
+	end(err)
+	return values, err
+}
+
+// parseHTTPStats parses stats in a generic key-value format: one "key value",
+// "key=value" or "key: value" pair per line, ignoring empty lines and lines
+// starting with #. Keys are the names of the stats DNS records, with or
+// without the ".bind" suffix (e.g. "hits" or "hits.bind"). The returned
+// values are keyed by record name, e.g. "hits.bind.".
+func parseHTTPStats(r io.Reader) (map[string]float64, error) {
+	values := make(map[string]float64)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		idx := strings.IndexAny(line, "=: \t")
+		if idx == -1 {
+			return nil, fmt.Errorf("malformed stats line %q", line)
+		}
+		key := strings.ToLower(strings.TrimSpace(line[:idx]))
+		f, err := strconv.ParseFloat(strings.TrimSpace(line[idx+1:]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("malformed stats line %q: %v", line, err)
+		}
+		key = strings.TrimSuffix(strings.TrimSuffix(key, "."), ".bind")
+		values[key+".bind."] = f
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// collectHTTPStats exposes the stats fetched from the HTTP stats URL. Keys
+// which do not correspond to a known stats record are ignored. Values are
+// also stored in values.
+func (c *Collector) collectHTTPStats(ctx context.Context, ch chan<- prometheus.Metric, values map[string]float64) error {
+	fetched, err := c.fetchHTTPStats(ctx)
+	if err != nil {
+		return err
+	}
+	for name, f := range fetched {
+		g, ok := c.floatMetrics[name]
+		if !ok {
+			continue
+		}
+		values[name] = f
+		ch <- prometheus.MustNewConstMetric(g, c.statsValueType(name), f)
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+// DefaultOUIVendors is a small curated subset of the IEEE OUI registry,
+// covering vendors commonly seen on home and lab networks. Keys are OUIs as
+// normalized by normalizeMAC (e.g. "001a11"). Use ParseOUIFile for the full
+// registry.
+var DefaultOUIVendors = map[string]string{
+	"001a11": "google",
+	"3c5ab4": "google",
+	"000393": "apple",
+	"000a27": "apple",
+	"000a95": "apple",
+	"001b63": "apple",
+	"0026bb": "apple",
+	"b827eb": "raspberrypi",
+	"dca632": "raspberrypi",
+	"e45f01": "raspberrypi",
+	"000c29": "vmware",
+	"005056": "vmware",
+	"000569": "vmware",
+	"080027": "virtualbox",
+	"525400": "qemu",
+	"00155d": "microsoft",
+	"000d3a": "microsoft",
+	"00163e": "xen",
+	"001c42": "parallels",
+	"00000c": "cisco",
+	"00044b": "nvidia",
+	"18b430": "nest",
+	"001788": "philips",
+	"5ccf7f": "espressif",
+	"240ac4": "espressif",
+	"30aea4": "espressif",
+	"00e04c": "realtek",
+	"001b21": "intel",
+	"001132": "synology",
+	"00089b": "qnap",
+	"000db9": "pcengines",
+	"001422": "dell",
+}
+
+// ParseOUIFile parses the IEEE OUI registry in its oui.txt format, whose
+// entries start with lines like
+//
+//	00-1A-11   (hex)		Google, Inc.
+//
+// and returns the vendor by OUI, keyed like DefaultOUIVendors. All other
+// lines are ignored.
+func ParseOUIFile(r io.Reader) (map[string]string, error) {
+	vendors := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		idx := strings.Index(line, "(hex)")
+		if idx == -1 {
+			continue
+		}
+		oui := normalizeMAC(strings.TrimSpace(line[:idx]))
+		vendor := strings.TrimSpace(line[idx+len("(hex)"):])
+		if len(oui) != 6 || vendor == "" {
+			continue
+		}
+		vendors[oui] = vendor
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return vendors, nil
+}
@@ -0,0 +1,127 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// maxPTRLookups is the maximum number of PTR lookups per scrape, see
+// Config.PTRCheckAddr. Leases which are not looked up in one scrape are
+// looked up in the next ones.
+const maxPTRLookups = 16
+
+// ptrResult is the result of the PTR lookup of a lease's IP address.
+type ptrResult struct {
+	computerName string // of the lease when it was checked
+	mismatch     bool
+	at           time.Time
+}
+
+// ptrMismatches returns the number of activeLeases whose IP address does not
+// resolve to their hostname, looking up the IP addresses whose result is
+// missing or older than Config.PTRCheckInterval (at most maxPTRLookups per
+// call, and none after a failed lookup). Leases without a hostname and
+// leases whose lookup failed are not counted.
+func (c *Collector) ptrMismatches(activeLeases []lease) int {
+	now := c.now()
+	c.mu.Lock()
+	results := c.ptrResults
+	c.mu.Unlock()
+
+	current := make(map[string]ptrResult, len(activeLeases))
+	var lookups, mismatches int
+	for _, l := range activeLeases {
+		if l.computerName == "*" || l.computerName == "" {
+			continue
+		}
+		r, ok := results[l.ipAddress]
+		stale := !ok || r.computerName != l.computerName || now.Sub(r.at) >= c.cfg.PTRCheckInterval
+		if stale && lookups < maxPTRLookups {
+			lookups++
+			names, err := c.lookupPTR(l.ipAddress)
+			if err != nil {
+				c.ptrLookupErrors.Inc()
+				// The DNS server is likely unreachable; do not add
+				// more timeouts to this scrape.
+				lookups = maxPTRLookups
+			} else {
+				r = ptrResult{
+					computerName: l.computerName,
+					mismatch:     !hostnameMatches(l.computerName, names),
+					at:           now,
+				}
+				ok = true
+			}
+		}
+		if !ok || r.computerName != l.computerName {
+			continue // not checked yet
+		}
+		current[l.ipAddress] = r
+		if r.mismatch {
+			mismatches++
+		}
+	}
+
+	c.mu.Lock()
+	c.ptrResults = current
+	c.mu.Unlock()
+	return mismatches
+}
+
+// lookupPTR returns the names which the PTR records of ip point to, which
+// are none if the name does not exist.
+func (c *Collector) lookupPTR(ip string) ([]string, error) {
+	reverse, err := dns.ReverseAddr(ip)
+	if err != nil {
+		return nil, err
+	}
+	msg := new(dns.Msg)
+	msg.SetQuestion(reverse, dns.TypePTR)
+	in, _, err := c.cfg.DnsClient.Exchange(msg, c.cfg.PTRCheckAddr)
+	if err != nil {
+		return nil, err
+	}
+	switch in.Rcode {
+	case dns.RcodeSuccess, dns.RcodeNameError:
+	default:
+		return nil, fmt.Errorf("PTR %s: %s", reverse, dns.RcodeToString[in.Rcode])
+	}
+	var names []string
+	for _, a := range in.Answer {
+		if ptr, ok := a.(*dns.PTR); ok {
+			names = append(names, ptr.Ptr)
+		}
+	}
+	return names, nil
+}
+
+// hostnameMatches reports whether one of the names (as returned by
+// lookupPTR) is the lease hostname computerName, optionally followed by a
+// domain.
+func hostnameMatches(computerName string, names []string) bool {
+	for _, name := range names {
+		name = strings.TrimSuffix(name, ".")
+		if strings.EqualFold(name, computerName) ||
+			strings.HasPrefix(strings.ToLower(name), strings.ToLower(computerName)+".") {
+			return true
+		}
+	}
+	return false
+}
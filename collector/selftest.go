@@ -0,0 +1,132 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// SelfTest queries each stats DNS record and reads the leases file, writing a
+// human-readable report including the raw DNS answers to w. It is meant to
+// diagnose connectivity and configuration problems during setup, and returns
+// an error if any step failed.
+func (c *Collector) SelfTest(w io.Writer) error {
+	var failed bool
+
+	if c.cfg.DnsmasqAddr != "" && c.cfg.StatsSource == StatsSourceHTTP {
+		fmt.Fprintf(w, "Fetching stats from %s:\n", c.cfg.DnsmasqAddr)
+		if values, err := c.fetchHTTPStats(context.Background()); err != nil {
+			fmt.Fprintf(w, "  FAIL %v\n", err)
+			failed = true
+		} else {
+			fmt.Fprintf(w, "  OK   %d values\n", len(values))
+		}
+	} else if c.cfg.DnsmasqAddr != "" {
+		if c.selfTestStats(w) {
+			failed = true
+		}
+	}
+
+	if c.leasesEnabled() {
+		source := c.cfg.LeasesPath
+		if c.cfg.LeasesGlob != "" {
+			source = c.cfg.LeasesGlob
+		}
+		fmt.Fprintf(w, "Reading leases file %s:\n", source)
+		var stats leaseFileStats
+		activeLeases, err := c.readLeases(&stats)
+		if err != nil {
+			fmt.Fprintf(w, "  FAIL %v\n", err)
+			failed = true
+		} else {
+			fmt.Fprintf(w, "  OK   %d leases parsed\n", len(activeLeases))
+			writeLeaseFileStats(w, stats)
+		}
+	}
+
+	if failed {
+		return errors.New("self-test failed")
+	}
+	return nil
+}
+
+// writeLeaseFileStats writes the parsing diagnostics of the leases file(s)
+// for SelfTest.
+func writeLeaseFileStats(w io.Writer, stats leaseFileStats) {
+	var skipped int
+	var reasons []string
+	for reason, n := range stats.skipped {
+		skipped += n
+		reasons = append(reasons, fmt.Sprintf("%s: %d", reason, n))
+	}
+	sort.Strings(reasons)
+	fmt.Fprintf(w, "       %d lines scanned\n", stats.lines)
+	if len(reasons) > 0 {
+		fmt.Fprintf(w, "       %d lines skipped (%s)\n", skipped, strings.Join(reasons, ", "))
+	} else {
+		fmt.Fprintf(w, "       0 lines skipped\n")
+	}
+	fmt.Fprintf(w, "       %d parse errors (unparseable lines are logged)\n", stats.errors)
+}
+
+// selfTestStats queries each stats DNS record for SelfTest and reports
+// whether any query failed.
+func (c *Collector) selfTestStats(w io.Writer) (failed bool) {
+	fmt.Fprintf(w, "Querying dnsmasq at %s:\n", c.cfg.DnsmasqAddr)
+	for _, questionBind := range c.questionBinds {
+		in, err := c.exchange(questionBind)
+		if err != nil {
+			fmt.Fprintf(w, "  FAIL %s: %v\n", questionBind, err)
+			failed = true
+			continue
+		}
+		if len(in.Answer) == 0 {
+			fmt.Fprintf(w, "  FAIL %s: no answer (rcode %d)\n", questionBind, in.Rcode)
+			failed = true
+			continue
+		}
+
+		p, err := c.parseStatsAnswer(in)
+		if err != nil {
+			fmt.Fprintf(w, "  FAIL %s: %v\n", questionBind, err)
+			failed = true
+		} else {
+			ch := make(chan prometheus.Metric)
+			done := make(chan struct{})
+			var metrics int
+			go func() {
+				for range ch {
+					metrics++
+				}
+				close(done)
+			}()
+			c.emitStats(p, ch, make(map[string]float64))
+			close(ch)
+			<-done
+			fmt.Fprintf(w, "  OK   %s: %d metrics\n", questionBind, metrics)
+		}
+		for _, a := range in.Answer {
+			fmt.Fprintf(w, "         %s\n", a)
+		}
+	}
+	return failed
+}
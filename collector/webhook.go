@@ -0,0 +1,125 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// leaseEvent is a lease added or removed since the previous scrape, as sent
+// to Config.LeaseWebhook.
+type leaseEvent struct {
+	Type         string `json:"type"` // "added" or "removed"
+	MACAddress   string `json:"mac_address,omitempty"`
+	IPAddress    string `json:"ip_address"`
+	ComputerName string `json:"computer_name"`
+	ClientID     string `json:"client_id"`
+	IAID         string `json:"iaid,omitempty"`
+	Expiry       uint64 `json:"expiry"`
+}
+
+// leaseWebhookPayload is the JSON body POSTed to Config.LeaseWebhook.
+type leaseWebhookPayload struct {
+	Time   int64        `json:"time"` // Unix time of the scrape
+	Events []leaseEvent `json:"events"`
+}
+
+func newLeaseEvent(typ string, l lease) leaseEvent {
+	return leaseEvent{
+		Type:         typ,
+		MACAddress:   l.macAddress,
+		IPAddress:    l.ipAddress,
+		ComputerName: l.computerName,
+		ClientID:     l.clientId,
+		IAID:         l.iaid,
+		Expiry:       l.expiry,
+	}
+}
+
+// webhookQueueSize is the number of lease event batches which may wait to
+// be POSTed to Config.LeaseWebhook. Further batches are dropped.
+const webhookQueueSize = 16
+
+// startLeaseWebhook starts the goroutine which POSTs the batches queued by
+// notifyLeaseWebhook, so that a slow webhook does not delay scrapes.
+func (c *Collector) startLeaseWebhook() {
+	timeout := c.cfg.LeaseWebhookTimeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	c.webhookClient = &http.Client{Timeout: timeout}
+	c.webhookQueue = make(chan leaseWebhookPayload, webhookQueueSize)
+	go func() {
+		for payload := range c.webhookQueue {
+			if err := c.postLeaseWebhook(payload); err != nil {
+				c.webhookFailures.Inc()
+				log.Printf("could not send %d lease events to the webhook: %v", len(payload.Events), err)
+			}
+		}
+	}()
+}
+
+// notifyLeaseWebhook diffs activeLeases against those of the previous call
+// and queues the added and removed leases to be POSTed to
+// Config.LeaseWebhook. The first call only records the leases. Failures are
+// logged and counted, but do not fail the scrape.
+func (c *Collector) notifyLeaseWebhook(activeLeases []lease) {
+	current := leaseSet(activeLeases)
+	c.mu.Lock()
+	prev := c.webhookLeases
+	c.webhookLeases = current
+	c.mu.Unlock()
+	if prev == nil {
+		return
+	}
+	added, removed := diffLeases(prev, current)
+	if len(added) == 0 && len(removed) == 0 {
+		return
+	}
+	payload := leaseWebhookPayload{Time: c.now().Unix()}
+	for _, l := range added {
+		payload.Events = append(payload.Events, newLeaseEvent("added", l))
+	}
+	for _, l := range removed {
+		payload.Events = append(payload.Events, newLeaseEvent("removed", l))
+	}
+	select {
+	case c.webhookQueue <- payload:
+	default:
+		c.webhookFailures.Inc()
+		log.Printf("could not send %d lease events to the webhook: %d batches are already queued", len(payload.Events), webhookQueueSize)
+	}
+}
+
+func (c *Collector) postLeaseWebhook(payload leaseWebhookPayload) error {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	resp, err := c.webhookClient.Post(c.cfg.LeaseWebhook, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s: unexpected HTTP status %s", c.cfg.LeaseWebhook, resp.Status)
+	}
+	return nil
+}
@@ -16,79 +16,1426 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
 	"flag"
+	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/google/dnsmasq_exporter/collector"
 	"github.com/miekg/dns"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	versioncollector "github.com/prometheus/client_golang/prometheus/collectors/version"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"github.com/prometheus/common/version"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"gopkg.in/yaml.v2"
 )
 
 var (
+	configFile = flag.String("config.file",
+		"",
+		"path to a YAML file whose keys mirror the flags (e.g. listen, dnsmasq, leases_path); flags given on the command line take precedence")
+
 	listen = flag.String("listen",
 		"localhost:9153",
 		"listen address")
 
+	h2cEnabled = flag.Bool("h2c",
+		false,
+		"additionally serve HTTP/2 without TLS (h2c), as required by some service mesh sidecars")
+
+	otelEnabled = flag.Bool("otel",
+		false,
+		"export OpenTelemetry spans of scrapes, stats queries and leases file reads via OTLP/HTTP, configured by the standard OTEL_EXPORTER_OTLP_* environment variables")
+
 	exposeLeases = flag.Bool("expose_leases",
 		false,
 		"expose dnsmasq leases as metrics (high cardinality)")
 
+	leaseExpiryUnit = flag.String("lease_expiry_unit",
+		collector.LeaseExpirySeconds,
+		"unit of dnsmasq_lease_expiry: seconds or milliseconds")
+
+	infiniteLeaseExpiry = flag.Int64("infinite_lease_expiry",
+		0,
+		"if non-zero, the Unix time exposed as dnsmasq_lease_expiry for infinite leases instead of 0 (e.g. 253402300799 for 9999-12-31)")
+
+	leaseChurnWindow = flag.Duration("lease_churn_window",
+		0,
+		"if non-zero, the sliding window (e.g. 15m) over which dnsmasq_leases_churn_per_minute averages the leases added or removed")
+
+	leaseWebhook = flag.String("lease_webhook",
+		"",
+		"if non-empty, a URL to which DHCP leases added or removed since the previous scrape are POSTed as JSON")
+
+	leaseWebhookTimeout = flag.Duration("lease_webhook_timeout",
+		5*time.Second,
+		"timeout for each POST to -lease_webhook")
+
+	minimalMetrics = flag.Bool("minimal_metrics",
+		false,
+		"expose only the dnsmasq and dnsmasq_exporter metrics, without the Go runtime (go_*) and process (process_*) metrics")
+
+	maxConcurrentScrapes = flag.Int("max_concurrent_scrapes",
+		0,
+		"if non-zero, the maximum number of scrapes served concurrently; further scrapes wait up to -scrape_queue_timeout, then fail with 503")
+
+	scrapeQueueTimeout = flag.Duration("scrape_queue_timeout",
+		5*time.Second,
+		"how long a scrape waits for one of the -max_concurrent_scrapes slots")
+
+	authToken = flag.String("auth_token",
+		"",
+		"if non-empty, requests for the metrics and stats must carry an \"Authorization: Bearer <token>\" header with this token")
+
+	peers = flag.String("peers",
+		"",
+		"comma-separated list of other dnsmasq_exporter instances (host:port or metrics URL) whose metrics are summed with the local ones into dnsmasq_cluster_* metrics")
+
+	peersTimeout = flag.Duration("peers_timeout",
+		5*time.Second,
+		"timeout for scraping each of the -peers")
+
+	leasePTRCheck = flag.String("lease_ptr_check",
+		"",
+		"if non-empty, the DNS server (e.g. 127.0.0.1:53) to query for the PTR records of lease IP addresses, exposing dnsmasq_lease_ptr_mismatch")
+
+	leasePTRCheckInterval = flag.Duration("lease_ptr_check_interval",
+		10*time.Minute,
+		"how often to look up the PTR record of each lease IP address with -lease_ptr_check")
+
+	maxLeaseSeries = flag.Int("max_lease_series",
+		0,
+		"do not expose per-lease metrics if there would be more than this many per-lease series, i.e. leases (or twice the leases with dnsmasq_lease_age_seconds_total), 0 means no limit")
+
+	leaseIPInclude = flag.String("lease_ip_include",
+		"",
+		"if non-empty, a comma-separated list of CIDR networks: only leases within them are exposed as per-lease metrics")
+
+	leaseIPExclude = flag.String("lease_ip_exclude",
+		"",
+		"comma-separated list of CIDR networks whose leases are not exposed as per-lease metrics")
+
+	leaseOUIFilter = flag.String("lease_oui_filter",
+		"",
+		"if non-empty, a comma-separated list of OUI prefixes (e.g. 00:1a:11): only leases whose MAC address starts with one of them are exposed as per-lease metrics")
+
+	leaseSampleRatio = flag.Float64("lease_sample_ratio",
+		1,
+		"fraction (0 to 1) of the clients whose leases are exposed as per-lease metrics, selected consistently by a hash of the MAC address")
+
+	vendorPrefixes = flag.String("vendor_from_clientid_prefix",
+		"",
+		"comma-separated list of MAC prefix=vendor pairs (e.g. 00:1a:11=google) by which leases are counted in dnsmasq_leases_by_vendor")
+
+	stripLeaseDomain = flag.String("strip_lease_domain",
+		"",
+		"if non-empty, a domain (e.g. lan) to remove from the end of lease hostnames")
+
+	decodeIDNHostnames = flag.Bool("decode_idn_hostnames",
+		false,
+		"with -expose_leases, expose punycode lease hostnames (xn--...) decoded to Unicode in computer_name, and as-is in computer_name_raw")
+
+	ouiVendors = flag.Bool("oui_vendors",
+		false,
+		"count leases in dnsmasq_leases_by_vendor by the vendor of their MAC address, using a built-in list of common vendors (or -oui_file)")
+
+	ouiFile = flag.String("oui_file",
+		"",
+		"path to the IEEE OUI registry (oui.txt) to use instead of the built-in list of vendors; implies -oui_vendors")
+
+	hostnamePatterns = flag.String("hostname_patterns",
+		"",
+		"comma-separated list of pattern=bucket pairs (e.g. android-*=mobile) by which leases are counted in dnsmasq_leases_matched; the first matching pattern wins")
+
+	expiryWarning = flag.Duration("expiry_warning",
+		0,
+		"if non-zero, count the leases expiring within this duration (e.g. 1h) in dnsmasq_leases_expiring_soon")
+
+	clockSkewThreshold = flag.Float64("clock_skew_threshold",
+		0.5,
+		"fraction of the leases which must appear expired (or, with -dhcp_lease_time, to expire too late) for dnsmasq_clock_skew_suspected to be 1")
+
+	dhcpLeaseTime = flag.Duration("dhcp_lease_time",
+		0,
+		"if non-zero, the lease time configured in dnsmasq (e.g. 12h), used to count leases by lifecycle phase in dnsmasq_leases_lifecycle and, with -expose_leases and -enable_openmetrics, to expose dnsmasq_lease_age_seconds_total")
+
+	timezone = flag.String("timezone",
+		"",
+		"IANA time zone (e.g. Europe/Zurich) determining midnight for dnsmasq_leases_issued_today (default: local time zone)")
+
+	dhcpPoolSize = flag.Int("dhcp_pool_size",
+		0,
+		"if non-zero, the number of addresses available across all DHCP ranges, used to expose dnsmasq_dhcp_pool_utilization")
+
+	dhcpRanges = flag.String("dhcp_ranges",
+		"",
+		"comma-separated list of the DHCP ranges configured in dnsmasq (e.g. 192.168.1.50-192.168.1.150), used to expose dnsmasq_leases_range and dnsmasq_leases_range_high_water")
+
 	leasesPath = flag.String("leases_path",
 		"/var/lib/misc/dnsmasq.leases",
-		"path to the dnsmasq leases file")
+		"path to the dnsmasq leases file, or - to read the leases from stdin")
+
+	leasesFetchCmd = flag.String("leases_fetch_cmd",
+		"",
+		"if non-empty, a shell command which fetches the leases file (e.g. from a remote host via rsync) to the path in $LEASES_PATH; it runs every -leases_fetch_interval and replaces -leases_path")
+
+	leasesFetchInterval = flag.Duration("leases_fetch_interval",
+		time.Minute,
+		"how often to run -leases_fetch_cmd, which is also its timeout")
+
+	leasesGlob = flag.String("leases_glob",
+		"",
+		"if non-empty, a glob pattern of leases files (e.g. rotated backups) to read instead of -leases_path; the most recently modified file wins for duplicate IP addresses")
+
+	maxLeaseLineLength = flag.Int("max_lease_line_length",
+		collector.DefaultMaxLeaseLineLength,
+		"lines in the leases file longer than this many bytes are skipped")
 
 	dnsmasqAddr = flag.String("dnsmasq",
 		"localhost:53",
-		"dnsmasq host:port address")
+		"dnsmasq host:port address, or a comma-separated list of addresses of dnsmasq instances sharing the leases file (their stats metrics are labeled with dnsmasq_addr)")
+	statsSource = flag.String("stats_source",
+		collector.StatsSourceDNS,
+		"where to query stats from: dns (CHAOS TXT records from -dnsmasq) or http (key-value pairs from -stats_url)")
+
+	statsURL = flag.String("stats_url",
+		"",
+		"URL of the HTTP stats page, for -stats_source=http")
+
 	dnsmasqProtocol = flag.String("protocol",
 		"udp",
-		"connect using udp or tcp")
+		"connect using udp, tcp, tcp-tls or auto (udp, repeating queries over tcp whose answer is truncated, times out or is disconnected)")
+	dnsInterface = flag.String("dns_interface",
+		"",
+		"if non-empty, send DNS queries to dnsmasq out of this network interface (Linux only)")
+	dnsTCPKeepAlive = flag.Duration("dns_tcp_keepalive",
+		0,
+		"TCP keep-alive period for connections to dnsmasq with -protocol=tcp (0 uses the Go default of 15s, negative disables keep-alives)")
+	netns = flag.String("netns",
+		"",
+		"if non-empty, path of a network namespace (e.g. /var/run/netns/lan) from which to send DNS queries to dnsmasq (Linux only)")
+	protocolAuto = flag.Bool("protocol_auto",
+		false,
+		"if the first scrape fails over -protocol but dnsmasq answers over the alternate protocol (tcp for udp, udp for tcp), use the alternate protocol from then on")
+	dnsDialTimeout = flag.Duration("dns_dial_timeout",
+		0,
+		"timeout for establishing connections to dnsmasq (0 uses the default of 2s)")
+	dnsReadTimeout = flag.Duration("dns_read_timeout",
+		0,
+		"timeout for reading the answer of each DNS query from dnsmasq (0 uses the default of 2s)")
+	dnsProxyProtocol = flag.Bool("dns_proxy_protocol",
+		false,
+		"send a PROXY protocol v1 header before each DNS query (requires -protocol=tcp)")
+
+	dnsmasqSSH = flag.String("dnsmasq_ssh",
+		"",
+		"if non-empty, user@host[:port] of an SSH server through which to reach dnsmasq: -dnsmasq is dialed over TCP from the SSH server, and -leases_path is read on it")
+
+	dnsmasqSSHKey = flag.String("dnsmasq_ssh_key",
+		"",
+		"path to the private key for -dnsmasq_ssh (by default, the SSH agent is used)")
+
+	dnsmasqSSHKnownHosts = flag.String("dnsmasq_ssh_known_hosts",
+		os.ExpandEnv("$HOME/.ssh/known_hosts"),
+		"path to the known_hosts file to verify the -dnsmasq_ssh host key against")
+
+	statsRetries = flag.Int("stats_retries",
+		0,
+		"number of times a failed stats query is retried within a scrape")
+
+	retryBackoff = flag.Duration("retry_backoff",
+		100*time.Millisecond,
+		"wait before the first retry of a failed stats query, doubled for each further retry")
+
+	retryJitter = flag.Float64("retry_jitter",
+		0.2,
+		"randomize each retry backoff by up to this fraction (0 to 1) in either direction")
+
+	dnsCookies = flag.Bool("dns_cookies",
+		false,
+		"send DNS cookies (RFC 7873) with stats queries and reject responses without a matching cookie (requires server support)")
+
+	splitServerAddr = flag.Bool("split_server_addr",
+		false,
+		"label dnsmasq_servers_* with server_ip and server_port instead of server (e.g. 127.0.0.1#53)")
+
+	serverExtraStats = flag.Bool("server_extra_stats",
+		false,
+		"expose numeric fields which follow the queries and failed queries of upstream servers in servers.bind as dnsmasq_servers_extra_stat")
+
+	serverFilter = flag.String("server_filter",
+		"",
+		"if non-empty, a regular expression: only upstream servers whose address (e.g. 127.0.0.1#53) matches it are exposed in dnsmasq_servers_*")
+
+	extraStatsRecords = flag.String("extra_stats_records",
+		"",
+		"comma-separated list of additional single-value stats DNS records to query, as record.bind.=metric_name[:help]")
+
+	computeRates = flag.Bool("compute_rates",
+		false,
+		"expose dnsmasq_queries_per_second, computed from the hits and misses of consecutive scrapes, for monitoring systems without rate()")
+
+	counterRecords = flag.String("counter_records",
+		"",
+		"comma-separated list of stats DNS records (e.g. hits or hits.bind) whose metrics are exposed as counters (named with a _total suffix, e.g. dnsmasq_hits_total) instead of gauges")
+
+	exportUnknownStats = flag.Bool("export_unknown_stats",
+		false,
+		"expose unknown numeric TXT records in stats answers as dnsmasq_unknown_<record name>")
+
+	failedStats = flag.String("failed_stats",
+		collector.FailedStatsOmit,
+		"what to expose for a stats record whose query failed: omit, nan or last (the last successfully queried value)")
+
+	breakerThreshold = flag.Int("breaker_threshold",
+		0,
+		"if non-zero, stop querying dnsmasq for -breaker_cooldown after this many consecutive failed scrapes, exposing dnsmasq_up 0 instead")
+
+	breakerCooldown = flag.Duration("breaker_cooldown",
+		time.Minute,
+		"how long to stop querying dnsmasq once -breaker_threshold is reached")
+
+	serialCollect = flag.Bool("serial_collect",
+		false,
+		"query the stats and read the leases one after the other instead of concurrently, lowering the peak load on small devices")
+
+	cacheLeases = flag.Bool("cache_leases",
+		false,
+		"parse the leases file only when its size or modification time changed, instead of for every scrape")
+
+	cacheDuration = flag.Duration("cache_duration",
+		0,
+		"if non-zero, serve the metrics of a scrape for this long (e.g. 10s) instead of querying dnsmasq for every scrape")
 
 	metricsPath = flag.String("metrics_path",
 		"/metrics",
 		"path under which metrics are served")
+
+	enableOpenMetrics = flag.Bool("enable_openmetrics",
+		false,
+		"serve metrics in the OpenMetrics format, including the _created timestamps of counters, if the scraper requests it")
+
+	instanceLabel = flag.String("instance_label",
+		"",
+		"if non-empty, a key=value label to add to all dnsmasq metrics, e.g. dnsmasq=office")
+
+	envLabelFromHostname = flag.String("env_label_from_hostname",
+		"",
+		"if non-empty, a regular expression applied to the hostname to derive an env label for all metrics: its first capturing group (or, without groups, the whole match), e.g. ^[a-z]+-(prod|staging)-. Without a match, no env label is added")
+
+	pushGateway = flag.String("push_gateway",
+		"",
+		"if non-empty, URL of a Pushgateway to which the metrics are pushed every -push_interval")
+
+	pushInterval = flag.Duration("push_interval",
+		time.Minute,
+		"interval in which metrics are pushed to -push_gateway")
+
+	textfilePath = flag.String("textfile_path",
+		"",
+		"if non-empty, periodically write the metrics to this file (e.g. for the node_exporter textfile collector); combine with -listen= to not serve HTTP")
+
+	textfileInterval = flag.Duration("textfile_interval",
+		time.Minute,
+		"interval in which metrics are written to -textfile_path")
+
+	failOnStartup = flag.Bool("fail_on_startup",
+		false,
+		"query dnsmasq once on startup and exit if it is unreachable")
+
+	selftest = flag.Bool("selftest",
+		false,
+		"query dnsmasq and read the leases file once, print diagnostics and exit")
+
+	once = flag.Bool("once",
+		false,
+		"print the output selected by -once_format to stdout once and exit instead of serving metrics")
+
+	onceFormat = flag.String("once_format",
+		"json",
+		"what -once prints: json (the parsed leases, e.g. to check parsing with -leases_path=-) or text (the metrics in the Prometheus text format)")
 )
 
+var versionCollector = versioncollector.NewCollector("dnsmasq_exporter")
+
 func init() {
-	prometheus.MustRegister(version.NewCollector("dnsmasq_exporter"))
+	prometheus.MustRegister(versionCollector)
+}
+
+// extraCollectors are registered in addition to the dnsmasq collectors.
+// Vendor builds can expose their own metrics by appending to extraCollectors
+// from an init function in an additional file of this package.
+var extraCollectors []prometheus.Collector
+
+// dnsmasqCollector is a dnsmasq collector and the constant labels to add to
+// its metrics.
+type dnsmasqCollector struct {
+	c      *collector.Collector
+	labels prometheus.Labels
+	addr   string // of the dnsmasq instance whose stats c queries, if any
+}
+
+// addrLabel is the label holding the dnsmasq address with several dnsmasq
+// instances. It is not instance, which Prometheus sets to the scrape target
+// and -push_gateway uses as grouping key.
+const addrLabel = "dnsmasq_addr"
+
+// newCollectors returns the dnsmasq collectors for cfg, whose metrics are
+// labeled with labels.
+//
+// With several dnsmasq instances (a comma-separated cfg.DnsmasqAddr), each one
+// gets a stats-only collector whose metrics are additionally labeled with its
+// address (see addrLabel), and the leases file is read by a separate
+// leases-only collector. An error is returned if any of their configurations
+// is invalid.
+func newCollectors(cfg collector.Config, labels prometheus.Labels) ([]dnsmasqCollector, error) {
+	addrs := strings.Split(cfg.DnsmasqAddr, ",")
+	if len(addrs) == 1 {
+		c, err := collector.NewValidated(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return []dnsmasqCollector{{c, labels, cfg.DnsmasqAddr}}, nil
+	}
+	var collectors []dnsmasqCollector
+	for _, addr := range addrs {
+		statsCfg := cfg
+		statsCfg.DnsmasqAddr = addr
+		statsCfg.LeasesPath = ""
+		statsCfg.LeasesGlob = ""
+		instanceLabels := prometheus.Labels{addrLabel: addr}
+		for k, v := range labels {
+			instanceLabels[k] = v
+		}
+		c, err := collector.NewValidated(statsCfg)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", addr, err)
+		}
+		collectors = append(collectors, dnsmasqCollector{c, instanceLabels, addr})
+	}
+	leasesCfg := cfg
+	leasesCfg.DnsmasqAddr = ""
+	if leasesCfg.LeasesPath == "" && leasesCfg.LeasesGlob == "" {
+		return collectors, nil
+	}
+	c, err := collector.NewValidated(leasesCfg)
+	if err != nil {
+		return nil, err
+	}
+	return append(collectors, dnsmasqCollector{c, labels, ""}), nil
+}
+
+// statsJSON queries the stats of the dnsmasq instances of collectors and
+// returns them for the /stats endpoint: the stats values keyed by record
+// (e.g. "hits") plus the upstream servers under "servers". With several
+// dnsmasq instances, these are keyed by instance address.
+func statsJSON(collectors []dnsmasqCollector) (interface{}, error) {
+	byAddr := make(map[string]interface{})
+	for _, dc := range collectors {
+		if dc.addr == "" {
+			continue
+		}
+		values, servers, err := dc.c.Stats()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", dc.addr, err)
+		}
+		stats := make(map[string]interface{}, len(values)+1)
+		for name, f := range values {
+			stats[name] = f
+		}
+		if servers != nil {
+			stats["servers"] = servers
+		}
+		byAddr[dc.addr] = stats
+	}
+	switch len(byAddr) {
+	case 0:
+		return nil, fmt.Errorf("no dnsmasq address configured")
+	case 1:
+		for _, stats := range byAddr {
+			return stats, nil
+		}
+	}
+	return byAddr, nil
+}
+
+// statsRecordName returns the stats DNS record name for s, which may omit
+// the ".bind." suffix (e.g. "hits" for "hits.bind.").
+func statsRecordName(s string) string {
+	s = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(s)), ".")
+	if !strings.Contains(s, ".") {
+		s += ".bind"
+	}
+	return s + "."
+}
+
+// newTargetInfo returns the dnsmasq_exporter_target_info metric, whose
+// labels are the dnsmasq address and the leases path the exporter uses.
+// Label values must be valid UTF-8, which paths need not be, so invalid
+// bytes are replaced; quotes, backslashes and newlines are escaped when the
+// metric is encoded.
+func newTargetInfo(dnsmasqAddr, leasesPath string) prometheus.Gauge {
+	g := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "dnsmasq_exporter_target_info",
+		Help: "The dnsmasq address and leases path (or glob) which the exporter queries, always 1",
+		ConstLabels: prometheus.Labels{
+			"dnsmasq_addr": strings.ToValidUTF8(dnsmasqAddr, "\uFFFD"),
+			"leases_path":  strings.ToValidUTF8(leasesPath, "\uFFFD"),
+		},
+	})
+	g.Set(1)
+	return g
+}
+
+// scrapesRejected counts the scrapes rejected by limitConcurrency.
+var scrapesRejected = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "dnsmasq_exporter_scrapes_rejected_total",
+	Help: "Number of scrapes rejected with 503 because -max_concurrent_scrapes were in progress for -scrape_queue_timeout",
+})
+
+// limitConcurrency returns a handler which serves at most max requests
+// concurrently with h. Further requests wait for up to timeout, then fail
+// with 503 Service Unavailable. If max is 0, it returns h.
+func limitConcurrency(max int, timeout time.Duration, h http.Handler) http.Handler {
+	if max == 0 {
+		return h
+	}
+	sem := make(chan struct{}, max)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case sem <- struct{}{}:
+		case <-timer.C:
+			scrapesRejected.Inc()
+			http.Error(w, "too many concurrent scrapes", http.StatusServiceUnavailable)
+			return
+		case <-r.Context().Done():
+			return
+		}
+		defer func() { <-sem }()
+		h.ServeHTTP(w, r)
+	})
+}
+
+// requireBearerToken returns a handler which serves requests carrying an
+// "Authorization: Bearer <token>" header with h, and rejects all others with
+// 401 Unauthorized. If token is empty, it returns h.
+func requireBearerToken(token string, h http.Handler) http.Handler {
+	if token == "" {
+		return h
+	}
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(got, want) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="dnsmasq_exporter"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// newExporterRegistry returns the registry for the metrics about the exporter
+// itself: the Go runtime and process metrics, which let operators watch the
+// exporter's resource use on memory-constrained routers, its version, and the
+// extra collectors.
+//
+// Without labels, this is the default registry, which contains the Go and
+// process collectors from the start. The label names of its metrics cannot be
+// changed, so with labels, the collectors are registered in a new registry.
+//
+// If minimal is set, the Go runtime and process metrics are left out.
+func newExporterRegistry(labels prometheus.Labels, minimal bool, extra ...prometheus.Collector) (prometheus.Gatherer, error) {
+	if labels == nil && !minimal {
+		for _, c := range extra {
+			if err := prometheus.Register(c); err != nil {
+				return nil, err
+			}
+		}
+		return prometheus.DefaultGatherer, nil
+	}
+	reg := prometheus.NewRegistry()
+	cs := []prometheus.Collector{versionCollector}
+	if !minimal {
+		cs = append(cs,
+			collectors.NewGoCollector(),
+			collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	}
+	cs = append(cs, extra...)
+	for _, c := range cs {
+		if err := prometheus.WrapRegistererWith(labels, reg).Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return reg, nil
+}
+
+// newRegistry returns a registry with the dnsmasq collectors and the extra
+// collectors registered. The metrics of the extra collectors are labeled with
+// extraLabels.
+func newRegistry(collectors []dnsmasqCollector, extraLabels prometheus.Labels, extra ...prometheus.Collector) (*prometheus.Registry, error) {
+	reg := prometheus.NewRegistry()
+	for _, dc := range collectors {
+		if err := prometheus.WrapRegistererWith(dc.labels, reg).Register(dc.c); err != nil {
+			return nil, err
+		}
+	}
+	for _, c := range extra {
+		if err := prometheus.WrapRegistererWith(extraLabels, reg).Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return reg, nil
+}
+
+// envFromHostname returns the env label value which re matches in hostname:
+// its first capturing group or, if it has none, the whole match.
+func envFromHostname(re *regexp.Regexp, hostname string) (string, bool) {
+	m := re.FindStringSubmatch(hostname)
+	if m == nil {
+		return "", false
+	}
+	if len(m) > 1 {
+		return m[1], m[1] != ""
+	}
+	return m[0], m[0] != ""
+}
+
+// parseLabel parses a key=value label.
+func parseLabel(s string) (prometheus.Labels, error) {
+	idx := strings.Index(s, "=")
+	if idx == -1 {
+		return nil, fmt.Errorf("%q is not of the form key=value", s)
+	}
+	key, value := s[:idx], s[idx+1:]
+	if !model.LabelName(key).IsValidLegacy() {
+		return nil, fmt.Errorf("%q is not a valid label name", key)
+	}
+	if key == "instance" || key == addrLabel {
+		return nil, fmt.Errorf("%q is reserved", key)
+	}
+	return prometheus.Labels{key: value}, nil
+}
+
+// parseMap parses a comma-separated list of key=value pairs.
+func parseMap(s string) (map[string]string, error) {
+	m := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+		idx := strings.Index(kv, "=")
+		if idx == -1 {
+			return nil, fmt.Errorf("%q is not of the form key=value", kv)
+		}
+		m[kv[:idx]] = kv[idx+1:]
+	}
+	return m, nil
+}
+
+// parseStatsRecords parses a comma-separated list of
+// record.bind.=metric_name[:help] stats record definitions.
+func parseStatsRecords(s string) ([]collector.StatsRecord, error) {
+	m, err := parseMap(s)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var records []collector.StatsRecord
+	for _, name := range names {
+		metric := m[name]
+		help := "dnsmasq stats DNS record " + name
+		if idx := strings.Index(metric, ":"); idx > -1 {
+			metric, help = metric[:idx], metric[idx+1:]
+		}
+		if !model.IsValidLegacyMetricName(metric) {
+			return nil, fmt.Errorf("%q is not a valid metric name", metric)
+		}
+		records = append(records, collector.StatsRecord{
+			Name:   name,
+			Metric: metric,
+			Help:   help,
+		})
+	}
+	return records, nil
+}
+
+// parseHostnamePatterns parses a comma-separated list of pattern=bucket pairs,
+// preserving their order.
+func parseHostnamePatterns(s string) ([]collector.HostnamePattern, error) {
+	var patterns []collector.HostnamePattern
+	for _, kv := range strings.Split(s, ",") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+		idx := strings.LastIndex(kv, "=")
+		if idx == -1 {
+			return nil, fmt.Errorf("%q is not of the form pattern=bucket", kv)
+		}
+		pattern := kv[:idx]
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("%q: %v", pattern, err)
+		}
+		patterns = append(patterns, collector.HostnamePattern{
+			Pattern: pattern,
+			Bucket:  kv[idx+1:],
+		})
+	}
+	return patterns, nil
+}
+
+// parseCIDRs parses a comma-separated list of CIDR networks.
+func parseCIDRs(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, cidr := range strings.Split(s, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// newDNSClient returns a client for querying dnsmasq over network. Note that
+// if the Dialer of the returned client is set, its Timeout takes precedence
+// over dialTimeout. A zero readTimeout uses the dns.Client default.
+func newDNSClient(network string, dialTimeout, readTimeout time.Duration) *dns.Client {
+	return &dns.Client{
+		SingleInflight: true,
+		Net:            network,
+		DialTimeout:    dialTimeout,
+		ReadTimeout:    readTimeout,
+	}
+}
+
+// newDNSDialer returns the dialer for querying dnsmasq, or nil if the
+// dns.Client default suffices. A non-empty iface binds sockets to that
+// interface, and keepAlive sets the TCP keep-alive period.
+func newDNSDialer(iface string, dialTimeout, keepAlive time.Duration) (*net.Dialer, error) {
+	if iface == "" && keepAlive == 0 {
+		return nil, nil
+	}
+	dialer := &net.Dialer{
+		Timeout:   dialTimeout,
+		KeepAlive: keepAlive,
+	}
+	if iface != "" {
+		control, err := bindToDevice(iface)
+		if err != nil {
+			return nil, err
+		}
+		dialer.Control = control
+	}
+	return dialer, nil
+}
+
+// withH2C wraps h so that it serves HTTP/2 to clients which use prior
+// knowledge or upgrade from HTTP/1.1 (h2c), and HTTP/1.1 to all others.
+func withH2C(h http.Handler) http.Handler {
+	return h2c.NewHandler(h, &http2.Server{})
+}
+
+// parseDhcpRanges parses a comma-separated list of start-end address ranges.
+func parseDhcpRanges(s string) ([]collector.DhcpRange, error) {
+	var ranges []collector.DhcpRange
+	for _, r := range strings.Split(s, ",") {
+		r = strings.TrimSpace(r)
+		if r == "" {
+			continue
+		}
+		idx := strings.Index(r, "-")
+		if idx == -1 {
+			return nil, fmt.Errorf("%q is not of the form start-end", r)
+		}
+		start, end := net.ParseIP(r[:idx]), net.ParseIP(r[idx+1:])
+		if start == nil || end == nil {
+			return nil, fmt.Errorf("%q: invalid IP address", r)
+		}
+		if (start.To4() == nil) != (end.To4() == nil) {
+			return nil, fmt.Errorf("%q: start and end are of different address families", r)
+		}
+		ranges = append(ranges, collector.DhcpRange{Start: start, End: end})
+	}
+	return ranges, nil
+}
+
+// applyConfigFile sets the flags of fs which were not set on the command line
+// from the YAML file at path, whose keys are flag names. Lists are joined with
+// commas, as the list-valued flags expect.
+func applyConfigFile(fs *flag.FlagSet, path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var values map[string]interface{}
+	if err := yaml.UnmarshalStrict(b, &values); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	for name, value := range values {
+		if fs.Lookup(name) == nil {
+			return fmt.Errorf("%s: unknown flag %q", path, name)
+		}
+		if set[name] {
+			continue
+		}
+		var s string
+		switch v := value.(type) {
+		case []interface{}:
+			elems := make([]string, len(v))
+			for i, e := range v {
+				elems[i] = fmt.Sprint(e)
+			}
+			s = strings.Join(elems, ",")
+		case nil:
+			s = ""
+		default:
+			s = fmt.Sprint(v)
+		}
+		if err := fs.Set(name, s); err != nil {
+			return fmt.Errorf("%s: %s: %v", path, name, err)
+		}
+	}
+	return nil
+}
+
+// secretFlags are the flags whose values may be or contain credentials (or
+// reveal where they are stored), e.g. in URL user info. configHash leaves
+// them out so that the published hash cannot be used to guess them.
+var secretFlags = map[string]bool{
+	"auth_token":              true,
+	"dnsmasq_ssh_key":         true,
+	"dnsmasq_ssh_known_hosts": true,
+	"lease_webhook":           true,
+	"leases_fetch_cmd":        true,
+	"push_gateway":            true,
+	"stats_url":               true,
+}
+
+// configHash returns a hash of the values of all flags of fs except
+// secretFlags, which is stable across runs with the same effective
+// configuration.
+func configHash(fs *flag.FlagSet) string {
+	h := sha256.New()
+	// VisitAll visits the flags in lexicographical order.
+	fs.VisitAll(func(f *flag.Flag) {
+		if secretFlags[f.Name] {
+			return
+		}
+		fmt.Fprintf(h, "%s=%q\n", f.Name, f.Value.String())
+	})
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// writeLeasesJSON writes the leases parsed by the leases collector of
+// collectors (the last one, see newCollectors) to w as JSON.
+func writeLeasesJSON(w io.Writer, collectors []dnsmasqCollector) error {
+	leases, err := collectors[len(collectors)-1].c.Leases()
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(leases)
+}
+
+// writeMetrics writes the metrics gathered from g to w in the Prometheus text
+// format.
+func writeMetrics(w io.Writer, g prometheus.Gatherer) error {
+	mfs, err := g.Gather()
+	if err != nil {
+		return err
+	}
+	enc := expfmt.NewEncoder(w, expfmt.NewFormat(expfmt.TypeTextPlain))
+	for _, mf := range mfs {
+		if err := enc.Encode(mf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeMetricsTable writes the metrics gathered from g to w as an aligned
+// table of name, labels and value, meant for reading by humans. Histograms
+// and summaries are shown as their _sum and _count.
+func writeMetricsTable(w io.Writer, g prometheus.Gatherer) error {
+	mfs, err := g.Gather()
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tLABELS\tVALUE")
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			var labels []string
+			for _, lp := range m.GetLabel() {
+				labels = append(labels, fmt.Sprintf("%s=%q", lp.GetName(), lp.GetValue()))
+			}
+			row := func(name string, value float64) {
+				fmt.Fprintf(tw, "%s\t%s\t%s\n", name, strings.Join(labels, ","), strconv.FormatFloat(value, 'g', -1, 64))
+			}
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				row(mf.GetName(), m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				row(mf.GetName(), m.GetGauge().GetValue())
+			case dto.MetricType_SUMMARY:
+				row(mf.GetName()+"_sum", m.GetSummary().GetSampleSum())
+				row(mf.GetName()+"_count", float64(m.GetSummary().GetSampleCount()))
+			case dto.MetricType_HISTOGRAM:
+				row(mf.GetName()+"_sum", m.GetHistogram().GetSampleSum())
+				row(mf.GetName()+"_count", float64(m.GetHistogram().GetSampleCount()))
+			default:
+				row(mf.GetName(), m.GetUntyped().GetValue())
+			}
+		}
+	}
+	return tw.Flush()
+}
+
+// writeTextfile writes the metrics gathered from g to path every interval.
+// Each write replaces the file atomically.
+func writeTextfile(path string, g prometheus.Gatherer, interval time.Duration) {
+	for {
+		if err := prometheus.WriteToTextfile(path, g); err != nil {
+			log.Printf("could not write metrics to %s: %v", path, err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// newPusher returns a Pusher which pushes the metrics gathered from g to the
+// Pushgateway at url, grouped by job dnsmasq and instance hostname.
+func newPusher(url, hostname string, g prometheus.Gatherer) *push.Pusher {
+	return push.New(url, "dnsmasq").
+		Gatherer(g).
+		Grouping("instance", hostname)
+}
+
+// pushMetrics pushes the metrics every interval.
+func pushMetrics(p *push.Pusher, interval time.Duration) {
+	for {
+		if err := p.Push(); err != nil {
+			log.Printf("could not push metrics: %v", err)
+		}
+		time.Sleep(interval)
+	}
 }
 
 func main() {
 	flag.Parse()
+	if *configFile != "" {
+		if err := applyConfigFile(flag.CommandLine, *configFile); err != nil {
+			log.Fatalf("could not load -config.file: %v", err)
+		}
+	}
+
+	switch *failedStats {
+	case collector.FailedStatsOmit, collector.FailedStatsNaN, collector.FailedStatsLast:
+	default:
+		log.Fatalf("invalid -failed_stats value %q: must be one of omit, nan or last", *failedStats)
+	}
+
+	switch *leaseExpiryUnit {
+	case collector.LeaseExpirySeconds, collector.LeaseExpiryMilliseconds:
+	default:
+		log.Fatalf("invalid -lease_expiry_unit value %q: must be seconds or milliseconds", *leaseExpiryUnit)
+	}
 
-	var (
-		dnsClient = &dns.Client{
-			SingleInflight: true,
-			Net:            *dnsmasqProtocol,
+	switch *statsSource {
+	case collector.StatsSourceDNS:
+	case collector.StatsSourceHTTP:
+		if *statsURL == "" {
+			log.Fatal("-stats_source=http requires -stats_url")
 		}
-		cfg = collector.Config{
-			DnsClient:    dnsClient,
-			DnsmasqAddr:  *dnsmasqAddr,
-			LeasesPath:   *leasesPath,
-			ExposeLeases: *exposeLeases,
+	default:
+		log.Fatalf("invalid -stats_source value %q: must be dns or http", *statsSource)
+	}
+
+	if *leaseSampleRatio < 0 || *leaseSampleRatio > 1 {
+		log.Fatalf("invalid -lease_sample_ratio value %v: must be between 0 and 1", *leaseSampleRatio)
+	}
+
+	if *retryJitter < 0 || *retryJitter > 1 {
+		log.Fatalf("invalid -retry_jitter value %v: must be between 0 and 1", *retryJitter)
+	}
+
+	if *maxConcurrentScrapes < 0 {
+		log.Fatalf("invalid -max_concurrent_scrapes value %d: must not be negative", *maxConcurrentScrapes)
+	}
+
+	if *clockSkewThreshold <= 0 || *clockSkewThreshold > 1 {
+		log.Fatalf("invalid -clock_skew_threshold value %v: must be greater than 0 and at most 1", *clockSkewThreshold)
+	}
+
+	if *dnsDialTimeout < 0 {
+		log.Fatalf("invalid -dns_dial_timeout value %v: must not be negative", *dnsDialTimeout)
+	}
+	if *dnsReadTimeout < 0 {
+		log.Fatalf("invalid -dns_read_timeout value %v: must not be negative", *dnsReadTimeout)
+	}
+	dialTimeout := 2 * time.Second // same as the dns.Client default
+	if *dnsDialTimeout > 0 {
+		dialTimeout = *dnsDialTimeout
+	}
+	readTimeout := 2 * time.Second
+	if *dnsReadTimeout > 0 {
+		readTimeout = *dnsReadTimeout
+	}
+
+	network := *dnsmasqProtocol
+	if network == "auto" {
+		network = "udp"
+	}
+	dnsClient := newDNSClient(network, dialTimeout, *dnsReadTimeout)
+	dialer, err := newDNSDialer(*dnsInterface, dialTimeout, *dnsTCPKeepAlive)
+	if err != nil {
+		log.Fatal(err)
+	}
+	dnsClient.Dialer = dialer
+
+	var exchanger collector.Exchanger = dnsClient
+	if *dnsProxyProtocol {
+		if *dnsmasqProtocol != "tcp" {
+			log.Fatal("-dns_proxy_protocol requires -protocol=tcp")
+		}
+		dialer := dnsClient.Dialer
+		if dialer == nil {
+			dialer = &net.Dialer{Timeout: dialTimeout}
+		}
+		exchanger = &proxyProtocolClient{dialer: dialer, readTimeout: readTimeout}
+	}
+	if *netns != "" {
+		if *dnsProxyProtocol {
+			log.Fatal("-netns cannot be combined with -dns_proxy_protocol")
+		}
+		var err error
+		exchanger, err = newNetnsClient(dnsClient, *netns)
+		if err != nil {
+			log.Fatalf("invalid -netns: %v", err)
+		}
+	}
+	// The alternate protocol is probed if the first scrape fails, which is
+	// not applicable to PROXY protocol (TCP only), SSH (see below) or HTTP
+	// stats.
+	var fallbackClient collector.Exchanger
+	var fallbackProtocol string
+	if (*dnsmasqProtocol == "udp" || *dnsmasqProtocol == "tcp" || *dnsmasqProtocol == "auto") && !*dnsProxyProtocol && *dnsmasqSSH == "" && *statsSource != collector.StatsSourceHTTP {
+		fallbackProtocol = "tcp"
+		if *dnsmasqProtocol == "tcp" {
+			fallbackProtocol = "udp"
+		}
+		fallback := newDNSClient(fallbackProtocol, dialTimeout, *dnsReadTimeout)
+		fallback.Dialer = dnsClient.Dialer
+		fallbackClient = fallback
+		if *netns != "" {
+			var err error
+			fallbackClient, err = newNetnsClient(fallback, *netns)
+			if err != nil {
+				log.Fatalf("invalid -netns: %v", err)
+			}
+		}
+	}
+	if *protocolAuto && (fallbackClient == nil || *dnsmasqProtocol == "auto") {
+		log.Fatal("-protocol_auto requires -protocol=udp or -protocol=tcp, and cannot be combined with -dns_proxy_protocol, -dnsmasq_ssh or -stats_source=http")
+	}
+	protocol := *dnsmasqProtocol
+	var openLeases func(string) (io.ReadCloser, error)
+	if *dnsmasqSSH != "" {
+		if *dnsProxyProtocol || *dnsInterface != "" || *netns != "" || *leasesGlob != "" {
+			log.Fatal("-dnsmasq_ssh cannot be combined with -dns_proxy_protocol, -dns_interface, -netns or -leases_glob")
+		}
+		tunnel, err := newSSHTunnel(*dnsmasqSSH, *dnsmasqSSHKey, *dnsmasqSSHKnownHosts, dialTimeout, readTimeout)
+		if err != nil {
+			log.Fatalf("invalid -dnsmasq_ssh: %v", err)
+		}
+		exchanger = tunnel
+		openLeases = tunnel.OpenLeases
+		protocol = "tcp"
+	}
+
+	if *leasesPath == "-" && !*once {
+		log.Fatal("-leases_path=- requires -once")
+	}
+	if *once && *onceFormat != "json" && *onceFormat != "text" {
+		log.Fatalf("invalid -once_format value %q: must be json or text", *onceFormat)
+	}
+
+	leasesFile := *leasesPath
+	var fetcher *leasesFetcher
+	if *leasesFetchCmd != "" {
+		if *dnsmasqSSH != "" || *leasesGlob != "" {
+			log.Fatal("-leases_fetch_cmd cannot be combined with -dnsmasq_ssh or -leases_glob")
+		}
+		if *leasesFetchInterval <= 0 {
+			log.Fatalf("invalid -leases_fetch_interval value %v: must be positive", *leasesFetchInterval)
+		}
+		var err error
+		fetcher, err = newLeasesFetcher(*leasesFetchCmd)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := fetcher.fetch(*leasesFetchInterval); err != nil {
+			fetcher.failures.Inc()
+			log.Printf("could not fetch the leases file: %v", err)
+		}
+		leasesFile = fetcher.path
+	}
+
+	location := time.Local
+	if *timezone != "" {
+		var err error
+		location, err = time.LoadLocation(*timezone)
+		if err != nil {
+			log.Fatalf("invalid -timezone: %v", err)
+		}
+	}
+
+	var serverFilterRE *regexp.Regexp
+	if *serverFilter != "" {
+		var err error
+		serverFilterRE, err = regexp.Compile(*serverFilter)
+		if err != nil {
+			log.Fatalf("invalid -server_filter: %v", err)
+		}
+	}
+
+	include, err := parseCIDRs(*leaseIPInclude)
+	if err != nil {
+		log.Fatalf("invalid -lease_ip_include: %v", err)
+	}
+	exclude, err := parseCIDRs(*leaseIPExclude)
+	if err != nil {
+		log.Fatalf("invalid -lease_ip_exclude: %v", err)
+	}
+
+	ranges, err := parseDhcpRanges(*dhcpRanges)
+	if err != nil {
+		log.Fatalf("invalid -dhcp_ranges: %v", err)
+	}
+
+	var ouis []string
+	if *leaseOUIFilter != "" {
+		ouis = strings.Split(*leaseOUIFilter, ",")
+	}
+
+	vendors, err := parseMap(*vendorPrefixes)
+	if err != nil {
+		log.Fatalf("invalid -vendor_from_clientid_prefix: %v", err)
+	}
+
+	var ouiVendorMap map[string]string
+	if *ouiFile != "" {
+		f, err := os.Open(*ouiFile)
+		if err != nil {
+			log.Fatalf("invalid -oui_file: %v", err)
+		}
+		ouiVendorMap, err = collector.ParseOUIFile(f)
+		f.Close()
+		if err != nil {
+			log.Fatalf("invalid -oui_file: %v", err)
+		}
+	} else if *ouiVendors {
+		ouiVendorMap = collector.DefaultOUIVendors
+	}
+
+	patterns, err := parseHostnamePatterns(*hostnamePatterns)
+	if err != nil {
+		log.Fatalf("invalid -hostname_patterns: %v", err)
+	}
+
+	extraRecords, err := parseStatsRecords(*extraStatsRecords)
+	if err != nil {
+		log.Fatalf("invalid -extra_stats_records: %v", err)
+	}
+
+	var counters []string
+	if *counterRecords != "" {
+		for _, r := range strings.Split(*counterRecords, ",") {
+			counters = append(counters, statsRecordName(r))
+		}
+	}
+
+	addr := *dnsmasqAddr
+	if *statsSource == collector.StatsSourceHTTP {
+		addr = *statsURL
+		protocol = "http"
+	}
+
+	var tracer collector.Tracer
+	shutdownTracing := func(context.Context) error { return nil }
+	if *otelEnabled {
+		t, shutdown, err := newOTLPTracer(context.Background())
+		if err != nil {
+			log.Fatalf("could not set up OpenTelemetry tracing: %v", err)
+		}
+		tracer = t
+		shutdownTracing = shutdown
+	}
+
+	cfg := collector.Config{
+		Tracer:              tracer,
+		DnsClient:           exchanger,
+		DnsmasqAddr:         addr,
+		LeasesPath:          leasesFile,
+		ExposeLeases:        *exposeLeases,
+		MaxLeaseSeries:      *maxLeaseSeries,
+		FailedStats:         *failedStats,
+		ExtraStatsRecords:   extraRecords,
+		CounterRecords:      counters,
+		ComputeRates:        *computeRates,
+		ExpiryWarning:       *expiryWarning,
+		MaxLeaseLineLength:  *maxLeaseLineLength,
+		LeaseIPInclude:      include,
+		LeaseIPExclude:      exclude,
+		LeaseOUIFilter:      ouis,
+		LeaseSampleRatio:    *leaseSampleRatio,
+		SerialCollect:       *serialCollect,
+		InfiniteLeaseExpiry: *infiniteLeaseExpiry,
+		LeaseChurnWindow:    *leaseChurnWindow,
+		LeaseWebhook:        *leaseWebhook,
+		LeaseWebhookTimeout: *leaseWebhookTimeout,
+		PTRCheckAddr:        *leasePTRCheck,
+		PTRCheckInterval:    *leasePTRCheckInterval,
+		VendorPrefixes:      vendors,
+		OUIVendors:          ouiVendorMap,
+		LeaseExpiryUnit:     *leaseExpiryUnit,
+		HostnamePatterns:    patterns,
+		LeasesGlob:          *leasesGlob,
+		StripLeaseDomain:    *stripLeaseDomain,
+		ExportUnknownStats:  *exportUnknownStats,
+		DecodeIDNHostnames:  *decodeIDNHostnames,
+		DnsCookies:          *dnsCookies,
+		StatsRetries:        *statsRetries,
+		RetryBackoff:        *retryBackoff,
+		RetryJitter:         *retryJitter,
+		OpenLeases:          openLeases,
+		Protocol:            protocol,
+		FallbackClient:      fallbackClient,
+		FallbackProtocol:    fallbackProtocol,
+		ProtocolAuto:        *protocolAuto,
+		StatsSource:         *statsSource,
+		StatsHTTPTimeout:    dialTimeout + readTimeout,
+		DhcpLeaseTime:       *dhcpLeaseTime,
+		OpenMetrics:         *enableOpenMetrics,
+		ClockSkewThreshold:  *clockSkewThreshold,
+		CacheDuration:       *cacheDuration,
+		CacheLeases:         *cacheLeases,
+		DhcpPoolSize:        *dhcpPoolSize,
+		DhcpRanges:          ranges,
+		BreakerThreshold:    *breakerThreshold,
+		BreakerCooldown:     *breakerCooldown,
+		Location:            location,
+		ServerFilter:        serverFilterRE,
+		SplitServerAddr:     *splitServerAddr,
+		ServerExtraStats:    *serverExtraStats,
+	}
+
+	var labels prometheus.Labels
+	if *instanceLabel != "" {
+		labels, err = parseLabel(*instanceLabel)
+		if err != nil {
+			log.Fatalf("invalid -instance_label: %v", err)
+		}
+	}
+	var envLabels prometheus.Labels
+	if *envLabelFromHostname != "" {
+		re, err := regexp.Compile(*envLabelFromHostname)
+		if err != nil {
+			log.Fatalf("invalid -env_label_from_hostname: %v", err)
+		}
+		hostname, err := os.Hostname()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if env, ok := envFromHostname(re, hostname); ok {
+			envLabels = prometheus.Labels{"env": env}
+			if labels == nil {
+				labels = make(prometheus.Labels)
+			}
+			labels["env"] = env
+		} else {
+			log.Printf("-env_label_from_hostname does not match hostname %q, not adding an env label", hostname)
+		}
+	}
+	collectors, err := newCollectors(cfg, labels)
+	if err != nil {
+		log.Fatalf("invalid configuration: %v", err)
+	}
+
+	if *selftest {
+		failed := false
+		for _, dc := range collectors {
+			if err := dc.c.SelfTest(os.Stdout); err != nil {
+				log.Print(err)
+				failed = true
+			}
+		}
+		if failed {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *failOnStartup {
+		for _, dc := range collectors {
+			if err := dc.c.Ping(); err != nil {
+				log.Fatalf("dnsmasq is unreachable: %v", err)
+			}
+		}
+	}
+
+	configInfo := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name:        "dnsmasq_exporter_config_info",
+		Help:        "Hash of the effective configuration (flag values, except for secrets), always 1",
+		ConstLabels: prometheus.Labels{"hash": configHash(flag.CommandLine)},
+	})
+	configInfo.Set(1)
+	targetLeasesPath := leasesFile
+	if *leasesGlob != "" {
+		targetLeasesPath = *leasesGlob
+	}
+	exporterCollectors := []prometheus.Collector{configInfo, newTargetInfo(addr, targetLeasesPath)}
+	if *maxConcurrentScrapes > 0 {
+		exporterCollectors = append(exporterCollectors, scrapesRejected)
+	}
+	if fetcher != nil {
+		exporterCollectors = append(exporterCollectors, fetcher.failures)
+	}
+	defaultGatherer, err := newExporterRegistry(envLabels, *minimalMetrics, exporterCollectors...)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	reg, err := newRegistry(collectors, envLabels, extraCollectors...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// localGatherers exclude the cluster metrics, see peerHeader.
+	localGatherers := prometheus.Gatherers{defaultGatherer, reg}
+	gatherers := localGatherers
+	if *peers != "" {
+		// The cluster collector gathers reg, so it cannot be registered there.
+		clusterReg := prometheus.NewRegistry()
+		cc := newClusterCollector(reg, strings.Split(*peers, ","), *peersTimeout, *authToken)
+		if err := prometheus.WrapRegistererWith(envLabels, clusterReg).Register(cc); err != nil {
+			log.Fatal(err)
+		}
+		gatherers = prometheus.Gatherers{defaultGatherer, reg, clusterReg}
+	}
+
+	if *once {
+		var err error
+		if *onceFormat == "json" {
+			err = writeLeasesJSON(os.Stdout, collectors)
+		} else {
+			err = writeMetrics(os.Stdout, gatherers)
+		}
+		if terr := shutdownTracing(context.Background()); terr != nil {
+			log.Printf("could not export OpenTelemetry spans: %v", terr)
 		}
-		collector = collector.New(cfg)
-		reg       = prometheus.NewRegistry()
-	)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if fetcher != nil {
+		go fetcher.run(*leasesFetchInterval)
+	}
+
+	if *pushGateway != "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			log.Fatal(err)
+		}
+		go pushMetrics(newPusher(*pushGateway, hostname, gatherers), *pushInterval)
+	}
 
-	reg.MustRegister(collector)
+	if *textfilePath != "" {
+		if *listen == "" {
+			// Only write the textfile, without serving the metrics.
+			writeTextfile(*textfilePath, gatherers, *textfileInterval)
+			return
+		}
+		go writeTextfile(*textfilePath, gatherers, *textfileInterval)
+	}
 
-	http.Handle(*metricsPath, promhttp.HandlerFor(
-		prometheus.Gatherers{prometheus.DefaultGatherer, reg},
-		promhttp.HandlerOpts{},
-	))
+	handlerOpts := promhttp.HandlerOpts{
+		EnableOpenMetrics:                   *enableOpenMetrics,
+		EnableOpenMetricsTextCreatedSamples: *enableOpenMetrics,
+	}
+	metricsHandler := peerAwareHandler(
+		promhttp.HandlerFor(localGatherers, handlerOpts),
+		promhttp.HandlerFor(gatherers, handlerOpts))
+	http.Handle(*metricsPath, requireBearerToken(*authToken, limitConcurrency(*maxConcurrentScrapes, *scrapeQueueTimeout, metricsHandler)))
+	http.Handle("/debug/metrics", requireBearerToken(*authToken, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if err := writeMetricsTable(w, gatherers); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})))
+	http.Handle("/stats", requireBearerToken(*authToken, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stats, err := statsJSON(collectors)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(stats); err != nil {
+			log.Printf("could not write stats: %v", err)
+		}
+	})))
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(`<html>
       <head><title>Dnsmasq Exporter</title></head>
       <body>
       <h1>Dnsmasq Exporter</h1>
       <p><a href="` + *metricsPath + `">Metrics</a></p>
+      <p><a href="/debug/metrics">Metrics (human-readable)</a></p>
+      <p><a href="/stats">Stats (JSON)</a></p>
       </body></html>`))
 	})
 	log.Println("Listening on", *listen)
 	log.Println("Service metrics under", *metricsPath)
-	log.Fatal(http.ListenAndServe(*listen, nil))
+	var handler http.Handler = http.DefaultServeMux
+	if *h2cEnabled {
+		handler = withH2C(handler)
+	}
+	log.Fatal(http.ListenAndServe(*listen, handler))
 }
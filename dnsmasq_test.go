@@ -0,0 +1,808 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/dnsmasq_exporter/collector"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"golang.org/x/net/http2"
+)
+
+func TestParseLabel(t *testing.T) {
+	for _, tt := range []struct {
+		in      string
+		key     string
+		value   string
+		wantErr bool
+	}{
+		{in: "dnsmasq=office", key: "dnsmasq", value: "office"},
+		{in: "dnsmasq=a=b", key: "dnsmasq", value: "a=b"},
+		{in: "dnsmasq=", key: "dnsmasq", value: ""},
+		{in: "dnsmasq", wantErr: true},
+		{in: "1nvalid=x", wantErr: true},
+		{in: "instance=x", wantErr: true},
+		{in: "dnsmasq_addr=x", wantErr: true},
+	} {
+		labels, err := parseLabel(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseLabel(%q): unexpectedly succeeded", tt.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseLabel(%q): %v", tt.in, err)
+			continue
+		}
+		if got, want := len(labels), 1; got != want {
+			t.Errorf("parseLabel(%q): got %d labels, want %d", tt.in, got, want)
+		}
+		if got, want := labels[tt.key], tt.value; got != want {
+			t.Errorf("parseLabel(%q)[%q]: got %q, want %q", tt.in, tt.key, got, want)
+		}
+	}
+}
+
+func TestParseMap(t *testing.T) {
+	got, err := parseMap("00:1a:11=google, aa:bb:cc=a=b,,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"00:1a:11": "google",
+		"aa:bb:cc": "a=b",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseMap: got %v, want %v", got, want)
+	}
+	if _, err := parseMap("novalue"); err == nil {
+		t.Errorf("parseMap(%q): unexpectedly succeeded", "novalue")
+	}
+}
+
+func TestParseDhcpRanges(t *testing.T) {
+	got, err := parseDhcpRanges("192.168.1.50-192.168.1.150, 2001:db8::10-2001:db8::ff,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []collector.DhcpRange{
+		{Start: net.ParseIP("192.168.1.50"), End: net.ParseIP("192.168.1.150")},
+		{Start: net.ParseIP("2001:db8::10"), End: net.ParseIP("2001:db8::ff")},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseDhcpRanges: got %v, want %v", got, want)
+	}
+	for _, s := range []string{"192.168.1.50", "192.168.1.50-foo", "192.168.1.50-2001:db8::ff"} {
+		if _, err := parseDhcpRanges(s); err == nil {
+			t.Errorf("parseDhcpRanges(%q): unexpectedly succeeded", s)
+		}
+	}
+}
+
+func TestEnvFromHostname(t *testing.T) {
+	for _, tt := range []struct {
+		pattern  string
+		hostname string
+		env      string
+		ok       bool
+	}{
+		{`^[a-z]+-(prod|staging)-`, "router-prod-01", "prod", true},
+		{`^[a-z]+-(prod|staging)-`, "router-dev-01", "", false},
+		{`prod|staging`, "staging-router", "staging", true},
+		{`^[a-z]+-(prod)?-`, "router--01", "", false},
+	} {
+		env, ok := envFromHostname(regexp.MustCompile(tt.pattern), tt.hostname)
+		if env != tt.env || ok != tt.ok {
+			t.Errorf("envFromHostname(%q, %q) = %q, %v, want %q, %v", tt.pattern, tt.hostname, env, ok, tt.env, tt.ok)
+		}
+	}
+}
+
+func TestNewRegistry(t *testing.T) {
+	extra := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "vendor_extra",
+		Help: "extra collector",
+	})
+	extra.Set(42)
+	collectors, err := newCollectors(collector.Config{
+		DnsClient:   &dns.Client{},
+		DnsmasqAddr: "localhost:1,localhost:2",
+		LeasesPath:  "collector/testdata/dnsmasq.leases",
+	}, prometheus.Labels{"dnsmasq": "office"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(collectors), 3; got != want {
+		t.Fatalf("unexpected number of collectors: got %d, want %d", got, want)
+	}
+	for i, addr := range []string{"localhost:1", "localhost:2"} {
+		want := prometheus.Labels{"dnsmasq": "office", "dnsmasq_addr": addr}
+		if got := collectors[i].labels; !reflect.DeepEqual(got, want) {
+			t.Errorf("collector %d: got labels %v, want %v", i, got, want)
+		}
+	}
+
+	// Only register the leases-only collector to not query dnsmasq.
+	reg, err := newRegistry(collectors[2:], nil, extra)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]bool)
+	for _, mf := range mfs {
+		got[mf.GetName()] = true
+	}
+	for _, name := range []string{"dnsmasq_leases", "vendor_extra"} {
+		if !got[name] {
+			t.Errorf("metric %q not gathered", name)
+		}
+	}
+}
+
+func TestWriteMetricsTable(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	g := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "dnsmasq_test",
+		Help: "test",
+	}, []string{"server"})
+	g.WithLabelValues("b").Set(2)
+	g.WithLabelValues("a").Set(1.5)
+	reg.MustRegister(g)
+	reg.MustRegister(prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "dnsmasq_a_total",
+		Help: "test",
+	}))
+
+	var buf strings.Builder
+	if err := writeMetricsTable(&buf, reg); err != nil {
+		t.Fatal(err)
+	}
+	want := `NAME             LABELS      VALUE
+dnsmasq_a_total              0
+dnsmasq_test     server="a"  1.5
+dnsmasq_test     server="b"  2
+`
+	if got := buf.String(); got != want {
+		t.Errorf("writeMetricsTable: got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestWriteLeasesJSON(t *testing.T) {
+	collectors, err := newCollectors(collector.Config{
+		LeasesPath: "collector/testdata/dnsmasq.leases",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf strings.Builder
+	if err := writeLeasesJSON(&buf, collectors); err != nil {
+		t.Fatal(err)
+	}
+	var got []map[string]interface{}
+	if err := json.Unmarshal([]byte(buf.String()), &got); err != nil {
+		t.Fatalf("%v:\n%s", err, buf.String())
+	}
+	want := []map[string]interface{}{
+		{"expiry": float64(1625595932), "mac_address": "00:00:00:00:00:00", "ip_address": "10.10.10.10", "computer_name": "host-1", "client_id": "00:00:00:00:00:00"},
+		{"expiry": float64(0), "mac_address": "00:00:00:00:00:01", "ip_address": "10.10.10.11", "computer_name": "host-2", "client_id": "00:00:00:00:00:01"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("writeLeasesJSON: got %v, want %v", got, want)
+	}
+}
+
+func TestApplyConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	config := `listen: localhost:1234
+dnsmasq:
+  - 127.0.0.1:53
+  - 127.0.0.1:5353
+expose_leases: true
+leases_path: /tmp/dnsmasq.leases
+`
+	if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	listen := fs.String("listen", "localhost:9153", "")
+	dnsmasq := fs.String("dnsmasq", "localhost:53", "")
+	exposeLeases := fs.Bool("expose_leases", false, "")
+	leasesPath := fs.String("leases_path", "/var/lib/misc/dnsmasq.leases", "")
+	if err := fs.Parse([]string{"-leases_path=/run/dnsmasq.leases"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyConfigFile(fs, path); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := *listen, "localhost:1234"; got != want {
+		t.Errorf("listen: got %q, want %q", got, want)
+	}
+	if got, want := *dnsmasq, "127.0.0.1:53,127.0.0.1:5353"; got != want {
+		t.Errorf("dnsmasq: got %q, want %q", got, want)
+	}
+	if !*exposeLeases {
+		t.Errorf("expose_leases: got false, want true")
+	}
+	// Flags on the command line take precedence over the config file.
+	if got, want := *leasesPath, "/run/dnsmasq.leases"; got != want {
+		t.Errorf("leases_path: got %q, want %q", got, want)
+	}
+
+	if err := os.WriteFile(path, []byte("no_such_flag: 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyConfigFile(fs, path); err == nil {
+		t.Errorf("applyConfigFile with an unknown key: got nil error")
+	}
+}
+
+func TestConfigHash(t *testing.T) {
+	newFlagSet := func(args ...string) *flag.FlagSet {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.String("listen", "localhost:9153", "")
+		fs.Bool("expose_leases", false, "")
+		fs.String("auth_token", "", "")
+		if err := fs.Parse(args); err != nil {
+			t.Fatal(err)
+		}
+		return fs
+	}
+	base := configHash(newFlagSet())
+	if got := configHash(newFlagSet()); got != base {
+		t.Errorf("configHash is not stable: got %q and %q", base, got)
+	}
+	// Explicitly passing the default value does not change the effective
+	// configuration.
+	if got := configHash(newFlagSet("-expose_leases=false")); got != base {
+		t.Errorf("configHash(-expose_leases=false) = %q, want %q", got, base)
+	}
+	if got := configHash(newFlagSet("-expose_leases")); got == base {
+		t.Errorf("configHash(-expose_leases) = %q, want a different hash", got)
+	}
+	// Secrets are not hashed.
+	if got := configHash(newFlagSet("-auth_token=secret")); got != base {
+		t.Errorf("configHash(-auth_token=secret) = %q, want %q", got, base)
+	}
+}
+
+func TestNewDNSClientReadTimeout(t *testing.T) {
+	// A dnsmasq which accepts connections but does not answer.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	c := newDNSClient("tcp", 5*time.Second, 100*time.Millisecond)
+	m := new(dns.Msg)
+	m.SetQuestion("cachesize.bind.", dns.TypeTXT)
+	start := time.Now()
+	_, _, err = c.Exchange(m, ln.Addr().String())
+	if elapsed := time.Since(start); elapsed >= 5*time.Second {
+		t.Errorf("Exchange took %v, want the read timeout of 100ms", elapsed)
+	}
+	opErr, ok := err.(*net.OpError)
+	if !ok || !opErr.Timeout() || opErr.Op != "read" {
+		t.Errorf("Exchange: got error %v, want a read timeout", err)
+	}
+}
+
+func TestDNSTCPKeepAlive(t *testing.T) {
+	defer flag.Set("dns_tcp_keepalive", dnsTCPKeepAlive.String())
+	if err := flag.Set("dns_tcp_keepalive", "30s"); err != nil {
+		t.Fatal(err)
+	}
+	dialer, err := newDNSDialer("", time.Second, *dnsTCPKeepAlive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newDNSClient("tcp", time.Second, 0)
+	c.Dialer = dialer
+	if c.Dialer == nil {
+		t.Fatal("newDNSDialer with a keep-alive period returned no dialer")
+	}
+	if got, want := c.Dialer.KeepAlive, 30*time.Second; got != want {
+		t.Errorf("Dialer.KeepAlive: got %v, want %v", got, want)
+	}
+	if got, want := c.Dialer.Timeout, time.Second; got != want {
+		t.Errorf("Dialer.Timeout: got %v, want %v", got, want)
+	}
+
+	// Without -dns_tcp_keepalive or -dns_interface, the dns.Client default
+	// dialer is used.
+	dialer, err = newDNSDialer("", time.Second, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dialer != nil {
+		t.Errorf("newDNSDialer: got %+v, want nil", dialer)
+	}
+}
+
+func TestNewExporterRegistry(t *testing.T) {
+	for _, labels := range []prometheus.Labels{nil, {"env": "prod"}} {
+		g, err := newExporterRegistry(labels, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mfs, err := g.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make(map[string]bool)
+		for _, mf := range mfs {
+			got[mf.GetName()] = true
+			for _, m := range mf.GetMetric() {
+				var env string
+				for _, lp := range m.GetLabel() {
+					if lp.GetName() == "env" {
+						env = lp.GetValue()
+					}
+				}
+				if env != labels["env"] {
+					t.Errorf("labels %v: %s has env label %q, want %q", labels, mf.GetName(), env, labels["env"])
+				}
+			}
+		}
+		names := []string{"go_goroutines", "go_memstats_alloc_bytes", "dnsmasq_exporter_build_info"}
+		if runtime.GOOS == "linux" {
+			// The process collector reads /proc.
+			names = append(names, "process_resident_memory_bytes")
+		}
+		for _, name := range names {
+			if !got[name] {
+				t.Errorf("labels %v: %s is not exposed", labels, name)
+			}
+		}
+	}
+}
+
+// gatherValues returns the values of the metrics gathered from g, keyed by
+// name and label values, and their types, keyed by name.
+func gatherValues(t *testing.T, g prometheus.Gatherer) (map[string]float64, map[string]string) {
+	t.Helper()
+	mfs, err := g.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[string]float64)
+	types := make(map[string]string)
+	for _, mf := range mfs {
+		types[mf.GetName()] = mf.GetType().String()
+		for _, m := range mf.GetMetric() {
+			name := mf.GetName()
+			for _, lp := range m.GetLabel() {
+				name += " " + lp.GetValue()
+			}
+			values[name] = m.GetGauge().GetValue() + m.GetCounter().GetValue()
+		}
+	}
+	return values, types
+}
+
+func TestClusterCollector(t *testing.T) {
+	peer := httptest.NewServer(requireBearerToken("secret", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`# TYPE dnsmasq_leases gauge
+dnsmasq_leases 3
+# TYPE dnsmasq_hits counter
+dnsmasq_hits{instance="127.0.0.1:53"} 10
+dnsmasq_hits{instance="127.0.0.2:53"} 20
+`))
+	})))
+	defer peer.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	defer down.Close()
+
+	local := prometheus.NewRegistry()
+	leases := prometheus.NewGauge(prometheus.GaugeOpts{Name: "dnsmasq_leases", Help: "leases"})
+	leases.Set(2)
+	local.MustRegister(leases)
+
+	reg := prometheus.NewRegistry()
+	peerAddr := strings.TrimPrefix(peer.URL, "http://")
+	reg.MustRegister(newClusterCollector(local, []string{peerAddr, down.URL}, time.Second, "secret"))
+	got, types := gatherValues(t, reg)
+	want := map[string]float64{
+		"dnsmasq_cluster_leases":                                  5,
+		"dnsmasq_cluster_hits":                                    30,
+		"dnsmasq_cluster_peer_up http://" + peerAddr + "/metrics": 1,
+		"dnsmasq_cluster_peer_up " + down.URL:                     0,
+		"dnsmasq_cluster_peers_failed":                            1,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("cluster metrics: got %v, want %v", got, want)
+	}
+	for name, want := range map[string]string{
+		"dnsmasq_cluster_leases": "GAUGE",
+		"dnsmasq_cluster_hits":   "COUNTER",
+	} {
+		if got := types[name]; got != want {
+			t.Errorf("%s: got type %s, want %s", name, got, want)
+		}
+	}
+}
+
+func TestClusterCollectorMutualPeers(t *testing.T) {
+	// Two exporters which list each other in -peers, wired like main.
+	type exporter struct {
+		srv     *httptest.Server
+		handler http.Handler
+		gather  prometheus.Gatherer
+	}
+	newExporter := func(leases float64) *exporter {
+		e := &exporter{}
+		e.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			e.handler.ServeHTTP(w, r)
+		}))
+		local := prometheus.NewRegistry()
+		g := prometheus.NewGauge(prometheus.GaugeOpts{Name: "dnsmasq_leases", Help: "leases"})
+		g.Set(leases)
+		local.MustRegister(g)
+		e.gather = local
+		return e
+	}
+	a, b := newExporter(2), newExporter(3)
+	defer a.srv.Close()
+	defer b.srv.Close()
+	for _, pair := range [][2]*exporter{{a, b}, {b, a}} {
+		e, peer := pair[0], pair[1]
+		clusterReg := prometheus.NewRegistry()
+		clusterReg.MustRegister(newClusterCollector(e.gather, []string{peer.srv.URL}, time.Second, ""))
+		e.handler = peerAwareHandler(
+			promhttp.HandlerFor(e.gather, promhttp.HandlerOpts{}),
+			promhttp.HandlerFor(prometheus.Gatherers{e.gather, clusterReg}, promhttp.HandlerOpts{}))
+	}
+
+	resp, err := http.Get(a.srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var parser expfmt.TextParser
+	mfs, err := parser.TextToMetricFamilies(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := mfs["dnsmasq_cluster_leases"].GetMetric()[0].GetGauge().GetValue(), float64(5); got != want {
+		t.Errorf("dnsmasq_cluster_leases: got %v, want %v", got, want)
+	}
+	if got, want := mfs["dnsmasq_cluster_peer_up"].GetMetric()[0].GetGauge().GetValue(), float64(1); got != want {
+		t.Errorf("dnsmasq_cluster_peer_up: got %v, want %v", got, want)
+	}
+}
+
+func TestRequireBearerToken(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("metrics"))
+	})
+	for _, tt := range []struct {
+		token         string
+		authorization string
+		want          int
+	}{
+		{token: "", authorization: "", want: http.StatusOK},
+		{token: "secret", authorization: "Bearer secret", want: http.StatusOK},
+		{token: "secret", authorization: "", want: http.StatusUnauthorized},
+		{token: "secret", authorization: "Bearer wrong", want: http.StatusUnauthorized},
+		{token: "secret", authorization: "secret", want: http.StatusUnauthorized},
+		{token: "secret", authorization: "Basic c2VjcmV0", want: http.StatusUnauthorized},
+	} {
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		if tt.authorization != "" {
+			req.Header.Set("Authorization", tt.authorization)
+		}
+		rec := httptest.NewRecorder()
+		requireBearerToken(tt.token, ok).ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("token %q, Authorization %q: got status %d, want %d", tt.token, tt.authorization, rec.Code, tt.want)
+		}
+		if rec.Code == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("token %q, Authorization %q: no WWW-Authenticate header", tt.token, tt.authorization)
+		}
+	}
+}
+
+func TestStatsRecordName(t *testing.T) {
+	for in, want := range map[string]string{
+		"hits":          "hits.bind.",
+		"hits.bind":     "hits.bind.",
+		" Misses.bind.": "misses.bind.",
+		"foo.example":   "foo.example.",
+	} {
+		if got := statsRecordName(in); got != want {
+			t.Errorf("statsRecordName(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestLimitConcurrency(t *testing.T) {
+	const max = 2
+	var inFlight, maxInFlight int32
+	release := make(chan struct{})
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			m := atomic.LoadInt32(&maxInFlight)
+			if n <= m || atomic.CompareAndSwapInt32(&maxInFlight, m, n) {
+				break
+			}
+		}
+		<-release
+	})
+	srv := httptest.NewServer(limitConcurrency(max, 50*time.Millisecond, slow))
+	defer srv.Close()
+
+	const requests = 10
+	codes := make(chan int, requests)
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := http.Get(srv.URL)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+			codes <- resp.StatusCode
+		}()
+	}
+	// The requests beyond max time out while the first ones are blocked.
+	time.Sleep(200 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(codes)
+
+	counts := make(map[int]int)
+	for code := range codes {
+		counts[code]++
+	}
+	if got, want := counts[http.StatusOK], max; got != want {
+		t.Errorf("successful requests: got %d, want %d (status codes: %v)", got, want, counts)
+	}
+	if got, want := counts[http.StatusServiceUnavailable], requests-max; got != want {
+		t.Errorf("rejected requests: got %d, want %d (status codes: %v)", got, want, counts)
+	}
+	if got := atomic.LoadInt32(&maxInFlight); got > max {
+		t.Errorf("concurrent requests: got %d, want at most %d", got, max)
+	}
+}
+
+func TestNewExporterRegistryMinimal(t *testing.T) {
+	configInfo := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "dnsmasq_exporter_config_info",
+		Help: "config",
+	})
+	for _, labels := range []prometheus.Labels{nil, {"env": "prod"}} {
+		g, err := newExporterRegistry(labels, true, configInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mfs, err := g.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, mf := range mfs {
+			got = append(got, mf.GetName())
+		}
+		want := []string{"dnsmasq_exporter_build_info", "dnsmasq_exporter_config_info"}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("labels %v: got metrics %v, want %v", labels, got, want)
+		}
+	}
+}
+
+func TestTargetInfo(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(newTargetInfo("127.0.0.1:53", "/var/lib/misc/\"dnsmasq\"\\\n\xff.leases"))
+	var buf strings.Builder
+	if err := writeMetrics(&buf, reg); err != nil {
+		t.Fatal(err)
+	}
+	want := `dnsmasq_exporter_target_info{dnsmasq_addr="127.0.0.1:53",leases_path="/var/lib/misc/\"dnsmasq\"\\\n` + "\uFFFD" + `.leases"} 1`
+	if !strings.Contains(buf.String(), want+"\n") {
+		t.Errorf("metrics do not contain %s:\n%s", want, buf.String())
+	}
+}
+
+func TestPushMetrics(t *testing.T) {
+	type pushed struct {
+		method, path string
+		mfs          map[string]*dto.MetricFamily
+	}
+	pushes := make(chan pushed, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := pushed{method: r.Method, path: r.URL.Path, mfs: make(map[string]*dto.MetricFamily)}
+		dec := expfmt.NewDecoder(r.Body, expfmt.ResponseFormat(r.Header))
+		for {
+			var mf dto.MetricFamily
+			if err := dec.Decode(&mf); err != nil {
+				if err != io.EOF {
+					t.Error(err)
+				}
+				break
+			}
+			p.mfs[mf.GetName()] = &mf
+		}
+		select {
+		case pushes <- p:
+		default:
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	reg := prometheus.NewRegistry()
+	leases := prometheus.NewGauge(prometheus.GaugeOpts{Name: "dnsmasq_leases", Help: "leases"})
+	leases.Set(3)
+	reg.MustRegister(leases)
+	go pushMetrics(newPusher(srv.URL, "router", reg), time.Hour)
+
+	var p pushed
+	select {
+	case p = <-pushes:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no push received")
+	}
+	if got, want := p.method, http.MethodPut; got != want {
+		t.Errorf("push method: got %s, want %s", got, want)
+	}
+	if got, want := p.path, "/metrics/job/dnsmasq/instance/router"; got != want {
+		t.Errorf("push path (grouping key): got %s, want %s", got, want)
+	}
+	mf, ok := p.mfs["dnsmasq_leases"]
+	if !ok {
+		t.Fatalf("pushed metrics do not contain dnsmasq_leases: %v", p.mfs)
+	}
+	if got, want := mf.GetMetric()[0].GetGauge().GetValue(), float64(3); got != want {
+		t.Errorf("dnsmasq_leases: got %v, want %v", got, want)
+	}
+}
+
+func TestWriteTextfile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "dnsmasq.prom")
+	if err := os.WriteFile(path, []byte("# stale\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	old, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reg := prometheus.NewRegistry()
+	leases := prometheus.NewGauge(prometheus.GaugeOpts{Name: "dnsmasq_leases", Help: "leases"})
+	leases.Set(3)
+	reg.MustRegister(leases)
+	go writeTextfile(path, reg, time.Hour)
+
+	var b []byte
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if b, err = os.ReadFile(path); err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != "# stale\n" {
+			break
+		}
+	}
+	var parser expfmt.TextParser
+	mfs, err := parser.TextToMetricFamilies(strings.NewReader(string(b)))
+	if err != nil {
+		t.Fatalf("textfile does not parse: %v\n%s", err, b)
+	}
+	if got, want := mfs["dnsmasq_leases"].GetMetric()[0].GetGauge().GetValue(), float64(3); got != want {
+		t.Errorf("dnsmasq_leases: got %v, want %v", got, want)
+	}
+
+	// The file was replaced by renaming a temporary file over it, not
+	// rewritten in place, and no temporary file is left behind.
+	cur, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if os.SameFile(old, cur) {
+		t.Errorf("%s was rewritten in place instead of replaced", path)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		t.Errorf("directory contains %v, want only %s", names, filepath.Base(path))
+	}
+}
+
+func TestH2C(t *testing.T) {
+	ts := httptest.NewServer(withH2C(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	})))
+	defer ts.Close()
+
+	// A prior knowledge client speaks HTTP/2 over a plain TCP connection.
+	client := &http.Client{
+		Transport: &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, addr)
+			},
+		},
+	}
+	resp, err := client.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ProtoMajor != 2 || string(b) != "HTTP/2.0" {
+		t.Errorf("got response %s with request %s, want HTTP/2.0", resp.Proto, b)
+	}
+
+	// Other clients are still served HTTP/1.1.
+	resp, err = http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 1 {
+		t.Errorf("got response %s, want HTTP/1.1", resp.Proto)
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// leasesFetcher runs a command which fetches the leases file from a remote
+// host (e.g. via rsync or scp) into a local file, from which the collectors
+// read the leases. The command writes to the path in $LEASES_PATH, which is
+// renamed over the local file only if the command succeeds, so that the
+// collectors never read a partially fetched file.
+type leasesFetcher struct {
+	cmd      string
+	path     string // of the local leases file
+	failures prometheus.Counter
+}
+
+// newLeasesFetcher returns a leasesFetcher for the shell command cmd, whose
+// local leases file is in a new temporary directory.
+func newLeasesFetcher(cmd string) (*leasesFetcher, error) {
+	dir, err := os.MkdirTemp("", "dnsmasq_exporter")
+	if err != nil {
+		return nil, err
+	}
+	return &leasesFetcher{
+		cmd:  cmd,
+		path: filepath.Join(dir, "dnsmasq.leases"),
+		failures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "dnsmasq_exporter_leases_fetch_failures_total",
+			Help: "Number of times -leases_fetch_cmd failed",
+		}),
+	}, nil
+}
+
+// fetch runs the command, killing it after timeout, and replaces the local
+// leases file with the fetched one.
+func (f *leasesFetcher) fetch(timeout time.Duration) error {
+	// The temporary file only reserves a unique name: it is removed so that
+	// a command which does not write the leases file can be detected.
+	tmpFile, err := os.CreateTemp(filepath.Dir(f.path), "dnsmasq.leases.*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := tmpFile.Name()
+	tmpFile.Close()
+	if err := os.Remove(tmp); err != nil {
+		return err
+	}
+	defer os.Remove(tmp) // if the command failed after writing it
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", f.cmd)
+	cmd.Env = append(os.Environ(), "LEASES_PATH="+tmp)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%q: %v", f.cmd, err)
+	}
+	if _, err := os.Stat(tmp); err != nil {
+		return fmt.Errorf("%q did not write the leases file to $LEASES_PATH: %v", f.cmd, err)
+	}
+	return os.Rename(tmp, f.path)
+}
+
+// run fetches the leases file every interval, each time with interval as the
+// timeout. Failures are logged and counted; the collectors keep reading the
+// previously fetched file.
+func (f *leasesFetcher) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := f.fetch(interval); err != nil {
+			f.failures.Inc()
+			log.Printf("could not fetch the leases file: %v", err)
+		}
+	}
+}
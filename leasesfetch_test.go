@@ -0,0 +1,73 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLeasesFetcher(t *testing.T) {
+	f, err := newLeasesFetcher(`printf '0 00:00:00:00:00:00 10.10.10.10 host-1 *\n' > "$LEASES_PATH"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(filepath.Dir(f.path))
+	if err := f.fetch(10 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(f.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), "0 00:00:00:00:00:00 10.10.10.10 host-1 *\n"; got != want {
+		t.Errorf("fetched leases: got %q, want %q", got, want)
+	}
+
+	// A failing command, even if it wrote a partial file, leaves the
+	// previously fetched file in place.
+	for _, cmd := range []string{
+		`echo partial > "$LEASES_PATH"; exit 1`,
+		`true`,
+		`sleep 10`,
+	} {
+		f.cmd = cmd
+		if err := f.fetch(100 * time.Millisecond); err == nil {
+			t.Errorf("fetch(%q): unexpectedly succeeded", cmd)
+		}
+		b, err := os.ReadFile(f.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := string(b), "0 00:00:00:00:00:00 10.10.10.10 host-1 *\n"; got != want {
+			t.Errorf("after fetch(%q): leases: got %q, want %q", cmd, got, want)
+		}
+	}
+
+	// No temporary files are left behind.
+	entries, err := os.ReadDir(filepath.Dir(f.path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		t.Errorf("directory contains %v, want only %s", names, filepath.Base(f.path))
+	}
+}
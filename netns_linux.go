@@ -0,0 +1,128 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/sys/unix"
+)
+
+// netnsClient sends DNS queries from within the network namespace at path
+// (e.g. /var/run/netns/lan), so that dnsmasq can be reached on an address
+// which is only bound inside that namespace. Only the sockets are created in
+// the namespace; the exporter itself stays in its own.
+type netnsClient struct {
+	client *dns.Client
+	path   string
+}
+
+func newNetnsClient(client *dns.Client, path string) (*netnsClient, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	return &netnsClient{client: client, path: path}, nil
+}
+
+// dial connects to address from a socket created in the namespace.
+func (c *netnsClient) dial(address string) (*dns.Conn, error) {
+	type result struct {
+		conn *dns.Conn
+		err  error
+	}
+	resultc := make(chan result, 1)
+	// setns(2) changes the namespace of the calling thread only. The
+	// goroutine is locked to its thread, and if switching back fails, it
+	// exits without unlocking so that the thread is terminated instead of
+	// being reused by other goroutines.
+	go func() {
+		runtime.LockOSThread()
+		conn, err := c.dialInNetns(address)
+		if err == errRestoreNetns {
+			resultc <- result{nil, err}
+			return
+		}
+		runtime.UnlockOSThread()
+		resultc <- result{conn, err}
+	}()
+	r := <-resultc
+	return r.conn, r.err
+}
+
+var errRestoreNetns = errors.New("could not switch back to the original network namespace")
+
+func (c *netnsClient) dialInNetns(address string) (*dns.Conn, error) {
+	orig, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", unix.Gettid()))
+	if err != nil {
+		return nil, err
+	}
+	defer orig.Close()
+	ns, err := os.Open(c.path)
+	if err != nil {
+		return nil, err
+	}
+	defer ns.Close()
+	if err := unix.Setns(int(ns.Fd()), unix.CLONE_NEWNET); err != nil {
+		return nil, fmt.Errorf("entering network namespace %s: %v", c.path, err)
+	}
+	conn, err := c.client.Dial(address)
+	if err := unix.Setns(int(orig.Fd()), unix.CLONE_NEWNET); err != nil {
+		if conn != nil {
+			conn.Close()
+		}
+		return nil, errRestoreNetns
+	}
+	return conn, err
+}
+
+func (c *netnsClient) Exchange(m *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+	co, err := c.dial(address)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer co.Close()
+	co.UDPSize = c.client.UDPSize
+	if opt := m.IsEdns0(); opt != nil && opt.UDPSize() >= dns.MinMsgSize {
+		co.UDPSize = opt.UDPSize()
+	}
+	timeout := 2 * time.Second
+	if c.client.ReadTimeout > 0 {
+		timeout = c.client.ReadTimeout
+	}
+	if err := co.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, 0, err
+	}
+
+	start := time.Now()
+	if err := co.WriteMsg(m); err != nil {
+		return nil, 0, err
+	}
+	r, err := co.ReadMsg()
+	if err != nil {
+		return nil, 0, err
+	}
+	if r.Id != m.Id {
+		return nil, 0, dns.ErrId
+	}
+	return r, time.Since(start), nil
+}
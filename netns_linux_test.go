@@ -0,0 +1,56 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestNetnsClient(t *testing.T) {
+	if _, err := newNetnsClient(&dns.Client{}, "/nonexistent/netns"); err == nil {
+		t.Error("newNetnsClient unexpectedly succeeded for a nonexistent namespace")
+	}
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(r)
+		w.WriteMsg(resp)
+	})}
+	go srv.ActivateAndServe()
+	defer srv.Shutdown()
+
+	// Entering our own namespace exercises the setns round trip without
+	// needing a second namespace, but still requires CAP_SYS_ADMIN.
+	c, err := newNetnsClient(&dns.Client{}, "/proc/self/ns/net")
+	if err != nil {
+		t.Skip(err)
+	}
+	m := new(dns.Msg)
+	m.SetQuestion("cachesize.bind.", dns.TypeTXT)
+	if _, _, err := c.Exchange(m, pc.LocalAddr().String()); err != nil {
+		if strings.HasPrefix(err.Error(), "entering network namespace") {
+			t.Skip(err)
+		}
+		t.Fatal(err)
+	}
+}
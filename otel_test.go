@@ -0,0 +1,83 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/dnsmasq_exporter/collector"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestOtelTracer(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	tracer := otelTracer{tracer: provider.Tracer("test")}
+
+	_, end := tracer.Start(context.Background(), "ok")
+	end(nil)
+	_, end = tracer.Start(context.Background(), "failed")
+	end(errors.New("timeout"))
+	spans := recorder.Ended()
+	if got, want := len(spans), 2; got != want {
+		t.Fatalf("got %d spans, want %d", got, want)
+	}
+	if got, want := spans[0].Name(), "ok"; got != want {
+		t.Errorf("span name: got %q, want %q", got, want)
+	}
+	if got, want := spans[0].Status().Code, codes.Unset; got != want {
+		t.Errorf("span %q status: got %v, want %v", spans[0].Name(), got, want)
+	}
+	if got, want := spans[1].Status(), (sdktrace.Status{Code: codes.Error, Description: "timeout"}); got != want {
+		t.Errorf("span %q status: got %v, want %v", spans[1].Name(), got, want)
+	}
+
+	// The collector records its spans with the tracer.
+	c := collector.New(collector.Config{
+		LeasesPath: "collector/testdata/dnsmasq.leases",
+		Tracer:     tracer,
+	})
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c)
+	if _, err := reg.Gather(); err != nil {
+		t.Fatal(err)
+	}
+	byName := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended()[2:] {
+		byName[span.Name()] = span
+	}
+	collect, ok := byName["dnsmasq.collect"]
+	if !ok {
+		t.Fatalf("no dnsmasq.collect span recorded, got %v", byName)
+	}
+	if collect.Parent().IsValid() {
+		t.Errorf("dnsmasq.collect span has parent %v, want none", collect.Parent().SpanID())
+	}
+	read, ok := byName["dnsmasq.read_leases"]
+	if !ok {
+		t.Fatalf("no dnsmasq.read_leases span recorded, got %v", byName)
+	}
+	if got, want := read.Parent().SpanID(), collect.SpanContext().SpanID(); got != want {
+		t.Errorf("dnsmasq.read_leases span: got parent %v, want dnsmasq.collect span %v", got, want)
+	}
+	if got, want := read.SpanContext().TraceID(), collect.SpanContext().TraceID(); got != want {
+		t.Errorf("dnsmasq.read_leases span: got trace %v, want %v", got, want)
+	}
+}
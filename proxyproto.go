@@ -0,0 +1,85 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// proxyProtocolClient sends DNS queries over TCP, prefixing each connection
+// with a PROXY protocol v1 header, as required by some load balancers in
+// front of dnsmasq. See
+// https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt
+type proxyProtocolClient struct {
+	dialer *net.Dialer
+
+	// readTimeout bounds each exchange after dialing. If zero, 2s (the
+	// dns.Client default) is used.
+	readTimeout time.Duration
+}
+
+func (c *proxyProtocolClient) Exchange(m *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+	conn, err := c.dialer.Dial("tcp", address)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+	timeout := 2 * time.Second
+	if c.readTimeout > 0 {
+		timeout = c.readTimeout
+	}
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, 0, err
+	}
+	if _, err := conn.Write([]byte(proxyHeader(conn.LocalAddr(), conn.RemoteAddr()))); err != nil {
+		return nil, 0, err
+	}
+
+	start := time.Now()
+	co := &dns.Conn{Conn: conn}
+	if err := co.WriteMsg(m); err != nil {
+		return nil, 0, err
+	}
+	r, err := co.ReadMsg()
+	if err != nil {
+		return nil, 0, err
+	}
+	if r.Id != m.Id {
+		return nil, 0, dns.ErrId
+	}
+	return r, time.Since(start), nil
+}
+
+// proxyHeader returns the PROXY protocol v1 header for a TCP connection from
+// src to dst.
+func proxyHeader(src, dst net.Addr) string {
+	s, ok := src.(*net.TCPAddr)
+	if !ok {
+		return "PROXY UNKNOWN\r\n"
+	}
+	d, ok := dst.(*net.TCPAddr)
+	if !ok {
+		return "PROXY UNKNOWN\r\n"
+	}
+	proto := "TCP4"
+	if s.IP.To4() == nil {
+		proto = "TCP6"
+	}
+	return fmt.Sprintf("PROXY %s %s %s %d %d\r\n", proto, s.IP, d.IP, s.Port, d.Port)
+}
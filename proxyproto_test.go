@@ -0,0 +1,110 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestProxyProtocolClient(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	headerc := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// Read the header byte by byte so that the DNS query which follows
+		// it is not consumed.
+		var header []byte
+		b := make([]byte, 1)
+		for !strings.HasSuffix(string(header), "\n") {
+			if _, err := conn.Read(b); err != nil {
+				break
+			}
+			header = append(header, b[0])
+		}
+		headerc <- string(header)
+		co := &dns.Conn{Conn: conn}
+		req, err := co.ReadMsg()
+		if err != nil {
+			return
+		}
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		co.WriteMsg(resp)
+	}()
+
+	c := &proxyProtocolClient{dialer: &net.Dialer{Timeout: time.Second}}
+	m := new(dns.Msg)
+	m.SetQuestion("cachesize.bind.", dns.TypeTXT)
+	if _, _, err := c.Exchange(m, ln.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+
+	header := <-headerc
+	if !strings.HasPrefix(header, "PROXY TCP4 127.0.0.1 127.0.0.1 ") || !strings.HasSuffix(header, "\r\n") {
+		t.Errorf("unexpected PROXY header: %q", header)
+	}
+	if got, want := len(strings.Fields(header)), 6; got != want {
+		t.Errorf("unexpected number of PROXY header fields: got %d, want %d", got, want)
+	}
+}
+
+func TestProxyProtocolClientReadTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		// Accept, but never answer.
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		time.Sleep(5 * time.Second)
+	}()
+
+	c := &proxyProtocolClient{
+		dialer:      &net.Dialer{Timeout: time.Second},
+		readTimeout: 100 * time.Millisecond,
+	}
+	m := new(dns.Msg)
+	m.SetQuestion("cachesize.bind.", dns.TypeTXT)
+	start := time.Now()
+	_, _, err = c.Exchange(m, ln.Addr().String())
+	if err == nil {
+		t.Fatal("Exchange unexpectedly succeeded")
+	}
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Errorf("Exchange: got error %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Exchange took %v, want about the read timeout", elapsed)
+	}
+}
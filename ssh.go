@@ -0,0 +1,240 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sshTunnel reaches a dnsmasq running on a remote host through SSH: DNS
+// queries are sent over TCP connections forwarded by the SSH server, and the
+// leases file is read by running cat on the remote host. The SSH connection
+// is established on first use and re-established after it failed.
+//
+// The leases file is deliberately not read via SFTP: the sftp subsystem is
+// often disabled on the routers and appliances dnsmasq runs on, whereas a
+// shell with cat is always available, and using it avoids an additional
+// dependency.
+type sshTunnel struct {
+	addr        string // host:port of the SSH server
+	config      *ssh.ClientConfig
+	agentSock   string // if non-empty, the SSH agent to authenticate with
+	dialTimeout time.Duration
+	readTimeout time.Duration
+
+	mu     sync.Mutex
+	client *ssh.Client
+}
+
+// newSSHTunnel returns an sshTunnel to target (user@host[:port]), which
+// authenticates using the private key in keyFile or, if keyFile is empty,
+// the SSH agent, and verifies the host key against knownHostsFile. The SSH
+// connection and forwarded DNS connections must be established within
+// dialTimeout, and DNS queries answered within readTimeout.
+func newSSHTunnel(target, keyFile, knownHostsFile string, dialTimeout, readTimeout time.Duration) (*sshTunnel, error) {
+	user, addr, err := parseSSHTarget(target)
+	if err != nil {
+		return nil, err
+	}
+	hostKeyCallback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, err
+	}
+	t := &sshTunnel{
+		addr: addr,
+		config: &ssh.ClientConfig{
+			User:            user,
+			HostKeyCallback: hostKeyCallback,
+			Timeout:         dialTimeout,
+		},
+		dialTimeout: dialTimeout,
+		readTimeout: readTimeout,
+	}
+	if keyFile != "" {
+		b, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(b)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", keyFile, err)
+		}
+		t.config.Auth = []ssh.AuthMethod{ssh.PublicKeys(signer)}
+	} else {
+		t.agentSock = os.Getenv("SSH_AUTH_SOCK")
+		if t.agentSock == "" {
+			return nil, fmt.Errorf("no SSH key file given and SSH_AUTH_SOCK is not set")
+		}
+	}
+	return t, nil
+}
+
+// parseSSHTarget splits user@host[:port] into the user and host:port,
+// defaulting to port 22.
+func parseSSHTarget(target string) (user, addr string, err error) {
+	idx := strings.LastIndex(target, "@")
+	if idx < 1 || idx == len(target)-1 {
+		return "", "", fmt.Errorf("%q is not of the form user@host[:port]", target)
+	}
+	user, addr = target[:idx], target[idx+1:]
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(strings.Trim(addr, "[]"), "22")
+	}
+	return user, addr, nil
+}
+
+// dial connects to the SSH server. The SSH agent, if any, is connected to
+// anew for every connection so that restarting the agent does not break
+// reconnecting.
+func (t *sshTunnel) dial() (*ssh.Client, error) {
+	config := *t.config
+	if t.agentSock != "" {
+		conn, err := net.Dial("unix", t.agentSock)
+		if err != nil {
+			return nil, fmt.Errorf("connecting to the SSH agent: %v", err)
+		}
+		defer conn.Close()
+		config.Auth = []ssh.AuthMethod{ssh.PublicKeysCallback(agent.NewClient(conn).Signers)}
+	}
+	return ssh.Dial("tcp", t.addr, &config)
+}
+
+// do calls f with the SSH client, connecting first if necessary. If f fails,
+// the connection is closed so that the next call reconnects.
+func (t *sshTunnel) do(f func(*ssh.Client) error) error {
+	t.mu.Lock()
+	client := t.client
+	if client == nil {
+		var err error
+		client, err = t.dial()
+		if err != nil {
+			t.mu.Unlock()
+			return err
+		}
+		t.client = client
+	}
+	t.mu.Unlock()
+
+	err := f(client)
+	if err != nil {
+		t.mu.Lock()
+		if t.client == client {
+			t.client.Close()
+			t.client = nil
+		}
+		t.mu.Unlock()
+	}
+	return err
+}
+
+// Exchange sends m over a TCP connection to address, as seen from the SSH
+// server.
+func (t *sshTunnel) Exchange(m *dns.Msg, address string) (r *dns.Msg, rtt time.Duration, err error) {
+	err = t.do(func(client *ssh.Client) error {
+		// Forwarded connections do not support deadlines, so time out by
+		// closing: opening the channel is aborted by closing the SSH
+		// connection (do reconnects on the next call), reading the answer
+		// by closing the channel.
+		timer := time.AfterFunc(t.dialTimeout, func() { client.Close() })
+		conn, err := client.Dial("tcp", address)
+		if !timer.Stop() {
+			if err == nil {
+				conn.Close()
+			}
+			return fmt.Errorf("dialing %s via SSH: timeout after %v", address, t.dialTimeout)
+		}
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		var timedOut int32
+		timer = time.AfterFunc(t.readTimeout, func() {
+			atomic.StoreInt32(&timedOut, 1)
+			conn.Close()
+		})
+		defer timer.Stop()
+		start := time.Now()
+		co := &dns.Conn{Conn: conn}
+		err = co.WriteMsg(m)
+		if err == nil {
+			r, err = co.ReadMsg()
+		}
+		if atomic.LoadInt32(&timedOut) == 1 {
+			return fmt.Errorf("exchanging with %s via SSH: timeout after %v", address, t.readTimeout)
+		}
+		if err != nil {
+			return err
+		}
+		if r.Id != m.Id {
+			return dns.ErrId
+		}
+		rtt = time.Since(start)
+		return nil
+	})
+	return r, rtt, err
+}
+
+// sshNotExist is the exit status of the command run by OpenLeases if the file does not
+// exist.
+const sshNotExist = 3
+
+// OpenLeases reads the file at path on the remote host.
+func (t *sshTunnel) OpenLeases(path string) (io.ReadCloser, error) {
+	var out []byte
+	var exitErr *ssh.ExitError
+	err := t.do(func(client *ssh.Client) error {
+		session, err := client.NewSession()
+		if err != nil {
+			return err
+		}
+		defer session.Close()
+		quoted := shellQuote(path)
+		out, err = session.Output(fmt.Sprintf("test -e %s || exit %d; cat %s", quoted, sshNotExist, quoted))
+		if e, ok := err.(*ssh.ExitError); ok {
+			// The connection works, only the command failed.
+			exitErr = e
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if exitErr != nil {
+		if exitErr.ExitStatus() == sshNotExist {
+			return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+		}
+		return nil, fmt.Errorf("reading %s via SSH: %v", path, exitErr)
+	}
+	return io.NopCloser(bytes.NewReader(out)), nil
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
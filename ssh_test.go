@@ -0,0 +1,338 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func TestParseSSHTarget(t *testing.T) {
+	for _, tt := range []struct {
+		in      string
+		user    string
+		addr    string
+		wantErr bool
+	}{
+		{in: "root@router", user: "root", addr: "router:22"},
+		{in: "root@router:2222", user: "root", addr: "router:2222"},
+		{in: "root@[fe80::1]", user: "root", addr: "[fe80::1]:22"},
+		{in: "root@[fe80::1]:2222", user: "root", addr: "[fe80::1]:2222"},
+		{in: "router", wantErr: true},
+		{in: "@router", wantErr: true},
+		{in: "root@", wantErr: true},
+	} {
+		user, addr, err := parseSSHTarget(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseSSHTarget(%q): got nil error", tt.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseSSHTarget(%q): %v", tt.in, err)
+			continue
+		}
+		if user != tt.user || addr != tt.addr {
+			t.Errorf("parseSSHTarget(%q) = %q, %q, want %q, %q", tt.in, user, addr, tt.user, tt.addr)
+		}
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	if got, want := shellQuote("/var/lib/misc/it's.leases"), `'/var/lib/misc/it'\''s.leases'`; got != want {
+		t.Errorf("shellQuote: got %s, want %s", got, want)
+	}
+}
+
+// fakeSSHServer starts an SSH server which accepts the key authorized,
+// forwards TCP connections and runs commands with sh. It returns the address
+// and the host key of the server.
+func fakeSSHServer(t *testing.T, authorized ssh.PublicKey) (string, ssh.PublicKey) {
+	t.Helper()
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if !bytes.Equal(key.Marshal(), authorized.Marshal()) {
+				return nil, fmt.Errorf("unknown key")
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostSigner)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveSSH(conn, config)
+		}
+	}()
+	return ln.Addr().String(), hostSigner.PublicKey()
+}
+
+func serveSSH(conn net.Conn, config *ssh.ServerConfig) {
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	defer sconn.Close()
+	go ssh.DiscardRequests(reqs)
+	for newCh := range chans {
+		switch newCh.ChannelType() {
+		case "direct-tcpip":
+			var p struct {
+				Host     string
+				Port     uint32
+				OrigHost string
+				OrigPort uint32
+			}
+			if err := ssh.Unmarshal(newCh.ExtraData(), &p); err != nil {
+				newCh.Reject(ssh.ConnectionFailed, err.Error())
+				continue
+			}
+			target, err := net.Dial("tcp", net.JoinHostPort(p.Host, strconv.Itoa(int(p.Port))))
+			if err != nil {
+				newCh.Reject(ssh.ConnectionFailed, err.Error())
+				continue
+			}
+			ch, chReqs, err := newCh.Accept()
+			if err != nil {
+				target.Close()
+				continue
+			}
+			go ssh.DiscardRequests(chReqs)
+			go func() {
+				io.Copy(ch, target)
+				ch.Close()
+			}()
+			go func() {
+				io.Copy(target, ch)
+				target.Close()
+			}()
+
+		case "session":
+			ch, chReqs, err := newCh.Accept()
+			if err != nil {
+				continue
+			}
+			go func() {
+				defer ch.Close()
+				for req := range chReqs {
+					if req.Type != "exec" {
+						req.Reply(false, nil)
+						continue
+					}
+					var p struct{ Command string }
+					if err := ssh.Unmarshal(req.Payload, &p); err != nil {
+						req.Reply(false, nil)
+						return
+					}
+					req.Reply(true, nil)
+					cmd := exec.Command("sh", "-c", p.Command)
+					cmd.Stdout = ch
+					cmd.Stderr = ch.Stderr()
+					var status uint32
+					if err := cmd.Run(); err != nil {
+						status = 127
+						if e, ok := err.(*exec.ExitError); ok {
+							status = uint32(e.ExitCode())
+						}
+					}
+					ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+					return
+				}
+			}()
+
+		default:
+			newCh.Reject(ssh.UnknownChannelType, newCh.ChannelType())
+		}
+	}
+}
+
+// newTestSSHTunnel returns an sshTunnel to a fakeSSHServer.
+func newTestSSHTunnel(t *testing.T, dialTimeout, readTimeout time.Duration) *sshTunnel {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake SSH server runs commands with sh")
+	}
+	dir := t.TempDir()
+	_, clientKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(clientKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "id_ed25519")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	addr, hostKey := fakeSSHServer(t, signer.PublicKey())
+	knownHostsFile := filepath.Join(dir, "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(addr)}, hostKey) + "\n"
+	if err := os.WriteFile(knownHostsFile, []byte(line), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tunnel, err := newSSHTunnel("dnsmasq@"+addr, keyFile, knownHostsFile, dialTimeout, readTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if tunnel.client != nil {
+			tunnel.client.Close()
+		}
+	})
+	return tunnel
+}
+
+func TestSSHTunnelExchange(t *testing.T) {
+	tunnel := newTestSSHTunnel(t, time.Second, time.Second)
+	if got, want := tunnel.config.Timeout, time.Second; got != want {
+		t.Errorf("SSH dial timeout: got %v, want %v", got, want)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{
+		Listener: ln,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetReply(r)
+			m.Answer = []dns.RR{&dns.TXT{
+				Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS},
+				Txt: []string{"666"},
+			}}
+			w.WriteMsg(m)
+		}),
+	}
+	started := make(chan struct{})
+	srv.NotifyStartedFunc = func() { close(started) }
+	go srv.ActivateAndServe()
+	<-started
+	defer srv.Shutdown()
+
+	m := new(dns.Msg)
+	m.SetQuestion("cachesize.bind.", dns.TypeTXT)
+	m.Question[0].Qclass = dns.ClassCHAOS
+	r, _, err := tunnel.Exchange(m, ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Answer) != 1 {
+		t.Fatalf("got %d answers, want 1: %v", len(r.Answer), r)
+	}
+	if got, want := r.Answer[0].(*dns.TXT).Txt, []string{"666"}; len(got) != 1 || got[0] != want[0] {
+		t.Errorf("TXT: got %q, want %q", got, want)
+	}
+}
+
+func TestSSHTunnelExchangeReadTimeout(t *testing.T) {
+	tunnel := newTestSSHTunnel(t, time.Second, 100*time.Millisecond)
+
+	// A dnsmasq which accepts connections but does not answer.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	m := new(dns.Msg)
+	m.SetQuestion("cachesize.bind.", dns.TypeTXT)
+	start := time.Now()
+	_, _, err = tunnel.Exchange(m, ln.Addr().String())
+	if elapsed := time.Since(start); elapsed >= 5*time.Second {
+		t.Errorf("Exchange took %v, want the read timeout of 100ms", elapsed)
+	}
+	if err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Errorf("Exchange: got error %v, want a timeout", err)
+	}
+}
+
+func TestSSHTunnelOpenLeases(t *testing.T) {
+	tunnel := newTestSSHTunnel(t, time.Second, time.Second)
+
+	leases := "1625595932 00:00:00:00:00:00 10.10.10.10 host-1 *\n"
+	path := filepath.Join(t.TempDir(), "it's.leases")
+	if err := os.WriteFile(path, []byte(leases), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rc, err := tunnel.OpenLeases(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	b, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), leases; got != want {
+		t.Errorf("OpenLeases(%s): got %q, want %q", path, got, want)
+	}
+
+	missing := filepath.Join(t.TempDir(), "missing.leases")
+	if _, err := tunnel.OpenLeases(missing); !os.IsNotExist(err) {
+		t.Errorf("OpenLeases(%s): got error %v, want a not exist error", missing, err)
+	}
+}